@@ -0,0 +1,252 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/flamegraph"
+	"github.com/daniel-cole/phunter/phpspy"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// DefaultTop is how many entries each list in a summary has by default
+const DefaultTop = 10
+
+// Summary is where a trace spent its samples
+type Summary struct {
+	Format               string  `json:"format"`
+	Samples              int     `json:"samples"`
+	FunctionsBySelf      []Entry `json:"functions_by_self"`      // the functions that were running
+	FunctionsByInclusive []Entry `json:"functions_by_inclusive"` // the functions that were on the stack
+	Files                []Entry `json:"files"`                  // by self samples, C functions count towards the file that called them
+	RequestSamples       int     `json:"request_samples"`        // samples with request info, see phpspy's -r option
+	RequestURIs          []Count `json:"request_uris"`           // without the query string
+	RequestMethods       []Count `json:"request_methods"`
+}
+
+// Entry is the samples of a function or file, each sample is counted once towards the inclusive
+// samples of a function however many times it appears on the stack
+type Entry struct {
+	Name             string  `json:"name"`
+	Self             int     `json:"self"`
+	SelfPercent      float64 `json:"self_percent"`
+	Inclusive        int     `json:"inclusive"`
+	InclusivePercent float64 `json:"inclusive_percent"`
+}
+
+// Count is the samples taken while handling a request URI or method
+type Count struct {
+	Name    string  `json:"name"`
+	Samples int     `json:"samples"`
+	Percent float64 `json:"percent"` // of the samples with request info
+}
+
+// Analyze summarises a trace in the format recorded in its metadata, keeping the top entries of each list
+func Analyze(format string, r io.Reader, top int) (Summary, error) {
+	a := newAnalysis()
+	switch format {
+	case "phpspy":
+		scanner := phpspy.NewScanner(r)
+		for scanner.Scan() {
+			trace := scanner.Trace()
+			a.add(trace.Frames, trace.Request, 1)
+		}
+		if err := scanner.Err(); err != nil {
+			return Summary{}, err
+		}
+	case "collapsed":
+		stacks, err := flamegraph.ParseFolded(r)
+		if err != nil {
+			return Summary{}, err
+		}
+		for stack, count := range stacks {
+			a.add(flamegraph.StackFrames(stack), nil, count)
+		}
+	default:
+		return Summary{}, fmt.Errorf("%w %q", flamegraph.ErrUnsupportedFormat, format)
+	}
+	if a.samples == 0 {
+		return Summary{}, flamegraph.ErrNoSamples
+	}
+	return a.summary(format, top), nil
+}
+
+type counter struct {
+	self      map[string]int
+	inclusive map[string]int
+}
+
+func newCounter() counter {
+	return counter{self: make(map[string]int), inclusive: make(map[string]int)}
+}
+
+// add counts a sample towards the name that was running and, once, towards each name on the stack
+func (c counter) add(self string, stack []string, count int) {
+	if self != "" {
+		c.self[self] += count
+	}
+	seen := make(map[string]bool, len(stack))
+	for _, name := range stack {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			c.inclusive[name] += count
+		}
+	}
+}
+
+// entries returns the top entries ordered by self or inclusive samples, then by name
+func (c counter) entries(total, top int, bySelf bool) []Entry {
+	entries := make([]Entry, 0, len(c.inclusive))
+	for name, inclusive := range c.inclusive {
+		self := c.self[name]
+		entries = append(entries, Entry{
+			Name:             name,
+			Self:             self,
+			SelfPercent:      percent(self, total),
+			Inclusive:        inclusive,
+			InclusivePercent: percent(inclusive, total),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if bySelf && a.Self != b.Self {
+			return a.Self > b.Self
+		}
+		if a.Inclusive != b.Inclusive {
+			return a.Inclusive > b.Inclusive
+		}
+		if a.Self != b.Self {
+			return a.Self > b.Self
+		}
+		return a.Name < b.Name
+	})
+	if len(entries) > top {
+		entries = entries[:top]
+	}
+	return entries
+}
+
+type analysis struct {
+	samples        int
+	functions      counter
+	files          counter
+	requestSamples int
+	uris           map[string]int
+	methods        map[string]int
+}
+
+func newAnalysis() *analysis {
+	return &analysis{
+		functions: newCounter(),
+		files:     newCounter(),
+		uris:      make(map[string]int),
+		methods:   make(map[string]int),
+	}
+}
+
+// add counts a stack sampled count times, frames are innermost first
+func (a *analysis) add(frames []phpspy.Frame, request *phpspy.Request, count int) {
+	if len(frames) == 0 {
+		return
+	}
+	a.samples += count
+
+	functions := make([]string, len(frames))
+	files := make([]string, 0, len(frames))
+	selfFile := ""
+	for i, frame := range frames {
+		functions[i] = frame.Function
+		if frame.File != "" && frame.File != "<internal>" {
+			files = append(files, frame.File)
+			if selfFile == "" {
+				selfFile = frame.File
+			}
+		}
+	}
+	a.functions.add(frames[0].Function, functions, count)
+	a.files.add(selfFile, files, count)
+
+	if request != nil {
+		a.requestSamples += count
+		if uri := strings.SplitN(request.URI, "?", 2)[0]; uri != "" {
+			a.uris[uri] += count
+		}
+		if request.Method != "" {
+			a.methods[request.Method] += count
+		}
+	}
+}
+
+func (a *analysis) summary(format string, top int) Summary {
+	return Summary{
+		Format:               format,
+		Samples:              a.samples,
+		FunctionsBySelf:      a.functions.entries(a.samples, top, true),
+		FunctionsByInclusive: a.functions.entries(a.samples, top, false),
+		Files:                a.files.entries(a.samples, top, true),
+		RequestSamples:       a.requestSamples,
+		RequestURIs:          counts(a.uris, a.requestSamples, top),
+		RequestMethods:       counts(a.methods, a.requestSamples, top),
+	}
+}
+
+func counts(samples map[string]int, total, top int) []Count {
+	counts := make([]Count, 0, len(samples))
+	for name, n := range samples {
+		counts = append(counts, Count{Name: name, Samples: n, Percent: percent(n, total)})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Samples != counts[j].Samples {
+			return counts[i].Samples > counts[j].Samples
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// WriteText writes the summary as tables
+func (s Summary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%d samples (%s)\n", s.Samples, s.Format)
+	writeEntries(tw, "Top functions by self samples", "FUNCTION", s.FunctionsBySelf)
+	writeEntries(tw, "Top functions by inclusive samples", "FUNCTION", s.FunctionsByInclusive)
+	writeEntries(tw, "Top files by self samples", "FILE", s.Files)
+	if s.RequestSamples > 0 {
+		writeCounts(tw, fmt.Sprintf("Top request URIs (%d samples with request info)", s.RequestSamples), "URI", s.RequestURIs)
+		writeCounts(tw, "Top request methods", "METHOD", s.RequestMethods)
+	}
+	return tw.Flush()
+}
+
+func writeEntries(w io.Writer, title, column string, entries []Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s\n", title)
+	fmt.Fprintf(w, "SELF\t%%\tINCLUSIVE\t%%\t\t%s\n", column)
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%.1f%%\t%d\t%.1f%%\t\t%s\n", e.Self, e.SelfPercent, e.Inclusive, e.InclusivePercent, e.Name)
+	}
+}
+
+func writeCounts(w io.Writer, title, column string, counts []Count) {
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s\n", title)
+	fmt.Fprintf(w, "SAMPLES\t%%\t\t%s\n", column)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%d\t%.1f%%\t\t%s\n", c.Samples, c.Percent, c.Name)
+	}
+}
@@ -0,0 +1,99 @@
+package analyzer
+
+import (
+	"bytes"
+	"errors"
+	"github.com/daniel-cole/phunter/flamegraph"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzePHPSpy(t *testing.T) {
+	file, err := os.Open("../phpspy/testdata/phpspy.trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	summary, err := Analyze("phpspy", file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Samples != 5 || summary.RequestSamples != 3 {
+		t.Errorf("expected 5 samples, 3 with request info, instead got %d and %d", summary.Samples, summary.RequestSamples)
+	}
+
+	expectedSelf := []Entry{
+		{Name: "usleep", Self: 3, SelfPercent: 60, Inclusive: 3, InclusivePercent: 60},
+		{Name: "App\\Http\\Middleware\\Authenticate::handle", Self: 1, SelfPercent: 20, Inclusive: 1, InclusivePercent: 20},
+		{Name: "PDOStatement::execute", Self: 1, SelfPercent: 20, Inclusive: 1, InclusivePercent: 20},
+	}
+	if !reflect.DeepEqual(summary.FunctionsBySelf, expectedSelf) {
+		t.Errorf("expected functions by self samples %+v, instead got %+v", expectedSelf, summary.FunctionsBySelf)
+	}
+	expectedInclusive := []string{"<main>", "App\\Http\\Controllers\\ReportController::index", "Illuminate\\Routing\\Controller::callAction"}
+	if names := entryNames(summary.FunctionsByInclusive); !reflect.DeepEqual(names, expectedInclusive) {
+		t.Errorf("expected functions by inclusive samples %v, instead got %v", expectedInclusive, names)
+	}
+	if first := summary.Files[0]; first.Name != "/var/www/app/Http/Controllers/ReportController.php" || first.Self != 3 || first.Inclusive != 4 {
+		t.Errorf("expected the time in usleep to count towards the controller that called it, instead got %+v", summary.Files)
+	}
+
+	expectedURIs := []Count{{Name: "/reports", Samples: 2, Percent: 200.0 / 3}, {Name: "/reports/export", Samples: 1, Percent: 100.0 / 3}}
+	if !reflect.DeepEqual(summary.RequestURIs, expectedURIs) {
+		t.Errorf("expected request URIs %+v, instead got %+v", expectedURIs, summary.RequestURIs)
+	}
+	expectedMethods := []Count{{Name: "GET", Samples: 2, Percent: 200.0 / 3}, {Name: "POST", Samples: 1, Percent: 100.0 / 3}}
+	if !reflect.DeepEqual(summary.RequestMethods, expectedMethods) {
+		t.Errorf("expected request methods %+v, instead got %+v", expectedMethods, summary.RequestMethods)
+	}
+
+	var text bytes.Buffer
+	if err := summary.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"5 samples (phpspy)", "Top request URIs (3 samples with request info)", "60.0%  usleep\n"} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("expected the text summary to contain %q:\n%s", expected, text.String())
+		}
+	}
+}
+
+func TestAnalyzeCollapsed(t *testing.T) {
+	folded := "main (app.py:10);handle (app.py:20);query (db.py:5) 3\nmain (app.py:10);handle (app.py:20);handle (app.py:20) 1\n"
+	summary, err := Analyze("collapsed", strings.NewReader(folded), DefaultTop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := summary.FunctionsBySelf[0]; first.Name != "query" || first.Self != 3 {
+		t.Errorf("expected query to have the most self samples, instead got %+v", summary.FunctionsBySelf)
+	}
+	if first := summary.FunctionsByInclusive[0]; first.Inclusive != 4 || summary.FunctionsByInclusive[1].Name != "main" {
+		t.Errorf("expected recursive calls to be counted once, instead got %+v", summary.FunctionsByInclusive)
+	}
+	if files := entryNames(summary.Files); !reflect.DeepEqual(files, []string{"db.py", "app.py"}) {
+		t.Errorf("expected the files to be parsed from the frames, instead got %v", files)
+	}
+	if summary.RequestSamples != 0 || len(summary.RequestURIs) != 0 {
+		t.Errorf("expected no request info, instead got %+v", summary)
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	if _, err := Analyze("backtrace", strings.NewReader(""), DefaultTop); !errors.Is(err, flamegraph.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, instead got %v", err)
+	}
+	if _, err := Analyze("phpspy", strings.NewReader("# mem 1 2\n"), DefaultTop); !errors.Is(err, flamegraph.ErrNoSamples) {
+		t.Errorf("expected ErrNoSamples, instead got %v", err)
+	}
+}
+
+func entryNames(entries []Entry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/cooldown"
+	"net/http"
+)
+
+// CooldownsPath is where the cooldowns API is served
+const CooldownsPath = "/api/v1/cooldowns"
+
+// Cooldowns is the response of the cooldowns API
+type Cooldowns struct {
+	Policy config.CooldownConfig `json:"policy"`
+	cooldown.State
+}
+
+// CooldownsHandler serves the PIDs, containers and targets that are cooling down and the traces counted
+// against the node wide limits:
+//
+//	GET /api/v1/cooldowns
+type CooldownsHandler struct {
+	policy func() config.CooldownConfig
+	state  func() cooldown.State
+}
+
+// NewCooldownsHandler returns a handler for the cooldown state returned by state
+// the policy is looked up on each request in case it changes on reload
+func NewCooldownsHandler(policy func() config.CooldownConfig, state func() cooldown.State) *CooldownsHandler {
+	return &CooldownsHandler{policy: policy, state: state}
+}
+
+func (h *CooldownsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, Cooldowns{Policy: h.policy(), State: h.state()})
+}
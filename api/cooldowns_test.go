@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/cooldown"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCooldowns(t *testing.T) {
+	until := testStartTime.Add(5 * time.Minute)
+	handler := NewCooldownsHandler(
+		func() config.CooldownConfig { return config.CooldownConfig{PID: 300, MaxTracesPerHour: 2} },
+		func() cooldown.State {
+			return cooldown.State{
+				Running:        1,
+				TracesLastHour: 3,
+				PIDs:           []cooldown.Cooldown{{Name: "4242", Until: until, RemainingSeconds: 120}},
+				Containers:     []cooldown.Cooldown{},
+				Targets:        []cooldown.Cooldown{},
+			}
+		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := request(t, http.MethodGet, server.URL+CooldownsPath)
+	var cooldowns Cooldowns
+	if err := json.NewDecoder(resp.Body).Decode(&cooldowns); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || cooldowns.Policy.PID != 300 || cooldowns.Policy.MaxTracesPerHour != 2 ||
+		cooldowns.Running != 1 || cooldowns.TracesLastHour != 3 || len(cooldowns.PIDs) != 1 ||
+		cooldowns.PIDs[0].Name != "4242" || !cooldowns.PIDs[0].Until.Equal(until) {
+		t.Errorf("unexpected cooldowns with status %d: %+v", resp.StatusCode, cooldowns)
+	}
+
+	if resp := request(t, http.MethodDelete, server.URL+CooldownsPath); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, instead got %d", resp.StatusCode)
+	}
+}
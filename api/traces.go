@@ -0,0 +1,417 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/analyzer"
+	"github.com/daniel-cole/phunter/flamegraph"
+	"github.com/daniel-cole/phunter/pprof"
+	"github.com/daniel-cole/phunter/trace"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TracesPath is where the traces API is served
+const TracesPath = "/api/v1/traces"
+
+// Trace is a trace file and its metadata as returned by the traces API
+type Trace struct {
+	ID string `json:"id"`
+	trace.Metadata
+	DurationSeconds float64 `json:"duration_seconds"` // 0 while the trace is running
+	Running         bool    `json:"running"`
+	Size            int64   `json:"size"` // size of the trace file in bytes
+}
+
+// TraceList is the response when listing traces
+type TraceList struct {
+	Traces []Trace `json:"traces"`
+}
+
+// Error is the response when a request fails
+type Error struct {
+	Error string `json:"error"`
+}
+
+// TracesHandler serves the traces API:
+//
+//	GET    /api/v1/traces                lists traces, newest first
+//	GET    /api/v1/traces/{id}           returns a trace's metadata
+//	GET    /api/v1/traces/{id}/download  downloads the trace file
+//	GET    /api/v1/traces/{id}/flamegraph  renders the trace as an SVG flame graph, or collapsed stacks with ?format=folded
+//	GET    /api/v1/traces/{id}/summary   returns the top functions, files and requests of the trace, ?top=N entries of each
+//	GET    /api/v1/traces/{id}/pprof     downloads the trace as a gzipped pprof profile
+//	DELETE /api/v1/traces/{id}           deletes the trace, its metadata and pprof profile, unless it's still running
+//
+// traces are listed from their metadata sidecar files, so traces written before metadata was recorded aren't listed
+type TracesHandler struct {
+	traceDir func() string
+	running  func(id string) bool
+}
+
+// NewTracesHandler returns a handler for the traces in the directory returned by traceDir
+// which is looked up on each request in case it changes on reload, running reports whether a trace is being written
+// as the metadata of a trace that was being written when phunter was killed is never given an end time
+func NewTracesHandler(traceDir func() string, running func(id string) bool) *TracesHandler {
+	return &TracesHandler{traceDir: traceDir, running: running}
+}
+
+func (h *TracesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, TracesPath), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.list(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	id := parts[0]
+	if !validID(id) {
+		writeError(w, http.StatusBadRequest, "invalid trace id %q", id)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.get(w, id)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		h.delete(w, id)
+	case len(parts) == 1:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	case len(parts) == 2 && parts[1] == "download" && r.Method == http.MethodGet:
+		h.download(w, r, id)
+	case len(parts) == 2 && parts[1] == "flamegraph" && r.Method == http.MethodGet:
+		h.flamegraph(w, r, id)
+	case len(parts) == 2 && parts[1] == "summary" && r.Method == http.MethodGet:
+		h.summary(w, r, id)
+	case len(parts) == 2 && parts[1] == "pprof" && r.Method == http.MethodGet:
+		h.pprof(w, id)
+	case len(parts) == 2 && (parts[1] == "download" || parts[1] == "flamegraph" || parts[1] == "summary" || parts[1] == "pprof"):
+		methodNotAllowed(w, http.MethodGet)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *TracesHandler) list(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	traceDir := h.traceDir()
+	entries, err := ioutil.ReadDir(traceDir)
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, "failed to read trace directory: %v", err)
+		return
+	}
+
+	traces := []Trace{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), trace.MetadataSuffix) {
+			continue
+		}
+		t, err := h.readTrace(traceDir, strings.TrimSuffix(entry.Name(), trace.MetadataSuffix))
+		if err != nil {
+			logrus.WithField("metadata", entry.Name()).Warnf("skipping trace: %v", err)
+			continue
+		}
+		if filter.matches(t) {
+			traces = append(traces, t)
+		}
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].StartTime.After(traces[j].StartTime) })
+	writeJSON(w, http.StatusOK, TraceList{Traces: traces})
+}
+
+func (h *TracesHandler) get(w http.ResponseWriter, id string) {
+	t, err := h.readTrace(h.traceDir(), id)
+	if err != nil {
+		writeReadError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (h *TracesHandler) download(w http.ResponseWriter, r *http.Request, id string) {
+	_, traceFile, ok := h.openTrace(w, id)
+	if !ok {
+		return
+	}
+	defer traceFile.Close()
+	info, err := traceFile.Stat()
+	if err != nil {
+		writeReadError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id))
+	http.ServeContent(w, r, id, info.ModTime(), traceFile)
+}
+
+// openTrace opens a trace file after checking it has metadata, writing an error response if it can't be opened
+func (h *TracesHandler) openTrace(w http.ResponseWriter, id string) (Trace, *os.File, bool) {
+	traceDir := h.traceDir()
+	t, err := h.readTrace(traceDir, id)
+	if err != nil {
+		writeReadError(w, id, err)
+		return Trace{}, nil, false
+	}
+	traceFile, err := os.Open(filepath.Join(traceDir, id))
+	if err != nil {
+		writeReadError(w, id, err)
+		return Trace{}, nil, false
+	}
+	return t, traceFile, true
+}
+
+// writeParseError writes the response when a trace couldn't be parsed to render it as a flame graph, summarise or convert it
+func writeParseError(w http.ResponseWriter, id string, err error) {
+	if errors.Is(err, flamegraph.ErrUnsupportedFormat) || errors.Is(err, flamegraph.ErrNoSamples) {
+		writeError(w, http.StatusUnprocessableEntity, "can't parse trace %s: %v", id, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "failed to parse trace %s: %v", id, err)
+}
+
+// flamegraph renders phpspy and collapsed stack traces, which can be rendered while the trace is running
+func (h *TracesHandler) flamegraph(w http.ResponseWriter, r *http.Request, id string) {
+	t, traceFile, ok := h.openTrace(w, id)
+	if !ok {
+		return
+	}
+	defer traceFile.Close()
+
+	stacks, err := flamegraph.Parse(t.OutputFormat, traceFile)
+	if err != nil {
+		writeParseError(w, id, err)
+		return
+	}
+
+	var body bytes.Buffer
+	contentType := "image/svg+xml"
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "svg":
+		title := fmt.Sprintf("%s PID %d %s", t.Application, t.PID, t.StartTime.Format(time.RFC3339))
+		if t.Container != nil {
+			title = fmt.Sprintf("%s PID %d in %s %s", t.Application, t.PID, t.Container.DisplayName(), t.StartTime.Format(time.RFC3339))
+		}
+		err = stacks.WriteSVG(&body, title)
+	case "folded":
+		contentType = "text/plain; charset=utf-8"
+		err = stacks.WriteFolded(&body)
+	default:
+		writeError(w, http.StatusBadRequest, "format must be svg or folded")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to render trace %s: %v", id, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body.Bytes())
+}
+
+// summary returns the top functions, files and requests of phpspy and collapsed stack traces
+func (h *TracesHandler) summary(w http.ResponseWriter, r *http.Request, id string) {
+	top := analyzer.DefaultTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			writeError(w, http.StatusBadRequest, "top must be a positive number")
+			return
+		}
+	}
+	t, traceFile, ok := h.openTrace(w, id)
+	if !ok {
+		return
+	}
+	defer traceFile.Close()
+
+	summary, err := analyzer.Analyze(t.OutputFormat, traceFile, top)
+	if err != nil {
+		writeParseError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// pprof converts phpspy and collapsed stack traces to a pprof profile, for go tool pprof and other pprof tooling
+func (h *TracesHandler) pprof(w http.ResponseWriter, id string) {
+	t, traceFile, ok := h.openTrace(w, id)
+	if !ok {
+		return
+	}
+	defer traceFile.Close()
+
+	profile, err := pprof.Convert(t.OutputFormat, traceFile, pprof.Options{Start: t.StartTime, Duration: t.Metadata.Duration()})
+	if err != nil {
+		writeParseError(w, id, err)
+		return
+	}
+	var body bytes.Buffer
+	if err := profile.Write(&body); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to write profile of trace %s: %v", id, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+pprof.FileSuffix))
+	w.Write(body.Bytes())
+}
+
+func (h *TracesHandler) delete(w http.ResponseWriter, id string) {
+	traceDir := h.traceDir()
+	t, err := h.readTrace(traceDir, id)
+	if err != nil {
+		writeReadError(w, id, err)
+		return
+	}
+	// the tracer is still writing the files and would recreate the metadata when it finishes
+	if t.Running {
+		writeError(w, http.StatusConflict, "trace %s is still running", id)
+		return
+	}
+	names := []string{id, trace.MetadataFileName(id)}
+	if t.PprofFile != "" {
+		names = append(names, t.PprofFile)
+	}
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(traceDir, name)); err != nil && !os.IsNotExist(err) {
+			writeError(w, http.StatusInternalServerError, "failed to delete trace %s: %v", id, err)
+			return
+		}
+	}
+	logrus.WithField("trace", id).Info("trace deleted through the api")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readTrace reads the metadata of a trace and the size of the trace file
+func (h *TracesHandler) readTrace(traceDir, id string) (Trace, error) {
+	metadata, err := trace.ReadMetadata(traceDir, id)
+	if err != nil {
+		return Trace{}, err
+	}
+	info, err := os.Stat(filepath.Join(traceDir, id))
+	if err != nil {
+		return Trace{}, err
+	}
+	return Trace{
+		ID:              id,
+		Metadata:        metadata,
+		DurationSeconds: metadata.Duration().Seconds(),
+		Running:         h.running(id),
+		Size:            info.Size(),
+	}, nil
+}
+
+// validID rejects IDs that could refer to a file outside of the trace directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// traceFilter selects traces by the query parameters of a list request
+type traceFilter struct {
+	since     time.Time
+	until     time.Time
+	container string
+	trigger   string
+	target    string
+	pid       int
+}
+
+func parseFilter(r *http.Request) (traceFilter, error) {
+	query := r.URL.Query()
+	filter := traceFilter{
+		container: query.Get("container"),
+		trigger:   query.Get("trigger"),
+		target:    query.Get("target"),
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.since, err = time.Parse(time.RFC3339, since); err != nil {
+			return traceFilter{}, fmt.Errorf("since must be an RFC 3339 time: %v", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.until, err = time.Parse(time.RFC3339, until); err != nil {
+			return traceFilter{}, fmt.Errorf("until must be an RFC 3339 time: %v", err)
+		}
+	}
+	if pid := query.Get("pid"); pid != "" {
+		if filter.pid, err = strconv.Atoi(pid); err != nil {
+			return traceFilter{}, fmt.Errorf("pid must be a number: %v", err)
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether the trace started within the time range and matches every other filter that is set
+// the container filter matches the container name, a prefix of the container ID or the pod name
+func (f traceFilter) matches(t Trace) bool {
+	if !f.since.IsZero() && t.StartTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && t.StartTime.After(f.until) {
+		return false
+	}
+	if f.trigger != "" && !strings.EqualFold(f.trigger, t.Trigger) {
+		return false
+	}
+	if f.target != "" && f.target != t.Target {
+		return false
+	}
+	if f.pid != 0 && f.pid != t.PID {
+		return false
+	}
+	if f.container != "" {
+		c := t.Container
+		if c == nil {
+			return false
+		}
+		if c.Name != f.container && !strings.HasPrefix(c.ID, f.container) &&
+			(c.Pod == nil || c.Pod.Name != f.container) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logrus.Errorf("failed to write api response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, Error{Error: fmt.Sprintf(format, args...)})
+}
+
+func writeReadError(w http.ResponseWriter, id string, err error) {
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "trace %s not found", id)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "failed to read trace %s: %v", id, err)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/daniel-cole/phunter/analyzer"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testStartTime = time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+
+func writeTestTrace(t *testing.T, traceDir string, metadata trace.Metadata, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(traceDir, metadata.TraceFile), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(traceDir, trace.MetadataFileName(metadata.TraceFile)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestTraceServer serves a trace directory containing a finished CPU trace of a container,
+// a running RSS trace and a legacy trace without metadata
+func newTestTraceServer(t *testing.T) (*httptest.Server, string) {
+	traceDir, err := ioutil.TempDir("", "phunter-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(traceDir) })
+
+	endTime := testStartTime.Add(10 * time.Second)
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:         4242,
+		Target:      "php",
+		Application: "php",
+		TraceFile:   "web-4242-2020-08-01T12:00:00Z.txt",
+		Trigger:     "CPU",
+		CPU:         250,
+		RSS:         1024,
+		StartTime:   testStartTime,
+		EndTime:     &endTime,
+		Container: &container.Info{
+			ID:   "0123456789abcdef",
+			Name: "web",
+			Pod:  &container.Pod{Name: "web-6d4cf56db6-abcde", Namespace: "default"},
+		},
+	}, "trace contents")
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:         5000,
+		Target:      "worker",
+		Application: "python",
+		TraceFile:   "5000-2020-08-01T13:00:00Z.txt",
+		Trigger:     "RSS",
+		RSS:         1048576,
+		StartTime:   testStartTime.Add(time.Hour),
+	}, "")
+	if err := ioutil.WriteFile(filepath.Join(traceDir, "legacy.txt"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	running := func(id string) bool { return id == "5000-2020-08-01T13:00:00Z.txt" }
+	server := httptest.NewServer(NewTracesHandler(func() string { return traceDir }, running))
+	t.Cleanup(server.Close)
+	return server, traceDir
+}
+
+func request(t *testing.T, method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func listTraceIDs(t *testing.T, url string) []string {
+	resp := request(t, http.MethodGet, url)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, instead got %d", resp.StatusCode)
+	}
+	var list TraceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, trace := range list.Traces {
+		ids = append(ids, trace.ID)
+	}
+	return ids
+}
+
+func TestListTraces(t *testing.T) {
+	server, _ := newTestTraceServer(t)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"5000-2020-08-01T13:00:00Z.txt", "web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?trigger=cpu", []string{"web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?since=2020-08-01T12:30:00Z", []string{"5000-2020-08-01T13:00:00Z.txt"}},
+		{"?until=2020-08-01T12:30:00Z", []string{"web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?since=2020-08-02T00:00:00Z", []string{}},
+		{"?container=web", []string{"web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?container=0123456789ab", []string{"web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?container=web-6d4cf56db6-abcde", []string{"web-4242-2020-08-01T12:00:00Z.txt"}},
+		{"?container=db", []string{}},
+		{"?target=worker&pid=5000", []string{"5000-2020-08-01T13:00:00Z.txt"}},
+	}
+	for _, test := range tests {
+		if ids := listTraceIDs(t, server.URL+TracesPath+test.query); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: expected %v, instead got %v", test.query, test.expected, ids)
+		}
+	}
+}
+
+func TestListTracesInvalidFilter(t *testing.T) {
+	server, _ := newTestTraceServer(t)
+
+	for _, query := range []string{"?since=yesterday", "?until=1596283200", "?pid=php"} {
+		if resp := request(t, http.MethodGet, server.URL+TracesPath+query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, instead got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetTrace(t *testing.T) {
+	server, _ := newTestTraceServer(t)
+
+	resp := request(t, http.MethodGet, server.URL+TracesPath+"/web-4242-2020-08-01T12:00:00Z.txt")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, instead got %d", resp.StatusCode)
+	}
+	var actual Trace
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if actual.PID != 4242 || actual.Trigger != "CPU" || actual.CPU != 250 || actual.Container.Name != "web" {
+		t.Errorf("unexpected metadata: %+v", actual)
+	}
+	if actual.DurationSeconds != 10 || actual.Running || actual.Size != int64(len("trace contents")) {
+		t.Errorf("expected a finished 10 second trace of 14 bytes, instead got: %+v", actual)
+	}
+
+	running := request(t, http.MethodGet, server.URL+TracesPath+"/5000-2020-08-01T13:00:00Z.txt")
+	if err := json.NewDecoder(running.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if !actual.Running || actual.DurationSeconds != 0 {
+		t.Errorf("expected a running trace, instead got: %+v", actual)
+	}
+}
+
+func TestGetTraceErrors(t *testing.T) {
+	server, _ := newTestTraceServer(t)
+
+	tests := map[string]int{
+		"/missing.txt": http.StatusNotFound,
+		"/legacy.txt":  http.StatusNotFound,
+		"/..":          http.StatusBadRequest,
+		"/web-4242-2020-08-01T12:00:00Z.txt/profile": http.StatusNotFound,
+	}
+	for path, status := range tests {
+		resp := request(t, http.MethodGet, server.URL+TracesPath+path)
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, instead got %d", path, status, resp.StatusCode)
+		}
+		var apiErr Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			t.Errorf("%s: expected a json error, instead got: %v", path, err)
+		}
+	}
+
+	if resp := request(t, http.MethodPost, server.URL+TracesPath); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, instead got %d", resp.StatusCode)
+	}
+}
+
+func TestDownloadTrace(t *testing.T) {
+	server, _ := newTestTraceServer(t)
+
+	resp := request(t, http.MethodGet, server.URL+TracesPath+"/web-4242-2020-08-01T12:00:00Z.txt/download")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, instead got %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "trace contents" {
+		t.Errorf("expected the trace contents, instead got %q", body)
+	}
+	expected := `attachment; filename="web-4242-2020-08-01T12:00:00Z.txt"`
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != expected {
+		t.Errorf("expected Content-Disposition %s, instead got %s", expected, disposition)
+	}
+}
+
+func TestDeleteTrace(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	id := "web-4242-2020-08-01T12:00:00Z.txt"
+
+	if resp := request(t, http.MethodDelete, server.URL+TracesPath+"/"+id); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, instead got %d", resp.StatusCode)
+	}
+	for _, name := range []string{id, trace.MetadataFileName(id)} {
+		if _, err := os.Stat(filepath.Join(traceDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted: %v", name, err)
+		}
+	}
+	if ids := listTraceIDs(t, server.URL+TracesPath); !reflect.DeepEqual(ids, []string{"5000-2020-08-01T13:00:00Z.txt"}) {
+		t.Errorf("expected only the remaining trace to be listed, instead got %v", ids)
+	}
+	if resp := request(t, http.MethodDelete, server.URL+TracesPath+"/"+id); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 deleting the trace again, instead got %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(traceDir, "legacy.txt")); err != nil {
+		t.Errorf("expected traces without metadata to be left alone: %v", err)
+	}
+}
+
+func TestDeleteRunningTrace(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	id := "5000-2020-08-01T13:00:00Z.txt"
+
+	if resp := request(t, http.MethodDelete, server.URL+TracesPath+"/"+id); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status 409, instead got %d", resp.StatusCode)
+	}
+	for _, name := range []string{id, trace.MetadataFileName(id)} {
+		if _, err := os.Stat(filepath.Join(traceDir, name)); err != nil {
+			t.Errorf("expected %s to be kept while the trace is running: %v", name, err)
+		}
+	}
+}
+
+func TestDeleteInterruptedTrace(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	// left without an end time by phunter being killed while it was tracing
+	id := "6000-2020-08-01T14:00:00Z.txt"
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:       6000,
+		Target:    "php",
+		TraceFile: id,
+		Trigger:   "CPU",
+		StartTime: testStartTime.Add(2 * time.Hour),
+		Status:    trace.TraceStatusRunning,
+	}, "partial trace")
+
+	var actual Trace
+	if err := json.NewDecoder(request(t, http.MethodGet, server.URL+TracesPath+"/"+id).Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if actual.Running {
+		t.Errorf("expected a trace that isn't being written not to be running, instead got: %+v", actual)
+	}
+	if resp := request(t, http.MethodDelete, server.URL+TracesPath+"/"+id); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, instead got %d", resp.StatusCode)
+	}
+	for _, name := range []string{id, trace.MetadataFileName(id)} {
+		if _, err := os.Stat(filepath.Join(traceDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted: %v", name, err)
+		}
+	}
+}
+
+func TestTraceFlameGraph(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:          4343,
+		Application:  "php",
+		OutputFormat: "phpspy",
+		TraceFile:    "4343-2020-08-01T12:00:00Z.trace",
+		StartTime:    testStartTime,
+	}, "0 usleep <internal>:-1\n1 <main> /var/www/index.php:3\n\n0 <main> /var/www/index.php:5\n")
+	url := server.URL + TracesPath + "/4343-2020-08-01T12:00:00Z.trace/flamegraph"
+
+	resp := request(t, http.MethodGet, url)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("expected an SVG, instead got status %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if !strings.Contains(string(body), `data-name="usleep"`) || !strings.Contains(string(body), "php PID 4343") {
+		t.Errorf("expected the flame graph to contain the trace's frames and title: %s", body)
+	}
+
+	resp = request(t, http.MethodGet, url+"?format=folded")
+	body, _ = ioutil.ReadAll(resp.Body)
+	if expected := "<main> 1\n<main>;usleep 1\n"; string(body) != expected {
+		t.Errorf("expected folded stacks %q, instead got %q", expected, body)
+	}
+
+	tests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{url + "?format=pdf", http.StatusBadRequest},
+		{server.URL + TracesPath + "/web-4242-2020-08-01T12:00:00Z.txt/flamegraph", http.StatusUnprocessableEntity},
+		{server.URL + TracesPath + "/missing.trace/flamegraph", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp := request(t, http.MethodGet, test.url); resp.StatusCode != test.expectedStatus {
+			t.Errorf("expected status %d for %s, instead got %d", test.expectedStatus, test.url, resp.StatusCode)
+		}
+	}
+}
+
+func TestTraceSummary(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:          4343,
+		Application:  "php",
+		OutputFormat: "phpspy",
+		TraceFile:    "4343-2020-08-01T12:00:00Z.trace",
+		StartTime:    testStartTime,
+	}, "0 usleep <internal>:-1\n1 <main> /var/www/index.php:3\n# 1597152000.5 /health - /var/www/index.php - GET\n\n"+
+		"0 <main> /var/www/index.php:5\n")
+	url := server.URL + TracesPath + "/4343-2020-08-01T12:00:00Z.trace/summary"
+
+	resp := request(t, http.MethodGet, url+"?top=1")
+	var summary analyzer.Summary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || summary.Samples != 2 || len(summary.FunctionsByInclusive) != 1 ||
+		summary.FunctionsByInclusive[0].Name != "<main>" || summary.RequestURIs[0].Name != "/health" {
+		t.Errorf("unexpected summary with status %d: %+v", resp.StatusCode, summary)
+	}
+
+	tests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{url + "?top=0", http.StatusBadRequest},
+		{server.URL + TracesPath + "/web-4242-2020-08-01T12:00:00Z.txt/summary", http.StatusUnprocessableEntity},
+		{server.URL + TracesPath + "/missing.trace/summary", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp := request(t, http.MethodGet, test.url); resp.StatusCode != test.expectedStatus {
+			t.Errorf("expected status %d for %s, instead got %d", test.expectedStatus, test.url, resp.StatusCode)
+		}
+	}
+}
+
+func TestTracePprof(t *testing.T) {
+	server, traceDir := newTestTraceServer(t)
+	writeTestTrace(t, traceDir, trace.Metadata{
+		PID:          4343,
+		Application:  "php",
+		OutputFormat: "phpspy",
+		TraceFile:    "4343-2020-08-01T12:00:00Z.trace",
+		StartTime:    testStartTime,
+	}, "0 usleep <internal>:-1\n1 <main> /var/www/index.php:3\n\n0 <main> /var/www/index.php:5\n")
+	url := server.URL + TracesPath + "/4343-2020-08-01T12:00:00Z.trace/pprof"
+
+	resp := request(t, http.MethodGet, url)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, instead got %d: %s", resp.StatusCode, body)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != `attachment; filename="4343-2020-08-01T12:00:00Z.trace.pb.gz"` {
+		t.Errorf("unexpected content disposition %q", disposition)
+	}
+	// profiles are gzipped
+	if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		t.Errorf("expected a gzipped profile, instead got %q", body)
+	}
+
+	tests := []struct {
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{http.MethodPost, url, http.StatusMethodNotAllowed},
+		{http.MethodGet, server.URL + TracesPath + "/web-4242-2020-08-01T12:00:00Z.txt/pprof", http.StatusUnprocessableEntity},
+		{http.MethodGet, server.URL + TracesPath + "/missing.trace/pprof", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if resp := request(t, test.method, test.url); resp.StatusCode != test.expectedStatus {
+			t.Errorf("expected status %d for %s %s, instead got %d", test.expectedStatus, test.method, test.url, resp.StatusCode)
+		}
+	}
+}
@@ -3,19 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/daniel-cole/phunter/container"
 	"github.com/daniel-cole/phunter/process"
 	"log"
 )
 
 func main() {
 	var pid = flag.Int("pid", -1, "process id")
+	var socket = flag.String("socket", container.DefaultDockerSocket, "docker daemon socket")
+	var procRoot = flag.String("proc-root", process.DefaultProcRoot, "where procfs is mounted")
 	flag.Parse()
-	
+
 	if *pid == -1 || *pid < 0 {
 		log.Fatal("PID must be specified and be >= 0")
 	}
 
-	p := process.Process{ID: *pid}
+	p := process.Process{ID: *pid, Resolver: container.NewDockerClient(*socket, *procRoot)}
 	containerName, err := p.FindContainerName()
 	if err != nil {
 		log.Fatalf("Failed to find container name for %d", *pid)
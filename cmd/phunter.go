@@ -2,21 +2,35 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"github.com/daniel-cole/phunter/analyzer"
+	"github.com/daniel-cole/phunter/api"
 	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/notify"
 	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/retention"
+	"github.com/daniel-cole/phunter/scheduler"
 	"github.com/daniel-cole/phunter/system"
 	"github.com/daniel-cole/phunter/trace"
+	"github.com/daniel-cole/phunter/upload"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
+	"path/filepath"
+	"syscall"
 	"time"
 )
 
+// configPollInterval is how often the configuration file is checked for changes
+const configPollInterval = 10 * time.Second
+
+// clock is replaced by a fake in tests
+var clock system.Clock = system.RealClock
+
 type UTCFormatter struct {
 	logrus.Formatter
 }
@@ -27,19 +41,6 @@ func (u UTCFormatter) Format(e *logrus.Entry) ([]byte, error) {
 }
 
 func init() {
-	// check required binaries are installed
-	requiredBinaries := "ps,pgrep,lsns,phpspy,bash,docker,top"
-	missingBinaries := false
-	for _, binary := range strings.Split(requiredBinaries, ",") {
-		if !system.CheckBinaryOnPath(binary) {
-			missingBinaries = true
-			logrus.Errorf("Missing binary from path: %s\n", binary)
-		}
-	}
-	if missingBinaries {
-		logrus.Fatal("Please install the missing binary(s)")
-	}
-
 	switch os.Getenv("PHUNTER_LOG_LEVEL") {
 	case "TRACE":
 		logrus.SetLevel(logrus.TraceLevel)
@@ -53,24 +54,54 @@ func init() {
 
 	logrus.SetReportCaller(true)
 	logrus.SetOutput(os.Stdout)
-	logrus.SetFormatter(UTCFormatter{&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}})}
+	logrus.SetFormatter(UTCFormatter{&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}})
+}
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		os.Exit(analyzeTrace(os.Args[2:]))
+	}
+
 	var configFile string
 	if configFile = os.Getenv("PHUNTER_CONFIG_FILE"); configFile == "" {
 		logrus.Fatal("PHUNTER_CONFIG_FILE environment variable must be set")
 	}
 
 	logrus.Infof("attempting to load configuration from file %s", configFile)
-	traceConfig := loadConfig(configFile)
+	traceConfig, err := config.Load(configFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	logrus.Infof("successfully loaded configuration")
 
 	printConfig(traceConfig)
 
+	// check the tracer for each target's application is supported and installed
+	if err := checkTracers(traceConfig, true); err != nil {
+		logrus.Fatal(err)
+	}
+
+	metrics.SetMaxProcessSeries(traceConfig.Metrics.MaxProcessSeries)
+	store := config.NewStore(traceConfig)
+	watcher, err := config.NewWatcher(configFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	done := make(chan bool, 1)
+	stop := make(chan struct{})
+	// cancelled with stop, interrupting the checks and running traces
+	ctx, cancel := context.WithCancel(context.Background())
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	// kubernetes sends SIGTERM when the pod is deleted
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	reloaded := make(chan struct{}, 1)
 
 	listenAddress := "0.0.0.0:9000"
 	server := http.Server{
@@ -80,8 +111,10 @@ func main() {
 		IdleTimeout:  30 * time.Second,
 	}
 
-	// fileserver
-	fs := http.FileServer(http.Dir(traceConfig.TraceDir))
+	// fileserver, the trace directory is looked up on each request in case it changes on reload
+	fs := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(store.Get().TraceDir)).ServeHTTP(w, r)
+	})
 	http.Handle("/", fs)
 
 	// healthz endpoint
@@ -92,32 +125,79 @@ func main() {
 	})
 	http.Handle("/healthz", healthzHandler)
 
-	ticker := time.NewTicker(time.Duration(traceConfig.CheckInterval) * time.Second)
+	// traces api
+	tracesHandler := api.NewTracesHandler(func() string { return store.Get().TraceDir }, trace.Running)
+	http.Handle(api.TracesPath, tracesHandler)
+	http.Handle(api.TracesPath+"/", tracesHandler)
+
+	// cooldowns api
+	http.Handle(api.CooldownsPath, api.NewCooldownsHandler(func() config.CooldownConfig { return store.Get().Cooldown }, trace.CooldownState))
+
+	// prometheus metrics endpoint
+	http.Handle("/metrics", metrics.Default.Handler())
+
+	// triggered traces wait for a worker, the furthest over their threshold first
+	queue := trace.NewQueue(func() config.QueueConfig { return store.Get().Queue })
+	queueStop := make(chan struct{})
+	checksDone := make(chan struct{})
+
+	// finished traces are uploaded in the background when upload is enabled
+	uploader := upload.NewUploader(upload.DefaultQueueSize)
+	trace.OnComplete(func(traceConfig config.HunterConfig, metadata trace.Metadata) {
+		uploader.Enqueue(upload.Job{Config: traceConfig, Metadata: metadata})
+	})
+
+	// notifications are rate limited per target and sent in the background
+	dispatcher := notify.NewDispatcher(notify.DefaultQueueSize)
+	trace.OnStart(func(traceConfig config.HunterConfig, metadata trace.Metadata) {
+		dispatcher.Dispatch(config.NotifyEventStart, traceConfig, metadata)
+	})
+	trace.OnComplete(func(traceConfig config.HunterConfig, metadata trace.Metadata) {
+		dispatcher.Dispatch(config.NotifyEventComplete, traceConfig, metadata)
+	})
 
 	go func() {
-		<-quit
-		logrus.Infof("phunter is is now stopping...")
-		ticker.Stop()
+		sig := <-quit
+		logrus.Infof("phunter is is now stopping after %s...", sig)
+		// the running tracers are interrupted so the traced processes aren't left stopped under ptrace
+		cancel()
+		<-checksDone
+		close(queueStop)
+		queue.Wait()
+		logrus.Info("running traces stopped")
+		// stopped once the interrupted traces have finished so their uploads and notifications are still sent
+		close(stop)
 		graceTime := 60 * time.Second
 
-		ctx, cancel := context.WithTimeout(context.Background(), graceTime)
-		defer cancel()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), graceTime)
+		defer cancelShutdown()
 
 		server.SetKeepAlivesEnabled(false)
-		if err := server.Shutdown(ctx); err != nil {
+		if err := server.Shutdown(shutdownCtx); err != nil {
 			logrus.Infof("Could not gracefully shutdown the server: %v\n", err)
 		}
+		// the queued uploads and notifications are sent before exiting, for up to the rest of the grace time
+	drain:
+		for _, queueDone := range []<-chan struct{}{uploader.Done(), dispatcher.Done()} {
+			select {
+			case <-queueDone:
+			case <-shutdownCtx.Done():
+				logrus.Warn("stopped before the queued uploads and notifications were sent")
+				break drain
+			}
+		}
 		close(done)
 	}()
 
+	go watchConfig(configFile, store, watcher, reload, reloaded, stop)
+	go queue.Run(queueStop)
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				go func() { checkProcesses(traceConfig) }()
-			}
-		}
+		runChecks(ctx, store, queue, reloaded)
+		close(checksDone)
 	}()
+	go runRetention(store, stop)
+	go uploader.Run(stop)
+	go dispatcher.Run(stop)
 
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logrus.Fatalf("Could not listen on %s: %v\n", listenAddress, err)
@@ -127,67 +207,341 @@ func main() {
 
 }
 
-func printConfig(config config.HunterConfig) {
+// runChecks checks the processes every check interval until the context is cancelled
+// a check is skipped while the previous check is still running
+func runChecks(ctx context.Context, store *config.Store, queue *trace.Queue, reloaded <-chan struct{}) {
+	// the sample history of each process is kept between checks for the triggers to be decided from
+	tracker := process.NewTracker()
+	// the container resolver is kept between checks so its connections are reused
+	resolvers := &containerResolvers{}
+	defer resolvers.close()
+	interval := func() time.Duration { return time.Duration(store.Get().CheckInterval) * time.Second }
+	checks := scheduler.New(interval, func(ctx context.Context) {
+		checkProcesses(ctx, store.Get(), resolvers, tracker, queue)
+	})
+	checks.Run(ctx, reloaded)
+}
 
-	logrus.Infof("RSS threshold: %d", config.ThresholdParams.RSSThreshold)
-	logrus.Infof("RSS trigger count: %d", config.ThresholdParams.RSSTriggerCount)
-	logrus.Infof("RSS trigger delay: %d seconds", config.ThresholdParams.RSSTriggerDelay)
+// runRetention evicts old traces every retention interval until stopped
+// the interval is read each time so a reload takes effect after the next run
+func runRetention(store *config.Store, stop <-chan struct{}) {
+	for {
+		traceConfig := store.Get()
+		if err := trace.EnforceRetention(traceConfig); err != nil {
+			logrus.Errorf("failed to enforce trace retention: %v", err)
+		}
+		if free, err := retention.FreeBytes(traceConfig.TraceDir); err == nil {
+			metrics.TraceDirFreeBytes.Set(float64(free))
+		}
 
-	logrus.Infof("CPU threshold: %.2f", config.ThresholdParams.CPUThreshold)
-	logrus.Infof("CPU trigger count: %d", config.ThresholdParams.CPUTriggerCount)
-	logrus.Infof("CPU trigger delay: %d seconds", config.ThresholdParams.CPUTriggerDelay)
+		select {
+		case <-stop:
+			return
+		case <-clock.After(time.Duration(traceConfig.Retention.Interval) * time.Second):
+		}
+	}
+}
+
+// watchConfig reloads the configuration on SIGHUP or when the contents of the configuration file change
+func watchConfig(configFile string, store *config.Store, watcher *config.Watcher, reload <-chan os.Signal,
+	reloaded chan<- struct{}, stop <-chan struct{}) {
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-reload:
+			logrus.Info("received SIGHUP, reloading configuration")
+			// record the current contents so the next poll doesn't reload the same change again
+			if _, err := watcher.Changed(); err != nil {
+				logrus.Errorf("failed to read configuration file: %v", err)
+			}
+			reloadConfig(configFile, store, reloaded)
+		case <-poll.C:
+			changed, err := watcher.Changed()
+			if err != nil {
+				logrus.Errorf("failed to check configuration file for changes: %v", err)
+				continue
+			}
+			if changed {
+				logrus.Infof("configuration file %s changed, reloading configuration", configFile)
+				reloadConfig(configFile, store, reloaded)
+			}
+		}
+	}
+}
+
+// reloadConfig validates the configuration file before making it the active configuration
+// the current configuration is kept if the new configuration is invalid
+func reloadConfig(configFile string, store *config.Store, reloaded chan<- struct{}) {
+	newConfig, err := config.Load(configFile)
+	if err == nil {
+		err = checkTracers(newConfig, true)
+	}
+	if err != nil {
+		logrus.Errorf("failed to reload configuration, keeping the current configuration: %v", err)
+		return
+	}
+
+	metrics.SetMaxProcessSeries(newConfig.Metrics.MaxProcessSeries)
+	store.Set(newConfig)
+	logrus.Info("successfully reloaded configuration")
+	printConfig(newConfig)
+	select {
+	case reloaded <- struct{}{}:
+	default:
+	}
+}
+
+func printConfig(config config.HunterConfig) {
 
 	logrus.Infof("check interval: %d seconds", config.CheckInterval)
-	logrus.Infof("trace command: %s", config.ProcessCommand)
-	logrus.Infof("application: %s", config.Application)
-	logrus.Infof("application version: %s", config.ApplicationVersion)
+	logrus.Infof("proc root: %s", config.ProcRoot)
 	logrus.Infof("trace directory: %s", config.TraceDir)
-	logrus.Infof("trace duration: %d seconds", config.TraceDuration)
-	logrus.Infof("docker: %t", config.Docker)
+	logrus.Infof("container resolver: %s", config.ContainerResolverType())
+	logrus.Infof("docker socket: %s", config.DockerSocket)
+	logrus.Infof("kubernetes: %t", config.Kubernetes.Enabled)
 	logrus.Infof("dryrun: %t", config.Dryrun)
+	logrus.Infof("retention: %+v", config.Retention)
+	logrus.Infof("cooldown: %+v", config.Cooldown)
+	logrus.Infof("trace queue: %+v", config.Queue)
+	if config.Upload.Enabled {
+		logrus.Infof("upload: bucket %s at %s", config.Upload.Bucket, config.Upload.Endpoint)
+	}
+	if config.Notify.Enabled() {
+		var notifiers []string
+		for _, n := range notify.NewNotifiers(config.Notify) {
+			notifiers = append(notifiers, n.Name())
+		}
+		logrus.Infof("notify: %v on %v, at most %d traces per target every %d seconds", notifiers, config.Notify.Events,
+			config.Notify.RateLimit, config.Notify.RateLimitInterval)
+	}
+
+	for _, target := range config.EffectiveTargets() {
+		log := logrus.WithField("target", target.Name)
+
+		for _, thresholdType := range []string{process.ThresholdTypeRSS, process.ThresholdTypeCPU} {
+			description, err := target.ThresholdParams.Describe(thresholdType)
+			if err != nil {
+				log.Errorf("%s trigger: %v", thresholdType, err)
+				continue
+			}
+			log.Infof("%s trigger: %s", thresholdType, description)
+		}
+
+		log.Infof("process matcher: %+v", target.Matcher())
+		log.Infof("application: %s", target.Application)
+		log.Infof("application version: %s", target.ApplicationVersion)
+		log.Infof("trace duration: %d seconds", target.TraceDuration)
+	}
 
+	for _, warning := range config.Warnings() {
+		logrus.Warn(warning)
+	}
+}
+
+// checkTracers ensures the tracer for every target's application is supported
+// and when checkBinary is set that the tracer is installed
+func checkTracers(traceConfig config.HunterConfig, checkBinary bool) error {
+	for _, target := range traceConfig.EffectiveTargets() {
+		targetConfig := traceConfig.ForTarget(target)
+		var err error
+		if checkBinary {
+			err = trace.CheckTracer(targetConfig)
+		} else {
+			_, err = trace.NewTracer(targetConfig)
+		}
+		if err != nil {
+			return fmt.Errorf("target %s: %v", target.Name, err)
+		}
+	}
+	return nil
 }
 
-func loadConfig(configFile string) config.HunterConfig {
-	var traceConfig *config.HunterConfig
-	data, err := ioutil.ReadFile(configFile)
+// validateConfig checks the configuration file passed as an argument, or PHUNTER_CONFIG_FILE
+// and returns the exit code for the validate-config mode
+func validateConfig(args []string) int {
+	configFile := os.Getenv("PHUNTER_CONFIG_FILE")
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	if configFile == "" {
+		fmt.Fprintln(os.Stderr, "usage: phunter validate-config FILE (or set PHUNTER_CONFIG_FILE)")
+		return 2
+	}
+
+	traceConfig, err := config.Load(configFile)
+	if err == nil {
+		err = checkTracers(traceConfig, false)
+	}
 	if err != nil {
-		logrus.Fatal(err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", configFile)
+	return 0
+}
+
+// analyzeTrace prints a summary of the trace file passed as an argument and returns the exit code for the analyze mode
+// the format is read from the trace's metadata when it has any, otherwise the trace is assumed to be from phpspy
+func analyzeTrace(args []string) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	top := flags.Int("top", analyzer.DefaultTop, "number of functions, files and requests to show")
+	format := flags.String("format", "", "format of the trace, phpspy or collapsed")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: phunter analyze [-top N] [-format phpspy|collapsed] FILE")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *top < 1 {
+		if err == nil {
+			flags.Usage()
+		}
+		return 2
 	}
+	traceFileName := flags.Arg(0)
 
-	err = yaml.Unmarshal(data, &traceConfig)
+	if *format == "" {
+		*format = "phpspy"
+		if metadata, err := trace.ReadMetadata(filepath.Dir(traceFileName), filepath.Base(traceFileName)); err == nil {
+			*format = metadata.OutputFormat
+		}
+	}
+	traceFile, err := os.Open(traceFileName)
 	if err != nil {
-		logrus.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer traceFile.Close()
+
+	summary, err := analyzer.Analyze(*format, traceFile, *top)
+	if err == nil {
+		err = summary.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", traceFileName, err)
+		return 1
 	}
+	return 0
+}
+
+// newContainerResolver returns the configured container resolver
+// which also looks up the pod of each container when kubernetes is enabled
+func newContainerResolver(traceConfig config.HunterConfig, procRoot string) (container.Resolver, error) {
+	resolver, err := container.NewResolver(traceConfig.ContainerResolverType(), traceConfig.DockerSocket, procRoot)
+	if err != nil || !traceConfig.Kubernetes.Enabled {
+		return resolver, err
+	}
+
+	kubeletURL := container.DefaultKubeletURL
+	if traceConfig.Kubernetes.KubeletURL != "" {
+		kubeletURL = os.ExpandEnv(traceConfig.Kubernetes.KubeletURL)
+	}
+	nodeName := os.ExpandEnv(traceConfig.Kubernetes.NodeName)
+	return container.NewKubeletResolver(resolver, kubeletURL, traceConfig.Kubernetes.TokenFile,
+		traceConfig.Kubernetes.InsecureSkipVerify, nodeName), nil
+}
+
+// containerResolvers keeps the container resolver for the configuration it was created from
+// a new resolver is only created when a reload changes how containers are resolved
+type containerResolvers struct {
+	config   containerResolverConfig
+	resolver container.Resolver
+	created  bool
+}
 
-	return *traceConfig
+// containerResolverConfig is the part of the configuration the container resolver is created from
+type containerResolverConfig struct {
+	resolverType string
+	dockerSocket string
+	procRoot     string
+	kubernetes   config.KubernetesConfig
 }
 
-func checkProcesses(traceConfig config.HunterConfig) {
+// get returns the resolver for the configuration, replacing the current resolver when the configuration has changed
+func (r *containerResolvers) get(traceConfig config.HunterConfig, procRoot string) (container.Resolver, error) {
+	resolverConfig := containerResolverConfig{
+		resolverType: traceConfig.ContainerResolverType(),
+		dockerSocket: traceConfig.DockerSocket,
+		procRoot:     procRoot,
+		kubernetes:   traceConfig.Kubernetes,
+	}
+	if r.created && resolverConfig == r.config {
+		return r.resolver, nil
+	}
+
+	resolver, err := newContainerResolver(traceConfig, procRoot)
+	if err != nil {
+		return nil, err
+	}
+	r.close()
+	r.config, r.resolver, r.created = resolverConfig, resolver, true
+	return resolver, nil
+}
+
+// close closes the connections kept open by the current resolver
+func (r *containerResolvers) close() {
+	container.CloseIdleConnections(r.resolver)
+}
+
+func checkProcesses(ctx context.Context, traceConfig config.HunterConfig, resolvers *containerResolvers,
+	tracker *process.Tracker, queue *trace.Queue) {
 	logrus.Info("checking processes")
-	pidList, err := process.GetPIDListByCommand(traceConfig.ProcessCommand)
+	startTime := time.Now()
+	defer func() { metrics.CheckDuration.Observe(time.Since(startTime).Seconds()) }()
+
+	procFS := process.NewProcFS(traceConfig.ProcRoot)
+	resolver, err := resolvers.get(traceConfig, procFS.Root)
 	if err != nil {
-		logrus.Printf("failed to get processes for %s, are any running on the system?", traceConfig.ProcessCommand)
-	}
-
-	var wg sync.WaitGroup
-	for _, pid := range pidList {
-		logrus.WithField("pid", pid).Debugf("checking pid")
-		go func(pid int) {
-			wg.Add(1)
-			defer wg.Done()
-
-			logrus.WithField("pid", pid).Debugf("checking if trace should be triggered")
-			p := &process.Process{ID: pid}
-			err = trace.AttemptTrace(p, process.Thresholds{
-				CPU: false,
-				RSS: false,
-			}, traceConfig)
-			if err != nil {
-				logrus.WithField("pid", pid).Errorf("error when attempting to trace process: %v", err)
-			}
-		}(pid)
+		logrus.Errorf("failed to create container resolver: %v", err)
+		return
 	}
-	wg.Wait()
+
+	matched := make(map[string]map[int]bool)
+	// the processes of targets that couldn't be scanned are kept so a transient error doesn't reset their histories
+	unscanned := make(map[string]bool)
+	for _, target := range traceConfig.EffectiveTargets() {
+		if ctx.Err() != nil {
+			logrus.Info("check cancelled")
+			return
+		}
+		log := logrus.WithField("target", target.Name)
+		targetConfig := traceConfig.ForTarget(target)
+		pidList, err := procFS.FindPIDs(target.Matcher())
+		if err != nil {
+			log.Errorf("failed to get processes matching %+v: %v", target.Matcher(), err)
+			unscanned[target.Name] = true
+			continue
+		}
+		if len(pidList) == 0 {
+			log.Debugf("no processes matched %+v", target.Matcher())
+		}
+		metrics.PIDsScanned.Set(float64(len(pidList)), target.Name)
+		matched[target.Name] = make(map[int]bool)
+
+		processes := make([]process.ProcessInterface, len(pidList))
+		for i, pid := range pidList {
+			matched[target.Name][pid] = true
+			processes[i] = &process.Process{ID: pid, FS: procFS, Resolver: resolver}
+		}
+		failed := scheduler.CheckProcesses(ctx, processes, func(ctx context.Context, p process.ProcessInterface) error {
+			log.WithField("pid", p.GetID()).Debugf("checking if trace should be triggered")
+			history := tracker.Track(targetConfig.TargetName, p, targetConfig.ThresholdParams.HistorySize())
+			return trace.AttemptTrace(ctx, p, history, queue, targetConfig)
+		})
+		for pid, err := range failed {
+			log.WithField("pid", pid).Errorf("error when attempting to trace process: %v", err)
+		}
+	}
+
+	// forget the processes that have exited and the targets removed by a reload
+	keep := func(target string, pid int) bool { return unscanned[target] || matched[target][pid] }
+	metrics.RetainProcesses(keep)
+	tracker.Retain(keep)
+	metrics.PIDsScanned.DeleteFunc(func(labelValues []string) bool {
+		return matched[labelValues[0]] == nil && !unscanned[labelValues[0]]
+	})
+
 	logrus.Info("finished checking processes")
 }
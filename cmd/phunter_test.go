@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/process/processtest"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"github.com/daniel-cole/phunter/trace"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckProcessesKeepsTargetsThatFailedToScan(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "phunter-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procRoot)
+
+	traceConfig := config.Default()
+	traceConfig.ProcRoot = procRoot
+	// the invalid pattern fails to scan like a transient procfs error would
+	traceConfig.Targets = []config.Target{
+		{Name: "scanned", ProcessCommand: "php-fpm"},
+		{Name: "failed", ProcessCommand: "("},
+	}
+	tracker := process.NewTracker()
+	for _, target := range []string{"scanned", "failed"} {
+		tracker.Track(target, &processtest.Process{ID: 42}, 3).Add(process.Sample{CPU: 200})
+		metrics.PIDsScanned.Set(1, target)
+	}
+	queue := trace.NewQueue(func() config.QueueConfig { return traceConfig.Queue })
+
+	checkProcesses(context.Background(), traceConfig, &containerResolvers{}, tracker, queue)
+
+	if samples := tracker.Track("failed", &processtest.Process{ID: 42}, 3).Samples(); len(samples) != 1 {
+		t.Errorf("expected the history of a target that failed to scan to be kept, instead got %+v", samples)
+	}
+	if metrics.PIDsScanned.Value("failed") != 1 {
+		t.Error("expected the scanned processes of a target that failed to scan to be kept")
+	}
+	if samples := tracker.Track("scanned", &processtest.Process{ID: 42}, 3).Samples(); len(samples) != 0 {
+		t.Errorf("expected the history of a process that has exited to be forgotten, instead got %+v", samples)
+	}
+}
+
+func TestRunRetentionEveryInterval(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+	fakeClock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	clock = fakeClock
+	defer func() { clock = system.RealClock }()
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.Retention.Interval = 60
+	traceConfig.Retention.MaxFiles = 1
+	traceConfig.Retention.MinFreeMiB = 0
+	writeTrace := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(traceDir, name), []byte("trace"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	traces := func() int {
+		files, err := ioutil.ReadDir(traceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	waitForWaiter := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for fakeClock.Waiters() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for retention to wait for the next interval")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	writeTrace("4242-2020-08-01T10:00:00Z.txt")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runRetention(config.NewStore(traceConfig), stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	waitForWaiter()
+	writeTrace("4242-2020-08-01T11:00:00Z.txt")
+	if traces() != 2 {
+		t.Fatal("expected the trace to be kept until the next interval")
+	}
+	fakeClock.Advance(time.Minute)
+	waitForWaiter()
+	if traces() != 1 {
+		t.Errorf("expected retention to evict a trace once the interval passed, instead %d are left", traces())
+	}
+}
@@ -1,25 +1,219 @@
 package config
 
-import "github.com/daniel-cole/phunter/process"
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/cooldown"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/retention"
+	"gopkg.in/yaml.v2"
+	"time"
+)
 
 type HunterConfig struct {
-	Application        string                  `yaml:"application"`
-	ApplicationVersion string                  `yaml:"application_version"`
-	ProcessCommand     string                  `yaml:"process_command"`
-	CheckInterval      int                     `yaml:"check_interval"`
-	TraceDuration      int                     `yaml:"trace_duration"`
-	TraceDir           string                  `yaml:"trace_dir"`
-	Docker             bool                    `yaml:"docker"`
-	Dryrun             bool                    `yaml:"dryrun"`
-	Timezone           string                  `yaml:"timezone"`
-	ThresholdParams    process.ThresholdParams `yaml:"threshold_params"`
-	PHPSpyConfig       PHPSpyConfig            `yaml:"phpspy"`
-}
-
-// For configuration options see: https://github.com/adsr/phpspy
-type PHPSpyConfig struct {
-	Threads   string `yaml:"threads"` // -T
-	Sleep     string `yaml:"sleep"` // -s
-	Rate      string `yaml:"rate"` // -H
-	Limit     string `yaml:"limit"` // -l
+	Application         string                  `yaml:"application"`
+	ApplicationVersion  string                  `yaml:"application_version"`
+	ProcessCommand      string                  `yaml:"process_command"`
+	ProcessMatcher      process.Matcher         `yaml:"process_matcher"`
+	ProcRoot            string                  `yaml:"proc_root"`
+	CheckInterval       int                     `yaml:"check_interval"`
+	TraceDuration       int                     `yaml:"trace_duration"`
+	TraceDir            string                  `yaml:"trace_dir"`
+	Docker              bool                    `yaml:"docker"`
+	DockerSocket        string                  `yaml:"docker_socket"`
+	ContainerResolver   string                  `yaml:"container_resolver"`
+	Dryrun              bool                    `yaml:"dryrun"`
+	Timezone            string                  `yaml:"timezone"`
+	ThresholdParams     process.ThresholdParams `yaml:"threshold_params"`
+	PHPSpyConfig        PHPSpyConfig            `yaml:"phpspy"`
+	PySpyConfig         PySpyConfig             `yaml:"pyspy"`
+	RbSpyConfig         RbSpyConfig             `yaml:"rbspy"`
+	NativeTracerConfig  NativeTracerConfig      `yaml:"native"`
+	CommandTracerConfig CommandTracerConfig     `yaml:"command"`
+	Kubernetes          KubernetesConfig        `yaml:"kubernetes"`
+	Metrics             MetricsConfig           `yaml:"metrics"`
+	Retention           RetentionConfig         `yaml:"retention"`
+	Cooldown            CooldownConfig          `yaml:"cooldown"`
+	Queue               QueueConfig             `yaml:"queue"`
+	Upload              UploadConfig            `yaml:"upload"`
+	Notify              NotifyConfig            `yaml:"notify"`
+	Targets             []Target                `yaml:"targets"`
+
+	// TargetName is set by ForTarget to the name of the target being checked
+	TargetName string `yaml:"-"`
+}
+
+// KubernetesConfig enables looking up the pod a container belongs to from the kubelet
+// environment variables in kubelet_url and node_name are expanded e.g. https://${NODE_IP}:10250
+type KubernetesConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	KubeletURL         string `yaml:"kubelet_url"`
+	TokenFile          string `yaml:"token_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	NodeName           string `yaml:"node_name"`
+}
+
+// MetricsConfig configures the prometheus metrics served on /metrics
+type MetricsConfig struct {
+	MaxProcessSeries int `yaml:"max_process_series"` // cap on the processes exported by the per process metrics, 0 disables them
+}
+
+// RetentionConfig limits the space used by trace_dir, a limit of 0 is not enforced
+// the oldest traces are evicted every interval and before each trace starts
+type RetentionConfig struct {
+	Interval    int   `yaml:"interval"`      // seconds between scheduled evictions
+	MaxAgeHours int   `yaml:"max_age_hours"` // traces older than this are evicted
+	MaxTotalMiB int64 `yaml:"max_total_mib"` // maximum size of all traces
+	MaxFiles    int   `yaml:"max_files"`     // maximum number of traces, metadata files aren't counted
+	MinFreeMiB  int64 `yaml:"min_free_mib"`  // new traces are refused when the filesystem has less free space
+}
+
+// Policy returns the limits enforced on trace_dir
+func (r RetentionConfig) Policy() retention.Policy {
+	return retention.Policy{
+		MaxAge:        time.Duration(r.MaxAgeHours) * time.Hour,
+		MaxTotalBytes: r.MaxTotalMiB * 1024 * 1024,
+		MaxFiles:      r.MaxFiles,
+		MinFreeBytes:  r.MinFreeMiB * 1024 * 1024,
+	}
+}
+
+// CooldownConfig limits how often traces are started on the node, a limit of 0 is not enforced
+// the pid, container and target cooldowns start when a trace finishes, how many traces run at once is queue.workers
+type CooldownConfig struct {
+	PID              int `yaml:"pid" json:"pid"`                                 // seconds before the same process can be traced again
+	Container        int `yaml:"container" json:"container"`                     // seconds before any process in the same container can be traced again
+	Target           int `yaml:"target" json:"target"`                           // seconds before any process of the same target can be traced again
+	MaxTracesPerHour int `yaml:"max_traces_per_hour" json:"max_traces_per_hour"` // across every target
+}
+
+// Policy returns the limits enforced on the traces started
+func (c CooldownConfig) Policy() cooldown.Policy {
+	return cooldown.Policy{
+		PID:              time.Duration(c.PID) * time.Second,
+		Container:        time.Duration(c.Container) * time.Second,
+		Target:           time.Duration(c.Target) * time.Second,
+		MaxTracesPerHour: c.MaxTracesPerHour,
+	}
+}
+
+// how a trace is queued when a trace of the same container is already queued
+const (
+	SameContainerQueue    = "queue"    // queue the trace anyway
+	SameContainerDrop     = "drop"     // drop the trace, also when a trace of the container is running
+	SameContainerCoalesce = "coalesce" // keep the queued trace furthest over its threshold
+)
+
+// QueueConfig bounds how many traces run at once, triggered traces wait in a queue ordered by
+// how far over the threshold the process is
+type QueueConfig struct {
+	Workers       int    `yaml:"workers"`        // traces run at once across every target
+	MaxQueued     int    `yaml:"max_queued"`     // traces waiting for a worker, the trace least over its threshold is dropped when full
+	SameContainer string `yaml:"same_container"` // queue, drop or coalesce
+}
+
+// Matcher returns the criteria used to select processes to check
+// process_command is treated as the comm pattern when process_matcher doesn't set one
+func (c HunterConfig) Matcher() process.Matcher {
+	return Target{ProcessCommand: c.ProcessCommand, ProcessMatcher: c.ProcessMatcher}.Matcher()
+}
+
+// Snapshot returns the configuration keyed by the option names used in the configuration file
+// so it can be recorded as JSON alongside a trace, credentials are redacted
+func (c HunterConfig) Snapshot() (map[string]interface{}, error) {
+	if c.Upload.SecretAccessKey != "" {
+		c.Upload.SecretAccessKey = redacted
+	}
+	if c.Upload.SessionToken != "" {
+		c.Upload.SessionToken = redacted
+	}
+	c.Notify = c.Notify.redact()
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot map[string]interface{}
+	if err := yaml.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return stringKeys(snapshot).(map[string]interface{}), nil
+}
+
+// redacted replaces credentials in configuration snapshots
+const redacted = "REDACTED"
+
+// stringKeys converts the map[interface{}]interface{} values yaml decodes nested maps into
+// to map[string]interface{} which can be encoded as JSON
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = stringKeys(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = stringKeys(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+		return v
+	}
+	return value
+}
+
+// ContainerResolverType returns how the container a process is running in is found
+// docker: true selects the docker resolver when container_resolver isn't set
+// and the cgroup resolver is used for kubernetes if neither is set
+func (c HunterConfig) ContainerResolverType() string {
+	switch {
+	case c.ContainerResolver != "":
+		return c.ContainerResolver
+	case c.Docker:
+		return container.ResolverDocker
+	case c.Kubernetes.Enabled:
+		return container.ResolverCgroup
+	}
+	return ""
+}
+
+// PySpyConfig configures the tracer used when application is python
+// For configuration options see: https://github.com/benfred/py-spy
+type PySpyConfig struct {
+	Rate         int  `yaml:"rate"`         // --rate
+	Native       bool `yaml:"native"`       // --native
+	Subprocesses bool `yaml:"subprocesses"` // --subprocesses
+	Idle         bool `yaml:"idle"`         // --idle
+	NonBlocking  bool `yaml:"nonblocking"`  // --nonblocking
+}
+
+// RbSpyConfig configures the tracer used when application is ruby
+// For configuration options see: https://github.com/rbspy/rbspy
+type RbSpyConfig struct {
+	Rate         int  `yaml:"rate"`         // --rate
+	Subprocesses bool `yaml:"subprocesses"` // --subprocesses
+}
+
+const (
+	NativeToolEUStack = "eu-stack"
+	NativeToolGDB     = "gdb"
+)
+
+// NativeTracerConfig configures the tracer used when application is native
+// which takes a backtrace of every thread in the process
+type NativeTracerConfig struct {
+	Tool string `yaml:"tool"` // eu-stack (default) or gdb
+}
+
+// CommandTracerConfig configures the tracer used when application is command
+// each argument is a go template rendered with the PID, Version and Duration of the trace
+type CommandTracerConfig struct {
+	Args         []string `yaml:"args"`          // e.g. ["perf", "record", "-p", "{{.PID}}", "-o", "/dev/stdout"]
+	OutputFormat string   `yaml:"output_format"` // describes the trace output, defaults to raw
+	Extension    string   `yaml:"extension"`     // trace file extension, defaults to trace
+	Bounded      bool     `yaml:"bounded"`       // the command exits by itself rather than being killed after trace_duration
 }
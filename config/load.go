@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ValidationError holds every problem found with a configuration so they can all be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Default returns the configuration used for any option that isn't set in the configuration file
+// see config-example.yml for a description of each option
+func Default() HunterConfig {
+	return HunterConfig{
+		Application:    "php",
+		ProcessCommand: "php-fpm",
+		ProcRoot:       process.DefaultProcRoot,
+		CheckInterval:  30,
+		TraceDuration:  10,
+		TraceDir:       "/tmp/phunter",
+		DockerSocket:   container.DefaultDockerSocket,
+		Timezone:       "UTC",
+		ThresholdParams: process.ThresholdParams{
+			CPUThreshold:     90,
+			CPUTriggerCount:  3,
+			CPUTriggerPolicy: process.TriggerPolicyCount,
+			RSSThreshold:     524288,
+			RSSTriggerCount:  3,
+			RSSTriggerPolicy: process.TriggerPolicyCount,
+		},
+		PHPSpyConfig: DefaultPHPSpyConfig(),
+		NativeTracerConfig: NativeTracerConfig{
+			Tool: NativeToolEUStack,
+		},
+		Kubernetes: KubernetesConfig{
+			KubeletURL:         container.DefaultKubeletURL,
+			TokenFile:          container.DefaultServiceAccountTokenFile,
+			InsecureSkipVerify: true,
+		},
+		Metrics: MetricsConfig{
+			MaxProcessSeries: metrics.DefaultMaxProcessSeries,
+		},
+		Upload: DefaultUploadConfig(),
+		Notify: DefaultNotifyConfig(),
+		// traces are only evicted once a limit is set
+		Retention: RetentionConfig{
+			Interval:   300,
+			MinFreeMiB: 256,
+		},
+		Cooldown: CooldownConfig{
+			PID: 300,
+		},
+		Queue: QueueConfig{
+			Workers:       2,
+			MaxQueued:     50,
+			SameContainer: SameContainerQueue,
+		},
+	}
+}
+
+// Load reads, applies defaults to and validates the configuration file
+func Load(configFile string) (HunterConfig, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return HunterConfig{}, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes the YAML configuration on top of the defaults and validates it
+// unknown or duplicate keys are rejected so typos don't silently fall back to the default
+func Parse(data []byte) (HunterConfig, error) {
+	config := Default()
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return HunterConfig{}, err
+	}
+	if err := config.decodeTargets(data); err != nil {
+		return HunterConfig{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return HunterConfig{}, err
+	}
+	return config, nil
+}
+
+// Warnings returns the options that are set but ignored, the configuration is still valid
+func (c HunterConfig) Warnings() []string {
+	var warnings []string
+	for i, target := range c.EffectiveTargets() {
+		prefix := ""
+		if len(c.Targets) > 0 {
+			prefix = fmt.Sprintf("targets[%d].", i)
+		}
+		params := target.ThresholdParams
+		if params.CPUTriggerDelay != 0 || params.RSSTriggerDelay != 0 {
+			warnings = append(warnings, fmt.Sprintf("%sthreshold_params.cpu_trigger_delay and rss_trigger_delay are ignored, "+
+				"processes are sampled every check_interval and triggers fire from the last cpu_trigger_window and "+
+				"rss_trigger_window samples", prefix))
+		}
+	}
+	return warnings
+}
+
+// Validate checks every option and returns a *ValidationError listing all the problems found
+func (c HunterConfig) Validate() error {
+	problems := &ValidationError{}
+
+	if c.CheckInterval <= 0 {
+		problems.add("check_interval must be greater than 0 seconds")
+	}
+	if c.TraceDir == "" {
+		problems.add("trace_dir must be set")
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		problems.add("timezone %q is not a valid location: %v", c.Timezone, err)
+	}
+	if c.ProcRoot == "" {
+		problems.add("proc_root must be set")
+	} else if info, err := os.Stat(c.ProcRoot); err != nil || !info.IsDir() {
+		problems.add("proc_root %s is not a directory", c.ProcRoot)
+	}
+
+	switch c.ContainerResolverType() {
+	case "", container.ResolverDocker, container.ResolverCgroup:
+	default:
+		problems.add("container_resolver must be %s or %s", container.ResolverDocker, container.ResolverCgroup)
+	}
+	if c.Kubernetes.Enabled {
+		if _, err := url.Parse(os.ExpandEnv(c.Kubernetes.KubeletURL)); err != nil {
+			problems.add("kubernetes.kubelet_url is not a valid URL: %v", err)
+		}
+	}
+
+	if c.Metrics.MaxProcessSeries < 0 {
+		problems.add("metrics.max_process_series must not be negative")
+	}
+	if c.Retention.Interval <= 0 {
+		problems.add("retention.interval must be greater than 0 seconds")
+	}
+	if c.Retention.MaxAgeHours < 0 || c.Retention.MaxTotalMiB < 0 || c.Retention.MaxFiles < 0 || c.Retention.MinFreeMiB < 0 {
+		problems.add("retention.max_age_hours, max_total_mib, max_files and min_free_mib must not be negative")
+	}
+	if c.Cooldown.PID < 0 || c.Cooldown.Container < 0 || c.Cooldown.Target < 0 || c.Cooldown.MaxTracesPerHour < 0 {
+		problems.add("cooldown.pid, container, target and max_traces_per_hour must not be negative")
+	}
+	if c.Queue.Workers < 1 {
+		problems.add("queue.workers must be at least 1")
+	}
+	if c.Queue.MaxQueued < 0 {
+		problems.add("queue.max_queued must not be negative")
+	}
+	switch c.Queue.SameContainer {
+	case SameContainerQueue, SameContainerDrop, SameContainerCoalesce:
+	default:
+		problems.add("queue.same_container must be %s, %s or %s", SameContainerQueue, SameContainerDrop, SameContainerCoalesce)
+	}
+
+	for _, problem := range c.Upload.problems() {
+		problems.add("upload.%s", problem)
+	}
+	for _, problem := range c.Notify.problems() {
+		problems.add("notify.%s", problem)
+	}
+
+	if len(c.Targets) == 0 {
+		c.EffectiveTargets()[0].validate("", problems)
+	}
+	names := make(map[string]bool)
+	for i, target := range c.Targets {
+		prefix := fmt.Sprintf("targets[%d].", i)
+		if target.Name == "" {
+			problems.add("%sname must be set", prefix)
+		} else if names[target.Name] {
+			problems.add("%sname %q is used by another target", prefix, target.Name)
+		}
+		names[target.Name] = true
+		target.validate(prefix, problems)
+	}
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseAppliesDefaults(t *testing.T) {
+	c, err := Parse([]byte("process_command: php-fpm7.4\nthreshold_params:\n  cpu_threshold: 150\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Default()
+	expected.ProcessCommand = "php-fpm7.4"
+	expected.ThresholdParams.CPUThreshold = 150
+	if c.CheckInterval != expected.CheckInterval || c.Timezone != "UTC" || c.TraceDir != expected.TraceDir {
+		t.Errorf("expected defaults to be applied, instead got: %+v", c)
+	}
+	if c.ThresholdParams != expected.ThresholdParams {
+		t.Errorf("expected threshold params %+v, instead got: %+v", expected.ThresholdParams, c.ThresholdParams)
+	}
+	if policy := c.Retention.Policy(); policy.MaxAge != 0 || policy.MaxTotalBytes != 0 || policy.MaxFiles != 0 {
+		t.Errorf("expected no traces to be evicted by default, instead got: %+v", policy)
+	}
+}
+
+func TestParseRejectsUnknownFields(t *testing.T) {
+	_, err := Parse([]byte("check_intervall: 30\n"))
+	if err == nil || !strings.Contains(err.Error(), "check_intervall") {
+		t.Errorf("expected the unknown field to be rejected, instead got: %v", err)
+	}
+}
+
+func TestParseAggregatesProblems(t *testing.T) {
+	_, err := Parse([]byte(`
+check_interval: 0
+timezone: "Mars/Olympus_Mons"
+container_resolver: "podman"
+process_matcher:
+  cmdline: "php-fpm: pool ("
+phpspy:
+  max_depth: 0
+threshold_params:
+  cpu_trigger_policy: "median"
+metrics:
+  max_process_series: -1
+queue:
+  same_container: "merge"
+upload:
+  enabled: true
+notify:
+  events: ["fired"]
+  email:
+    host: "smtp.example.com"
+`))
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, instead got: %v", err)
+	}
+	expected := []string{"check_interval", "timezone", "container_resolver", "process_matcher", "phpspy.max_depth",
+		"threshold_params.cpu_trigger_policy", "metrics.max_process_series", "queue.same_container", "upload.bucket",
+		"notify.events", "notify.email.from"}
+	if len(validationErr.Problems) != len(expected) {
+		t.Errorf("expected %d problems, instead got: %v", len(expected), validationErr.Problems)
+	}
+	for _, option := range expected {
+		if !strings.Contains(err.Error(), option) {
+			t.Errorf("expected %s to be reported: %v", option, err)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	c, err := Parse([]byte("threshold_params:\n  cpu_trigger_delay: 5\n"))
+	if err != nil {
+		t.Fatalf("expected the deprecated option to still be accepted: %v", err)
+	}
+	if warnings := c.Warnings(); len(warnings) != 1 || !strings.HasPrefix(warnings[0], "threshold_params.cpu_trigger_delay") {
+		t.Errorf("expected a warning for the deprecated option, instead got %q", warnings)
+	}
+	if warnings := Default().Warnings(); len(warnings) != 0 {
+		t.Errorf("expected no warnings by default, instead got %q", warnings)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	if _, err := Load("../config-example.yml"); err != nil {
+		t.Errorf("expected the example configuration to be valid: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := Default()
+	c.ProcessMatcher.Cmdline = "pool www"
+	c.Upload.SecretAccessKey = "secret"
+	c.Notify.Webhook.URL = "https://hooks.example.com/phunter?token=secret"
+	c.Notify.Webhook.Headers = map[string]string{"Authorization": "Bearer secret"}
+	c.Notify.Slack.WebhookURL = "https://hooks.slack.com/services/T000/B000/secret"
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := json.Marshal(snapshot); err != nil {
+		t.Fatalf("expected the snapshot to be encodable as JSON: %v", err)
+	}
+	if snapshot["process_command"] != "php-fpm" {
+		t.Errorf("expected process_command to be php-fpm, instead got %v", snapshot["process_command"])
+	}
+	matcher, ok := snapshot["process_matcher"].(map[string]interface{})
+	if !ok || matcher["cmdline"] != "pool www" {
+		t.Errorf("expected the nested process_matcher to be recorded, instead got %v", snapshot["process_matcher"])
+	}
+	upload, ok := snapshot["upload"].(map[string]interface{})
+	if !ok || upload["secret_access_key"] != redacted || upload["session_token"] != "" {
+		t.Errorf("expected only the credentials that are set to be redacted, instead got %v", snapshot["upload"])
+	}
+	if strings.Contains(fmt.Sprint(snapshot["notify"]), "secret") {
+		t.Errorf("expected the webhook URLs and headers to be redacted, instead got %v", snapshot["notify"])
+	}
+	if c.Upload.SecretAccessKey != "secret" || c.Notify.Webhook.Headers["Authorization"] != "Bearer secret" {
+		t.Error("expected the configuration not to be modified by taking a snapshot")
+	}
+	if _, ok := snapshot["TargetName"]; ok {
+		t.Error("expected options that can't be set in the configuration file to be left out")
+	}
+}
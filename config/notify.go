@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+)
+
+const (
+	NotifyEventStart    = "start"    // a triggered trace started
+	NotifyEventComplete = "complete" // a trace finished
+)
+
+// NotifyConfig configures notifications sent when a triggered trace starts and when the trace completes
+// environment variables in the URLs, headers and password are expanded e.g. ${SLACK_WEBHOOK_URL}
+type NotifyConfig struct {
+	Events            []string      `yaml:"events"`              // start and complete
+	TraceServerURL    string        `yaml:"trace_server_url"`    // used to link to traces e.g. http://${NODE_IP}:9000
+	RateLimit         int           `yaml:"rate_limit"`          // traces notified per target in each rate_limit_interval, 0 for no limit
+	RateLimitInterval int           `yaml:"rate_limit_interval"` // seconds
+	Webhook           WebhookConfig `yaml:"webhook"`
+	Slack             SlackConfig   `yaml:"slack"`
+	Email             EmailConfig   `yaml:"email"`
+}
+
+// WebhookConfig posts notifications as JSON to a URL
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"` // e.g. Authorization
+}
+
+// SlackConfig posts notifications to a Slack compatible incoming webhook
+type SlackConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+	Channel    string `yaml:"channel"`  // overrides the webhook's channel
+	Username   string `yaml:"username"` // overrides the webhook's username
+}
+
+// EmailConfig sends notifications by SMTP, STARTTLS is used when the server supports it
+type EmailConfig struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"` // PLAIN authentication is used when set
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// DefaultNotifyConfig returns the defaults for notifications, no notifiers are configured by default
+func DefaultNotifyConfig() NotifyConfig {
+	return NotifyConfig{
+		Events:            []string{NotifyEventStart, NotifyEventComplete},
+		RateLimit:         5,
+		RateLimitInterval: 3600,
+		Email:             EmailConfig{Port: 587},
+	}
+}
+
+// Notifies returns whether notifications are sent for the event
+func (c NotifyConfig) Notifies(event string) bool {
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled returns whether any notifiers are configured
+func (c NotifyConfig) Enabled() bool {
+	return c.Webhook.URL != "" || c.Slack.WebhookURL != "" || c.Email.Host != ""
+}
+
+// redact replaces the options that may contain credentials, copying the webhook headers so c is unchanged
+func (c NotifyConfig) redact() NotifyConfig {
+	// webhook URLs commonly carry a token in the path or query
+	if c.Webhook.URL != "" {
+		c.Webhook.URL = redacted
+	}
+	if c.Slack.WebhookURL != "" {
+		c.Slack.WebhookURL = redacted
+	}
+	if c.Email.Password != "" {
+		c.Email.Password = redacted
+	}
+	if len(c.Webhook.Headers) > 0 {
+		headers := make(map[string]string, len(c.Webhook.Headers))
+		for name := range c.Webhook.Headers {
+			headers[name] = redacted
+		}
+		c.Webhook.Headers = headers
+	}
+	return c
+}
+
+func (c NotifyConfig) problems() []string {
+	var problems []string
+	for _, event := range c.Events {
+		if event != NotifyEventStart && event != NotifyEventComplete {
+			problems = append(problems, fmt.Sprintf("events must be %s or %s, not %q", NotifyEventStart, NotifyEventComplete, event))
+		}
+	}
+	if c.RateLimit < 0 {
+		problems = append(problems, "rate_limit must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateLimitInterval <= 0 {
+		problems = append(problems, "rate_limit_interval must be greater than 0 seconds")
+	}
+	urls := []struct{ option, value string }{
+		{"trace_server_url", c.TraceServerURL},
+		{"webhook.url", c.Webhook.URL},
+		{"slack.webhook_url", c.Slack.WebhookURL},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+		// the value isn't included in the problem as it may be a credential
+		if parsed, err := url.Parse(os.ExpandEnv(u.value)); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s must be an http or https URL", u.option))
+		}
+	}
+	if c.Email.Host != "" {
+		if c.Email.Port < 1 || c.Email.Port > 65535 {
+			problems = append(problems, "email.port must be between 1 and 65535")
+		}
+		if c.Email.From == "" || len(c.Email.To) == 0 {
+			problems = append(problems, "email.from and email.to must be set")
+		}
+	}
+	return problems
+}
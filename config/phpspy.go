@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	PHPSpyOutputMultiLine  = "multi-line"
+	PHPSpyOutputSingleLine = "single-line"
+)
+
+// PHPSpyDefaultRate is the rate phpspy traces at when neither rate nor sleep is set
+const PHPSpyDefaultRate = 99
+
+// PHPSpyConfig configures the tracer used when application is php
+// zero values are left out of the command so phpspy's own default is used
+// For configuration options see: https://github.com/adsr/phpspy
+type PHPSpyConfig struct {
+	Pgrep               string   `yaml:"pgrep"`                 // -P, trace processes matching the pgrep args instead of the pid
+	Threads             int      `yaml:"threads"`               // -T, number of threads used in pgrep mode
+	Sleep               int64    `yaml:"sleep"`                 // -s, nanoseconds to sleep between traces instead of a rate
+	Rate                int      `yaml:"rate"`                  // -H, traces per second, PHPSpyDefaultRate unless sleep is set
+	Limit               int      `yaml:"limit"`                 // -l, total number of traces to capture, 0 is unlimited
+	TimeLimitMS         int      `yaml:"time_limit_ms"`         // -i, stop tracing after milliseconds, 0 is unlimited
+	MaxDepth            int      `yaml:"max_depth"`             // -n, maximum stack trace depth, -1 is unlimited
+	RequestInfo         string   `yaml:"request_info"`          // -r, request info to capture q=query c=cookie u=uri p=path, capitals negate
+	MemoryUsage         bool     `yaml:"memory_usage"`          // -m, capture peak and current memory usage
+	Filter              string   `yaml:"filter"`                // -f, only output traces matching the POSIX regex
+	FilterNegate        string   `yaml:"filter_negate"`         // -F, only output traces not matching the POSIX regex
+	ExecutorGlobalsAddr string   `yaml:"executor_globals_addr"` // -x, address of executor_globals in hex, found dynamically when empty
+	SAPIGlobalsAddr     string   `yaml:"sapi_globals_addr"`     // -a, address of sapi_globals in hex, found dynamically when empty
+	OutputFormat        string   `yaml:"output_format"`         // multi-line or single-line (-1)
+	VerboseFields       string   `yaml:"verbose_fields"`        // -d, p=pid t=timestamp, capitals negate
+	BufferSize          int      `yaml:"buffer_size"`           // -b, output buffer size
+	ContinueOnError     bool     `yaml:"continue_on_error"`     // -c, attempt to continue tracing after an error
+	PeekVars            []string `yaml:"peek_vars"`             // -e, variables to peek at e.g. "$var@/path/file.php:10"
+	PeekGlobals         []string `yaml:"peek_globals"`          // -g, globals to peek at e.g. "server.REQUEST_TIME"
+	WritePprof          bool     `yaml:"write_pprof"`           // convert the trace to a pprof profile written alongside it when tracing completes
+}
+
+var (
+	phpSpyRequestInfoPattern   = regexp.MustCompile(`^[qcupQCUP]*$`)
+	phpSpyVerboseFieldsPattern = regexp.MustCompile(`^[ptPT]*$`)
+)
+
+// DefaultPHPSpyConfig returns phpspy's own defaults, the rate is left unset so a configured sleep is used instead
+func DefaultPHPSpyConfig() PHPSpyConfig {
+	return PHPSpyConfig{
+		Threads:      16,
+		MaxDepth:     -1,
+		OutputFormat: PHPSpyOutputMultiLine,
+		BufferSize:   4096,
+	}
+}
+
+// Validate checks the options will be accepted by phpspy
+func (c PHPSpyConfig) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return fmt.Errorf("invalid phpspy configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c PHPSpyConfig) problems() []string {
+	var problems []string
+	nonNegative := []struct {
+		name  string
+		value int64
+	}{
+		{"threads", int64(c.Threads)},
+		{"sleep", c.Sleep},
+		{"rate", int64(c.Rate)},
+		{"limit", int64(c.Limit)},
+		{"time_limit_ms", int64(c.TimeLimitMS)},
+		{"buffer_size", int64(c.BufferSize)},
+	}
+	for _, option := range nonNegative {
+		if option.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", option.name))
+		}
+	}
+	if c.Rate > 0 && c.Sleep > 0 {
+		problems = append(problems, "only one of rate and sleep can be set")
+	}
+	if c.MaxDepth == 0 || c.MaxDepth < -1 {
+		problems = append(problems, "max_depth must be -1 (unlimited) or greater than 0")
+	}
+	if !phpSpyRequestInfoPattern.MatchString(c.RequestInfo) {
+		problems = append(problems, fmt.Sprintf("request_info %q may only contain the characters qcupQCUP", c.RequestInfo))
+	}
+	if !phpSpyVerboseFieldsPattern.MatchString(c.VerboseFields) {
+		problems = append(problems, fmt.Sprintf("verbose_fields %q may only contain the characters ptPT", c.VerboseFields))
+	}
+	for _, filter := range [][2]string{{"filter", c.Filter}, {"filter_negate", c.FilterNegate}} {
+		if filter[1] == "" {
+			continue
+		}
+		if _, err := regexp.CompilePOSIX(filter[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not a valid POSIX regular expression: %v", filter[0], err))
+		}
+	}
+	for _, addr := range [][2]string{{"executor_globals_addr", c.ExecutorGlobalsAddr}, {"sapi_globals_addr", c.SAPIGlobalsAddr}} {
+		if addr[1] == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimPrefix(addr[1], "0x"), 16, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q is not a hex address", addr[0], addr[1]))
+		}
+	}
+	switch c.OutputFormat {
+	case "", PHPSpyOutputMultiLine, PHPSpyOutputSingleLine:
+	default:
+		problems = append(problems, fmt.Sprintf("output_format must be %s or %s", PHPSpyOutputMultiLine, PHPSpyOutputSingleLine))
+	}
+	return problems
+}
+
+// Args returns the phpspy arguments to trace the process with the specified pid
+// the php version is detected by phpspy when version is empty
+func (c PHPSpyConfig) Args(pid int, version string) []string {
+	var args []string
+	if version != "" {
+		args = append(args, "-V"+version)
+	}
+	if c.Pgrep != "" {
+		args = append(args, "-P", c.Pgrep)
+		if c.Threads > 0 {
+			args = append(args, "-T", strconv.Itoa(c.Threads))
+		}
+	} else {
+		args = append(args, "-p", strconv.Itoa(pid))
+	}
+
+	if c.Sleep > 0 {
+		args = append(args, "-s", strconv.FormatInt(c.Sleep, 10))
+	} else if c.Rate > 0 {
+		args = append(args, "-H", strconv.Itoa(c.Rate))
+	} else {
+		args = append(args, "-H", strconv.Itoa(PHPSpyDefaultRate))
+	}
+	if c.Limit > 0 {
+		args = append(args, "-l", strconv.Itoa(c.Limit))
+	}
+	if c.TimeLimitMS > 0 {
+		args = append(args, "-i", strconv.Itoa(c.TimeLimitMS))
+	}
+	if c.MaxDepth > 0 {
+		args = append(args, "-n", strconv.Itoa(c.MaxDepth))
+	}
+	if c.RequestInfo != "" {
+		args = append(args, "-r", c.RequestInfo)
+	}
+	if c.MemoryUsage {
+		args = append(args, "-m")
+	}
+	if c.Filter != "" {
+		args = append(args, "-f", c.Filter)
+	}
+	if c.FilterNegate != "" {
+		args = append(args, "-F", c.FilterNegate)
+	}
+	if c.ExecutorGlobalsAddr != "" {
+		args = append(args, "-x", c.ExecutorGlobalsAddr)
+	}
+	if c.SAPIGlobalsAddr != "" {
+		args = append(args, "-a", c.SAPIGlobalsAddr)
+	}
+	if c.OutputFormat == PHPSpyOutputSingleLine {
+		args = append(args, "-1")
+	}
+	if c.VerboseFields != "" {
+		args = append(args, "-d", c.VerboseFields)
+	}
+	if c.BufferSize > 0 {
+		args = append(args, "-b", strconv.Itoa(c.BufferSize))
+	}
+	if c.ContinueOnError {
+		args = append(args, "-c")
+	}
+	for _, peekVar := range c.PeekVars {
+		args = append(args, "-e", peekVar)
+	}
+	for _, peekGlobal := range c.PeekGlobals {
+		args = append(args, "-g", peekGlobal)
+	}
+	return args
+}
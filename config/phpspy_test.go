@@ -0,0 +1,128 @@
+package config
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPHPSpyArgsDefaults(t *testing.T) {
+	args := DefaultPHPSpyConfig().Args(4242, "74")
+	expected := []string{"-V74", "-p", "4242", "-H", "99", "-b", "4096"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, instead got: %v", expected, args)
+	}
+}
+
+func TestPHPSpyArgsAllOptions(t *testing.T) {
+	c := PHPSpyConfig{
+		Sleep:               10101010,
+		Limit:               1000,
+		TimeLimitMS:         5000,
+		MaxDepth:            50,
+		RequestInfo:         "qcup",
+		MemoryUsage:         true,
+		Filter:              "Illuminate",
+		FilterNegate:        "vendor",
+		ExecutorGlobalsAddr: "0x7f1c2a3b4c5d",
+		SAPIGlobalsAddr:     "7f1c2a3b4c6e",
+		OutputFormat:        PHPSpyOutputSingleLine,
+		VerboseFields:       "pt",
+		BufferSize:          8192,
+		ContinueOnError:     true,
+		PeekVars:            []string{"$id@/app/index.php:10"},
+		PeekGlobals:         []string{"server.REQUEST_TIME"},
+	}
+	args := c.Args(4242, "")
+	expected := []string{
+		"-p", "4242",
+		"-s", "10101010",
+		"-l", "1000",
+		"-i", "5000",
+		"-n", "50",
+		"-r", "qcup",
+		"-m",
+		"-f", "Illuminate",
+		"-F", "vendor",
+		"-x", "0x7f1c2a3b4c5d",
+		"-a", "7f1c2a3b4c6e",
+		"-1",
+		"-d", "pt",
+		"-b", "8192",
+		"-c",
+		"-e", "$id@/app/index.php:10",
+		"-g", "server.REQUEST_TIME",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, instead got: %v", expected, args)
+	}
+}
+
+func TestPHPSpyArgsPgrepMode(t *testing.T) {
+	c := DefaultPHPSpyConfig()
+	c.Pgrep = "-x php-fpm"
+	c.Threads = 4
+	args := c.Args(4242, "74")
+	expected := []string{"-V74", "-P", "-x php-fpm", "-T", "4", "-H", "99", "-b", "4096"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, instead got: %v", expected, args)
+	}
+}
+
+func TestPHPSpyArgsSleep(t *testing.T) {
+	c := HunterConfig{PHPSpyConfig: DefaultPHPSpyConfig()}
+	if err := yaml.Unmarshal([]byte("phpspy:\n  sleep: 20000000\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PHPSpyConfig.Validate(); err != nil {
+		t.Fatalf("expected sleep on top of the defaults to be valid: %v", err)
+	}
+	args := c.PHPSpyConfig.Args(4242, "")
+	expected := []string{"-p", "4242", "-s", "20000000", "-b", "4096"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, instead got: %v", expected, args)
+	}
+}
+
+func TestPHPSpyValidateRateAndSleep(t *testing.T) {
+	c := DefaultPHPSpyConfig()
+	c.Rate = 49
+	c.Sleep = 20000000
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "rate and sleep") {
+		t.Errorf("expected setting both rate and sleep to fail validation, instead got %v", err)
+	}
+}
+
+func TestPHPSpyValidate(t *testing.T) {
+	if err := DefaultPHPSpyConfig().Validate(); err != nil {
+		t.Errorf("expected defaults to be valid: %v", err)
+	}
+
+	c := DefaultPHPSpyConfig()
+	c.Rate = -1
+	c.MaxDepth = 0
+	c.RequestInfo = "qx"
+	c.Filter = "("
+	c.ExecutorGlobalsAddr = "0xzz"
+	c.OutputFormat = "json"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config to fail validation")
+	}
+	for _, option := range []string{"rate", "max_depth", "request_info", "filter", "executor_globals_addr", "output_format"} {
+		if !strings.Contains(err.Error(), option) {
+			t.Errorf("expected %s to be reported as invalid: %v", option, err)
+		}
+	}
+}
+
+func TestPHPSpyUnmarshalKeepsDefaults(t *testing.T) {
+	c := HunterConfig{PHPSpyConfig: DefaultPHPSpyConfig()}
+	if err := yaml.Unmarshal([]byte("phpspy:\n  rate: 49\n  memory_usage: true\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.PHPSpyConfig.Rate != 49 || !c.PHPSpyConfig.MemoryUsage || c.PHPSpyConfig.MaxDepth != -1 {
+		t.Errorf("unexpected phpspy config: %+v", c.PHPSpyConfig)
+	}
+}
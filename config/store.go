@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// Store holds the active configuration so it can be replaced while phunter is running
+// readers always see either the old or new configuration in full
+type Store struct {
+	value atomic.Value
+}
+
+// NewStore returns a store holding the initial configuration
+func NewStore(config HunterConfig) *Store {
+	s := &Store{}
+	s.value.Store(config)
+	return s
+}
+
+// Get returns the active configuration
+func (s *Store) Get() HunterConfig {
+	return s.value.Load().(HunterConfig)
+}
+
+// Set replaces the active configuration
+func (s *Store) Set(config HunterConfig) {
+	s.value.Store(config)
+}
+
+// Watcher detects changes to a configuration file by comparing its contents
+// the file is read through any symlinks so a kubernetes ConfigMap update, which swaps
+// the ..data symlink rather than writing to the file, is also detected
+type Watcher struct {
+	path string
+	sum  [sha256.Size]byte
+}
+
+// NewWatcher returns a watcher for the configuration file in its current state
+func NewWatcher(path string) (*Watcher, error) {
+	w := &Watcher{path: path}
+	if _, err := w.Changed(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Changed reports whether the file contents are different to the last time it was checked
+func (w *Watcher) Changed() (bool, error) {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	if sum == w.sum {
+		return false, nil
+	}
+	w.sum = sum
+	return true, nil
+}
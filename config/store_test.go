@@ -0,0 +1,67 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(Default())
+	updated := Default()
+	updated.CheckInterval = 5
+	store.Set(updated)
+	if store.Get().CheckInterval != 5 {
+		t.Errorf("expected the updated configuration, instead got: %+v", store.Get())
+	}
+}
+
+// TestWatcherConfigMapUpdate replicates how the kubelet updates a mounted ConfigMap
+// config.yml -> ..data/config.yml and ..data -> ..<timestamp> which is swapped on update
+func TestWatcherConfigMapUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phunter-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeVersion := func(version string, contents string) {
+		versionDir := filepath.Join(dir, version)
+		if err := os.Mkdir(versionDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(versionDir, "config.yml"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tmpLink := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(version, tmpLink); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeVersion("..2020_01_01", "check_interval: 30\n")
+	configFile := filepath.Join(dir, "config.yml")
+	if err := os.Symlink(filepath.Join("..data", "config.yml"), configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := NewWatcher(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := watcher.Changed(); err != nil || changed {
+		t.Errorf("expected no change, instead got: %t %v", changed, err)
+	}
+
+	writeVersion("..2020_01_02", "check_interval: 10\n")
+	if changed, err := watcher.Changed(); err != nil || !changed {
+		t.Errorf("expected the symlink swap to be detected, instead got: %t %v", changed, err)
+	}
+	if changed, err := watcher.Changed(); err != nil || changed {
+		t.Errorf("expected the change to only be reported once, instead got: %t %v", changed, err)
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/process"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultTargetName is the name of the target made from the top level options when no targets are listed
+const DefaultTargetName = "default"
+
+// Target is a group of processes that are checked with their own thresholds and tracer
+// options that aren't set are inherited from the top level configuration, except for the
+// process_command and process_matcher which every target must set
+type Target struct {
+	Name                string                  `yaml:"name"`
+	ProcessCommand      string                  `yaml:"process_command"`
+	ProcessMatcher      process.Matcher         `yaml:"process_matcher"`
+	Application         string                  `yaml:"application"`
+	ApplicationVersion  string                  `yaml:"application_version"`
+	TraceDuration       int                     `yaml:"trace_duration"`
+	ThresholdParams     process.ThresholdParams `yaml:"threshold_params"`
+	PHPSpyConfig        PHPSpyConfig            `yaml:"phpspy"`
+	PySpyConfig         PySpyConfig             `yaml:"pyspy"`
+	RbSpyConfig         RbSpyConfig             `yaml:"rbspy"`
+	NativeTracerConfig  NativeTracerConfig      `yaml:"native"`
+	CommandTracerConfig CommandTracerConfig     `yaml:"command"`
+}
+
+// Matcher returns the criteria used to select the target's processes
+// process_command is treated as the comm pattern when process_matcher doesn't set one
+func (t Target) Matcher() process.Matcher {
+	matcher := t.ProcessMatcher
+	if matcher.Comm == "" {
+		matcher.Comm = t.ProcessCommand
+	}
+	return matcher
+}
+
+// inheritedTarget returns a target with the top level options that targets inherit
+func (c HunterConfig) inheritedTarget() Target {
+	return Target{
+		Application:         c.Application,
+		ApplicationVersion:  c.ApplicationVersion,
+		TraceDuration:       c.TraceDuration,
+		ThresholdParams:     c.ThresholdParams,
+		PHPSpyConfig:        c.PHPSpyConfig,
+		PySpyConfig:         c.PySpyConfig,
+		RbSpyConfig:         c.RbSpyConfig,
+		NativeTracerConfig:  c.NativeTracerConfig,
+		CommandTracerConfig: c.CommandTracerConfig,
+	}
+}
+
+// EffectiveTargets returns the targets to check on every tick
+// the top level options form a single target when no targets are listed
+func (c HunterConfig) EffectiveTargets() []Target {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	target := c.inheritedTarget()
+	target.Name = DefaultTargetName
+	target.ProcessCommand = c.ProcessCommand
+	target.ProcessMatcher = c.ProcessMatcher
+	return []Target{target}
+}
+
+// ForTarget returns the configuration used to check and trace the target's processes
+func (c HunterConfig) ForTarget(t Target) HunterConfig {
+	targetConfig := c
+	targetConfig.Targets = nil
+	targetConfig.TargetName = t.Name
+	targetConfig.ProcessCommand = t.ProcessCommand
+	targetConfig.ProcessMatcher = t.ProcessMatcher
+	targetConfig.Application = t.Application
+	targetConfig.ApplicationVersion = t.ApplicationVersion
+	targetConfig.TraceDuration = t.TraceDuration
+	targetConfig.ThresholdParams = t.ThresholdParams
+	targetConfig.PHPSpyConfig = t.PHPSpyConfig
+	targetConfig.PySpyConfig = t.PySpyConfig
+	targetConfig.RbSpyConfig = t.RbSpyConfig
+	targetConfig.NativeTracerConfig = t.NativeTracerConfig
+	targetConfig.CommandTracerConfig = t.CommandTracerConfig
+	return targetConfig
+}
+
+// decodeTargets decodes each target on top of the options it inherits from the top level configuration
+// yaml can't do this in a single pass as the top level options aren't known until the whole file is decoded
+func (c *HunterConfig) decodeTargets(data []byte) error {
+	var raw struct {
+		Targets []yaml.MapSlice `yaml:"targets"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	c.Targets = make([]Target, len(raw.Targets))
+	for i, rawTarget := range raw.Targets {
+		targetData, err := yaml.Marshal(rawTarget)
+		if err != nil {
+			return err
+		}
+		target := c.inheritedTarget()
+		if err := yaml.UnmarshalStrict(targetData, &target); err != nil {
+			return fmt.Errorf("targets[%d]: %v", i, err)
+		}
+		c.Targets[i] = target
+	}
+	return nil
+}
+
+func (t Target) validate(prefix string, problems *ValidationError) {
+	if t.Application == "" {
+		problems.add("%sapplication must be set", prefix)
+	}
+	if t.TraceDuration <= 0 {
+		problems.add("%strace_duration must be greater than 0 seconds", prefix)
+	}
+
+	matcher := t.Matcher()
+	if matcher == (process.Matcher{}) {
+		problems.add("%sprocess_command or process_matcher must be set", prefix)
+	} else if err := matcher.Validate(); err != nil {
+		problems.add("%sprocess_matcher: %v", prefix, err)
+	}
+
+	params := t.ThresholdParams
+	if params.CPUThreshold < 0 {
+		problems.add("%sthreshold_params.cpu_threshold must not be negative", prefix)
+	}
+	if params.RSSThreshold < 0 {
+		problems.add("%sthreshold_params.rss_threshold must not be negative", prefix)
+	}
+	if params.CPUTriggerCount < 1 {
+		problems.add("%sthreshold_params.cpu_trigger_count must be at least 1", prefix)
+	}
+	if params.RSSTriggerCount < 1 {
+		problems.add("%sthreshold_params.rss_trigger_count must be at least 1", prefix)
+	}
+	for _, problem := range params.Problems() {
+		problems.add("%sthreshold_params.%s", prefix, problem)
+	}
+
+	if t.Application == "php" {
+		for _, problem := range t.PHPSpyConfig.problems() {
+			problems.add("%sphpspy.%s", prefix, problem)
+		}
+	}
+}
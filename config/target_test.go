@@ -0,0 +1,108 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEffectiveTargetsDefault(t *testing.T) {
+	c, err := Parse([]byte("process_command: php-fpm7.4\ntrace_duration: 20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := c.EffectiveTargets()
+	if len(targets) != 1 {
+		t.Fatalf("expected a single target, instead got: %+v", targets)
+	}
+	if targets[0].Name != DefaultTargetName || targets[0].ProcessCommand != "php-fpm7.4" || targets[0].TraceDuration != 20 {
+		t.Errorf("expected the target to be made from the top level options, instead got: %+v", targets[0])
+	}
+}
+
+func TestTargetsInheritTopLevelOptions(t *testing.T) {
+	c, err := Parse([]byte(`
+application_version: "74"
+trace_duration: 10
+threshold_params:
+  cpu_threshold: 150
+  rss_threshold: 262144
+phpspy:
+  rate: 49
+targets:
+  - name: www74
+    process_matcher:
+      cmdline: "^php-fpm: pool www"
+      exe: "/usr/sbin/php-fpm7.4"
+  - name: cli80
+    process_command: "php"
+    application_version: "80"
+    trace_duration: 30
+    threshold_params:
+      cpu_threshold: 95
+    phpspy:
+      memory_usage: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := c.EffectiveTargets()
+	if len(targets) != 2 {
+		t.Fatalf("expected two targets, instead got: %+v", targets)
+	}
+
+	www := c.ForTarget(targets[0])
+	if www.TargetName != "www74" || www.ApplicationVersion != "74" || www.TraceDuration != 10 {
+		t.Errorf("unexpected www74 configuration: %+v", www)
+	}
+	if www.ThresholdParams.CPUThreshold != 150 || www.PHPSpyConfig.Rate != 49 {
+		t.Errorf("expected www74 to inherit the top level thresholds and phpspy options: %+v", www)
+	}
+	if www.Matcher().Cmdline != "^php-fpm: pool www" || www.Matcher().Comm != "" {
+		t.Errorf("expected www74 to only use its own matcher: %+v", www.Matcher())
+	}
+
+	cli := c.ForTarget(targets[1])
+	if cli.ApplicationVersion != "80" || cli.TraceDuration != 30 || cli.Matcher().Comm != "php" {
+		t.Errorf("unexpected cli80 configuration: %+v", cli)
+	}
+	if cli.ThresholdParams.CPUThreshold != 95 || cli.ThresholdParams.RSSThreshold != 262144 {
+		t.Errorf("expected cli80 to override the cpu threshold only: %+v", cli.ThresholdParams)
+	}
+	if !cli.PHPSpyConfig.MemoryUsage || cli.PHPSpyConfig.Rate != 49 {
+		t.Errorf("expected cli80 to merge its phpspy options: %+v", cli.PHPSpyConfig)
+	}
+}
+
+func TestTargetsValidation(t *testing.T) {
+	_, err := Parse([]byte(`
+targets:
+  - name: www
+    process_command: php-fpm
+  - name: www
+    trace_duration: -1
+  - process_command: php
+    phpspy:
+      max_depth: 0
+`))
+	if err == nil {
+		t.Fatal("expected invalid targets to fail validation")
+	}
+	for _, problem := range []string{
+		`targets[1].name "www" is used by another target`,
+		"targets[1].trace_duration",
+		"targets[1].process_command or process_matcher must be set",
+		"targets[2].name must be set",
+		"targets[2].phpspy.max_depth",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to be reported: %v", problem, err)
+		}
+	}
+}
+
+func TestTargetsRejectUnknownFields(t *testing.T) {
+	_, err := Parse([]byte("targets:\n  - name: www\n    process_command: php-fpm\n    check_interval: 5\n"))
+	if err == nil || !strings.Contains(err.Error(), "check_interval") {
+		t.Errorf("expected the unknown target field to be rejected, instead got: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/template"
+)
+
+// DefaultUploadKeyTemplate stores traces by node and day, the trace file name includes the container, PID and time
+const DefaultUploadKeyTemplate = "{{.Node}}/{{.Date}}/{{.Container}}/{{.File}}"
+
+// UploadConfig configures uploading finished traces and their metadata to an S3 compatible bucket
+// environment variables in the endpoint and credentials are expanded e.g. ${AWS_SECRET_ACCESS_KEY}
+// the credentials fall back to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+type UploadConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	Endpoint          string `yaml:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region            string `yaml:"region"`   // used to sign requests
+	Bucket            string `yaml:"bucket"`
+	PathStyle         bool   `yaml:"path_style"` // address the bucket as endpoint/bucket rather than bucket.endpoint
+	AccessKeyID       string `yaml:"access_key_id"`
+	SecretAccessKey   string `yaml:"secret_access_key"`
+	SessionToken      string `yaml:"session_token"`
+	KeyTemplate       string `yaml:"key_template"`        // go template for the object key, see upload.KeyData
+	MaxAttempts       int    `yaml:"max_attempts"`        // attempts at uploading each file before giving up
+	InitialBackoff    int    `yaml:"initial_backoff"`     // seconds to wait before the first retry, doubled on each retry
+	MaxBackoff        int    `yaml:"max_backoff"`         // maximum seconds to wait between retries
+	DeleteAfterUpload bool   `yaml:"delete_after_upload"` // delete the local trace once it's uploaded
+}
+
+// DefaultUploadConfig returns the defaults for uploading traces, which is disabled by default
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		Endpoint:       "https://s3.amazonaws.com",
+		Region:         "us-east-1",
+		KeyTemplate:    DefaultUploadKeyTemplate,
+		MaxAttempts:    5,
+		InitialBackoff: 1,
+		MaxBackoff:     60,
+	}
+}
+
+// Credentials returns the access key, secret key and session token with environment variables expanded
+func (c UploadConfig) Credentials() (string, string, string) {
+	credentials := []string{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}
+	for i, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		if credentials[i] == "" {
+			credentials[i] = os.Getenv(env)
+		} else {
+			credentials[i] = os.ExpandEnv(credentials[i])
+		}
+	}
+	return credentials[0], credentials[1], credentials[2]
+}
+
+// EndpointURL returns the endpoint with environment variables expanded
+func (c UploadConfig) EndpointURL() (*url.URL, error) {
+	endpoint, err := url.Parse(os.ExpandEnv(c.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("%s must be an http or https URL", c.Endpoint)
+	}
+	return endpoint, nil
+}
+
+func (c UploadConfig) problems() []string {
+	if !c.Enabled {
+		return nil
+	}
+	var problems []string
+	if _, err := c.EndpointURL(); err != nil {
+		problems = append(problems, fmt.Sprintf("endpoint is not valid: %v", err))
+	}
+	if c.Region == "" {
+		problems = append(problems, "region must be set")
+	}
+	if c.Bucket == "" {
+		problems = append(problems, "bucket must be set")
+	}
+	if c.KeyTemplate == "" {
+		problems = append(problems, "key_template must be set")
+	} else if _, err := template.New("key").Parse(c.KeyTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("key_template is not a valid template: %v", err))
+	}
+	if c.MaxAttempts < 1 {
+		problems = append(problems, "max_attempts must be at least 1")
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < c.InitialBackoff {
+		problems = append(problems, "initial_backoff must not be negative and max_backoff must not be less than it")
+	}
+	return problems
+}
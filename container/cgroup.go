@@ -0,0 +1,113 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+	RuntimeCRIO       = "cri-o"
+	RuntimePodman     = "podman"
+)
+
+var (
+	// matches the last 64 character container ID in a cgroup path
+	// e.g. /docker/<id> or /kubepods.slice/.../cri-containerd-<id>.scope
+	cgroupContainerIDPattern = regexp.MustCompile(`(?:^|[/-])([0-9a-f]{64})(?:\.scope)?$`)
+
+	// matches the pod UID in a kubernetes cgroup path, the systemd driver replaces dashes with underscores
+	// e.g. /kubepods/burstable/pod<uid>/ or /kubepods-burstable-pod<uid>.slice/
+	cgroupPodUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+	// systemd scope prefixes used by each container runtime
+	cgroupScopeRuntimes = map[string]string{
+		"docker-":         RuntimeDocker,
+		"cri-containerd-": RuntimeContainerd,
+		"crio-":           RuntimeCRIO,
+		"libpod-":         RuntimePodman,
+	}
+)
+
+// CgroupResolver finds the container a process is running in from /proc/[pid]/cgroup
+// it doesn't depend on a container runtime daemon so it works with docker, containerd and CRI-O
+// and supports both cgroup v1 and v2 with either the cgroupfs or systemd cgroup driver
+type CgroupResolver struct {
+	ProcRoot string // where the host procfs is mounted
+}
+
+// NewCgroupResolver returns a resolver that reads cgroups from procRoot
+func NewCgroupResolver(procRoot string) *CgroupResolver {
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	return &CgroupResolver{ProcRoot: procRoot}
+}
+
+// Resolve returns the container ID, and the pod UID when running on kubernetes, of the process
+// the name of the container isn't available from cgroups so the short container ID is used instead
+func (c *CgroupResolver) Resolve(pid int) (Info, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.ProcRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to read cgroup for pid %d: %v", pid, err)
+	}
+	info, found := parseCgroup(string(data))
+	if !found {
+		return Info{}, ErrNotFound{PID: pid}
+	}
+	return info, nil
+}
+
+// parseCgroup extracts the container from the contents of /proc/[pid]/cgroup
+// each line is hierarchy-ID:controller-list:cgroup-path where cgroup v2 has a hierarchy ID of 0
+// and no controllers
+func parseCgroup(data string) (Info, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if info, found := parseCgroupPath(parts[2]); found {
+			return info, true
+		}
+	}
+	return Info{}, false
+}
+
+func parseCgroupPath(path string) (Info, bool) {
+	match := cgroupContainerIDPattern.FindStringSubmatch(path)
+	if match == nil {
+		return Info{}, false
+	}
+	info := Info{ID: match[1], Name: ShortID(match[1])}
+
+	base := filepath.Base(path)
+	for prefix, runtime := range cgroupScopeRuntimes {
+		if strings.HasPrefix(base, prefix) {
+			info.Runtime = runtime
+		}
+	}
+	if info.Runtime == "" && strings.Contains(path, "/docker/") {
+		info.Runtime = RuntimeDocker
+	}
+
+	if podMatch := cgroupPodUIDPattern.FindStringSubmatch(path); podMatch != nil {
+		info.PodUID = strings.Replace(podMatch[1], "_", "-", -1)
+	}
+	return info, true
+}
+
+// ShortID truncates a container ID to the 12 characters shown by container tooling
+func ShortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,52 @@
+package container
+
+import (
+	"testing"
+)
+
+const testContainerID = "3f2b1c9a8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a"
+const testPodUID = "6f9a1e34-5c2b-4d8e-9a7f-1b2c3d4e5f60"
+
+func TestCgroupResolverResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     int
+		runtime string
+		podUID  string
+	}{
+		{"docker cgroup v1 cgroupfs", 101, RuntimeDocker, ""},
+		{"docker cgroup v2 systemd", 102, RuntimeDocker, ""},
+		{"kubernetes containerd cgroup v1 systemd", 103, RuntimeContainerd, testPodUID},
+		{"kubernetes cri-o cgroup v2 systemd", 104, RuntimeCRIO, testPodUID},
+		{"kubernetes cgroup v1 cgroupfs", 105, "", testPodUID},
+		{"kubernetes cgroup v2 cgroupfs", 106, "", testPodUID},
+	}
+
+	resolver := NewCgroupResolver("testdata/proc")
+	for _, test := range tests {
+		info, err := resolver.Resolve(test.pid)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if info.ID != testContainerID {
+			t.Errorf("%s: expected container ID %s, instead got: %s", test.name, testContainerID, info.ID)
+		}
+		if info.Name != testContainerID[:12] {
+			t.Errorf("%s: expected container name to be the short ID, instead got: %s", test.name, info.Name)
+		}
+		if info.Runtime != test.runtime {
+			t.Errorf("%s: expected runtime %q, instead got: %q", test.name, test.runtime, info.Runtime)
+		}
+		if info.PodUID != test.podUID {
+			t.Errorf("%s: expected pod UID %q, instead got: %q", test.name, test.podUID, info.PodUID)
+		}
+	}
+}
+
+func TestCgroupResolverHostProcess(t *testing.T) {
+	_, err := NewCgroupResolver("testdata/proc").Resolve(107)
+	if _, ok := err.(ErrNotFound); !ok {
+		t.Errorf("expected ErrNotFound for a process not in a container, instead got: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	ResolverDocker = "docker" // query the Docker Engine API
+	ResolverCgroup = "cgroup" // parse /proc/[pid]/cgroup
+)
+
+// Info describes the container a process is running in
+type Info struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Image   string            `json:"image,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Runtime string            `json:"runtime,omitempty"`
+	PodUID  string            `json:"pod_uid,omitempty"`
+	Pod     *Pod              `json:"pod,omitempty"`
+}
+
+// DisplayName identifies the container in trace file names
+// containers in a kubernetes pod are named <namespace>_<pod>_<container>
+func (i Info) DisplayName() string {
+	if i.Pod == nil {
+		return i.Name
+	}
+	name := i.Pod.Namespace + "_" + i.Pod.Name
+	if i.Pod.Container != "" {
+		name += "_" + i.Pod.Container
+	}
+	return name
+}
+
+// LogFields returns the fields used to identify the container in logs
+func (i Info) LogFields() logrus.Fields {
+	fields := logrus.Fields{"container": i.Name}
+	if i.Pod != nil {
+		fields["pod"] = i.Pod.Name
+		fields["namespace"] = i.Pod.Namespace
+		fields["node"] = i.Pod.Node
+		if i.Pod.Deployment != "" {
+			fields["deployment"] = i.Pod.Deployment
+		}
+	}
+	return fields
+}
+
+// Resolver finds the container that a process on the host is running in
+type Resolver interface {
+	Resolve(pid int) (Info, error)
+}
+
+// NewResolver returns the resolver of the specified type, an empty type means containers are not resolved
+func NewResolver(resolverType string, dockerSocket string, procRoot string) (Resolver, error) {
+	switch resolverType {
+	case "":
+		return nil, nil
+	case ResolverDocker:
+		return NewDockerClient(dockerSocket, procRoot), nil
+	case ResolverCgroup:
+		return NewCgroupResolver(procRoot), nil
+	default:
+		return nil, fmt.Errorf("unsupported container resolver: %s", resolverType)
+	}
+}
+
+// CloseIdleConnections closes the connections a resolver keeps open between lookups
+// for when the resolver is replaced, resolvers that don't keep any open are left alone
+func CloseIdleConnections(resolver Resolver) {
+	if closer, ok := resolver.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// ErrNotFound is returned by a Resolver when the process isn't running in a known container
+type ErrNotFound struct {
+	PID int
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("unable to find container for pid: %d", e.PID)
+}
+
+// pidNamespace returns the PID namespace of a process e.g. pid:[4026531836]
+func pidNamespace(procRoot string, pid int) (string, error) {
+	return os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "pid"))
+}
@@ -0,0 +1,178 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDockerSocket is where the Docker Engine API listens by default
+	DefaultDockerSocket = "/var/run/docker.sock"
+
+	dockerRequestTimeout = 10 * time.Second
+)
+
+// DockerClient is a minimal Docker Engine API client that talks to the daemon over its unix socket
+type DockerClient struct {
+	Socket   string // path to the docker daemon socket
+	ProcRoot string // where the host procfs is mounted, used to compare PID namespaces
+
+	httpClient *http.Client
+
+	mu         sync.Mutex
+	namespaces map[string]Info // the containers by PID namespace, only refreshed when a namespace isn't found
+}
+
+// DockerContainer is a container returned from listing containers
+type DockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// DockerInspect holds the fields phunter uses from inspecting a container
+type DockerInspect struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Pid int `json:"Pid"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+func (i DockerInspect) info() Info {
+	return Info{
+		ID:      i.ID,
+		Name:    strings.TrimPrefix(i.Name, "/"),
+		Image:   i.Config.Image,
+		Labels:  i.Config.Labels,
+		Runtime: RuntimeDocker,
+	}
+}
+
+// NewDockerClient returns a client for the docker daemon listening on socket
+func NewDockerClient(socket string, procRoot string) *DockerClient {
+	if socket == "" {
+		socket = DefaultDockerSocket
+	}
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	return &DockerClient{
+		Socket:   socket,
+		ProcRoot: procRoot,
+		httpClient: &http.Client{
+			Timeout: dockerRequestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Resolve finds the container of the process from the container ID in its cgroup with a single inspect
+// containers with their own cgroup namespace don't show their ID, so these are found by sharing a PID namespace
+// with the process instead
+func (d *DockerClient) Resolve(pid int) (Info, error) {
+	if cgroup, err := NewCgroupResolver(d.ProcRoot).Resolve(pid); err == nil {
+		inspect, err := d.InspectContainer(cgroup.ID)
+		if err == nil {
+			return inspect.info(), nil
+		}
+		logrus.WithField("pid", pid).Debugf("failed to inspect container %s from cgroup: %v", cgroup.ID, err)
+	}
+
+	pidNS, err := pidNamespace(d.ProcRoot, pid)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to read pid namespace for %d: %v", pid, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info, ok := d.namespaces[pidNS]; ok {
+		return info, nil
+	}
+	if err := d.refreshNamespaces(); err != nil {
+		return Info{}, err
+	}
+	if info, ok := d.namespaces[pidNS]; ok {
+		return info, nil
+	}
+	return Info{}, ErrNotFound{PID: pid}
+}
+
+// refreshNamespaces inspects every running container to find its PID namespace, d.mu must be held
+func (d *DockerClient) refreshNamespaces() error {
+	containers, err := d.ListContainers()
+	if err != nil {
+		return err
+	}
+	namespaces := make(map[string]Info)
+	for _, c := range containers {
+		inspect, err := d.InspectContainer(c.ID)
+		if err != nil {
+			logrus.Debugf("failed to inspect container %s: %v", c.ID, err)
+			continue
+		}
+		if inspect.State.Pid <= 0 {
+			continue
+		}
+		containerNS, err := pidNamespace(d.ProcRoot, inspect.State.Pid)
+		if err != nil {
+			logrus.Debugf("failed to read pid namespace for container %s: %v", c.ID, err)
+			continue
+		}
+		namespaces[containerNS] = inspect.info()
+	}
+	d.namespaces = namespaces
+	return nil
+}
+
+// CloseIdleConnections closes the connections to the docker daemon that aren't in use
+func (d *DockerClient) CloseIdleConnections() {
+	d.httpClient.CloseIdleConnections()
+}
+
+// ListContainers returns the running containers, the same as docker ps
+func (d *DockerClient) ListContainers() ([]DockerContainer, error) {
+	var containers []DockerContainer
+	err := d.get("/containers/json", &containers)
+	return containers, err
+}
+
+// InspectContainer returns the low level details of a container, the same as docker inspect
+func (d *DockerClient) InspectContainer(id string) (DockerInspect, error) {
+	var inspect DockerInspect
+	err := d.get("/containers/"+url.PathEscape(id)+"/json", &inspect)
+	return inspect, err
+}
+
+func (d *DockerClient) get(path string, v interface{}) error {
+	// the host is ignored as requests are always sent over the socket
+	resp, err := d.httpClient.Get("http://docker" + path)
+	if err != nil {
+		return fmt.Errorf("docker api request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("docker api request to %s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,205 @@
+package container
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestProcRoot creates a procfs stand-in where each pid has the given pid namespace
+func newTestProcRoot(t *testing.T, namespaces map[int]string) string {
+	root, err := ioutil.TempDir("", "phunter-container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for pid, ns := range namespaces {
+		nsDir := filepath.Join(root, strconv.Itoa(pid), "ns")
+		if err := os.MkdirAll(nsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(ns, filepath.Join(nsDir, "pid")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// newTestDockerSocket serves handler on a unix socket in place of the docker daemon
+func newTestDockerSocket(t *testing.T, handler http.Handler) string {
+	dir, err := ioutil.TempDir("", "phunter-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+	return socket
+}
+
+// testCgroupContainerID is the ID of a container the test docker handler can inspect, but doesn't list
+const testCgroupContainerID = "3f2b1c9a8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a"
+
+// dockerRequests counts the list and inspect requests served by a test docker handler
+type dockerRequests struct {
+	mu       sync.Mutex
+	lists    int
+	inspects int
+}
+
+func (r *dockerRequests) counts() (lists, inspects int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lists, r.inspects
+}
+
+func (r *dockerRequests) count(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		if req.URL.Path == "/containers/json" {
+			r.lists++
+		} else if strings.HasPrefix(req.URL.Path, "/containers/") {
+			r.inspects++
+		}
+		r.mu.Unlock()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func testDockerHandler(t *testing.T) http.Handler {
+	inspect := map[string]DockerInspect{}
+	for id, pid := range map[string]int{"aaa111": 100, "bbb222": 200, testCgroupContainerID: 300} {
+		var i DockerInspect
+		i.ID = id
+		i.Name = "/" + id + "-name"
+		i.State.Pid = pid
+		i.Config.Image = "php:7.4-fpm"
+		i.Config.Labels = map[string]string{"app": id}
+		inspect[id] = i
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]DockerContainer{{ID: "aaa111"}, {ID: "bbb222"}})
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id := filepath.Base(filepath.Dir(r.URL.Path))
+		i, ok := inspect[id]
+		if !ok {
+			http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(i)
+	})
+	return mux
+}
+
+func TestDockerClientResolve(t *testing.T) {
+	procRoot := newTestProcRoot(t, map[int]string{
+		100:  "pid:[4026532001]",
+		200:  "pid:[4026532002]",
+		2001: "pid:[4026532002]",
+	})
+	client := NewDockerClient(newTestDockerSocket(t, testDockerHandler(t)), procRoot)
+
+	info, err := client.Resolve(2001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "bbb222" || info.Name != "bbb222-name" || info.Image != "php:7.4-fpm" || info.Labels["app"] != "bbb222" {
+		t.Errorf("unexpected container info: %+v", info)
+	}
+}
+
+func TestDockerClientResolveFromCgroup(t *testing.T) {
+	procRoot := newTestProcRoot(t, map[int]string{2001: "pid:[4026532003]"})
+	cgroup := "0::/system.slice/docker-" + testCgroupContainerID + ".scope\n"
+	if err := ioutil.WriteFile(filepath.Join(procRoot, "2001", "cgroup"), []byte(cgroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+	requests := &dockerRequests{}
+	client := NewDockerClient(newTestDockerSocket(t, requests.count(testDockerHandler(t))), procRoot)
+
+	info, err := client.Resolve(2001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != testCgroupContainerID || info.Runtime != RuntimeDocker {
+		t.Errorf("unexpected container info: %+v", info)
+	}
+	if lists, inspects := requests.counts(); lists != 0 || inspects != 1 {
+		t.Errorf("expected only the container in the cgroup to be inspected, instead got %d lists and %d inspects", lists, inspects)
+	}
+}
+
+func TestDockerClientResolveCachesNamespaces(t *testing.T) {
+	procRoot := newTestProcRoot(t, map[int]string{
+		100:  "pid:[4026532001]",
+		200:  "pid:[4026532002]",
+		1001: "pid:[4026532001]",
+		2001: "pid:[4026532002]",
+		3001: "pid:[4026531836]",
+	})
+	requests := &dockerRequests{}
+	client := NewDockerClient(newTestDockerSocket(t, requests.count(testDockerHandler(t))), procRoot)
+
+	for _, pid := range []int{2001, 1001, 2001} {
+		if _, err := client.Resolve(pid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lists, inspects := requests.counts(); lists != 1 || inspects != 2 {
+		t.Errorf("expected the containers to be inspected once, instead got %d lists and %d inspects", lists, inspects)
+	}
+
+	// a namespace that isn't cached refreshes the containers in case it's a new container
+	if _, err := client.Resolve(3001); err == nil {
+		t.Error("expected a process outside of any container not to be found")
+	}
+	if lists, inspects := requests.counts(); lists != 2 || inspects != 4 {
+		t.Errorf("expected the containers to be inspected again on a miss, instead got %d lists and %d inspects", lists, inspects)
+	}
+}
+
+func TestDockerClientResolveNotFound(t *testing.T) {
+	procRoot := newTestProcRoot(t, map[int]string{
+		100:  "pid:[4026532001]",
+		200:  "pid:[4026532002]",
+		3001: "pid:[4026531836]",
+	})
+	client := NewDockerClient(newTestDockerSocket(t, testDockerHandler(t)), procRoot)
+
+	_, err := client.Resolve(3001)
+	if _, ok := err.(ErrNotFound); !ok {
+		t.Errorf("expected ErrNotFound, instead got: %v", err)
+	}
+}
+
+func TestDockerClientAPIError(t *testing.T) {
+	procRoot := newTestProcRoot(t, map[int]string{100: "pid:[4026532001]"})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "daemon unavailable", http.StatusInternalServerError)
+	})
+	client := NewDockerClient(newTestDockerSocket(t, handler), procRoot)
+
+	if _, err := client.Resolve(100); err == nil {
+		t.Error("expected an error when the docker api fails")
+	}
+}
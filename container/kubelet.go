@@ -0,0 +1,198 @@
+package container
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultKubeletURL is the kubelet API when phunter shares the node's network namespace
+	DefaultKubeletURL = "https://127.0.0.1:10250"
+
+	// DefaultServiceAccountTokenFile is where kubernetes mounts the pod's service account token
+	DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	kubeletRequestTimeout = 10 * time.Second
+)
+
+// Pod describes the kubernetes pod a container belongs to
+type Pod struct {
+	UID        string `json:"uid"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+	Container  string `json:"container,omitempty"`  // name of the container in the pod spec
+	Deployment string `json:"deployment,omitempty"` // only set when the pod is owned by a deployment's replica set
+	Node       string `json:"node,omitempty"`
+}
+
+// KubeletResolver adds the kubernetes pod metadata to the containers found by another resolver
+// using the pods endpoint of the kubelet running on the node
+type KubeletResolver struct {
+	Resolver  Resolver // finds the container ID of a process which is then matched against the pods on the node
+	URL       string   // base URL of the kubelet e.g. https://10.0.0.1:10250 or http://127.0.0.1:10255
+	TokenFile string   // bearer token sent to the kubelet, usually the service account token
+	NodeName  string   // used when the pod spec doesn't include the node name
+
+	httpClient *http.Client
+}
+
+type kubeletPodList struct {
+	Items []kubeletPod `json:"items"`
+}
+
+type kubeletPod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		Labels          map[string]string `json:"labels"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses     []kubeletContainerStatus `json:"containerStatuses"`
+		InitContainerStatuses []kubeletContainerStatus `json:"initContainerStatuses"`
+	} `json:"status"`
+}
+
+type kubeletContainerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"` // <runtime>://<id>
+}
+
+// NewKubeletResolver wraps resolver so that containers also include the pod they belong to
+func NewKubeletResolver(resolver Resolver, url string, tokenFile string, insecureSkipVerify bool,
+	nodeName string) *KubeletResolver {
+	return &KubeletResolver{
+		Resolver:  resolver,
+		URL:       strings.TrimRight(url, "/"),
+		TokenFile: tokenFile,
+		NodeName:  nodeName,
+		httpClient: &http.Client{
+			Timeout: kubeletRequestTimeout,
+			Transport: &http.Transport{
+				// the kubelet serving certificate is commonly self-signed
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+	}
+}
+
+// Resolve finds the container of the process and the pod it belongs to
+// failing to look up the pod isn't treated as an error as the container is still useful on its own
+func (k *KubeletResolver) Resolve(pid int) (Info, error) {
+	info, err := k.Resolver.Resolve(pid)
+	if err != nil {
+		return Info{}, err
+	}
+
+	pods, err := k.pods()
+	if err != nil {
+		logrus.WithField("pid", pid).Errorf("failed to get pods from kubelet: %v", err)
+		return info, nil
+	}
+	if pod := matchPod(pods, info); pod != nil {
+		if pod.Node == "" {
+			pod.Node = k.NodeName
+		}
+		info.Pod = pod
+	} else {
+		logrus.WithField("pid", pid).Debugf("no pod found for container %s", info.ID)
+	}
+	return info, nil
+}
+
+// CloseIdleConnections closes the connections to the kubelet, and those of the wrapped resolver, that aren't in use
+func (k *KubeletResolver) CloseIdleConnections() {
+	k.httpClient.CloseIdleConnections()
+	CloseIdleConnections(k.Resolver)
+}
+
+// pods returns the pods running on the node
+func (k *KubeletResolver) pods() ([]kubeletPod, error) {
+	req, err := http.NewRequest(http.MethodGet, k.URL+"/pods", nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.TokenFile != "" {
+		token, err := ioutil.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubelet token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("kubelet returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var podList kubeletPodList
+	if err := json.NewDecoder(resp.Body).Decode(&podList); err != nil {
+		return nil, fmt.Errorf("failed to decode pods from kubelet: %v", err)
+	}
+	return podList.Items, nil
+}
+
+// matchPod finds the pod running the container, matching on the container ID first and
+// the pod UID from cgroups second
+func matchPod(pods []kubeletPod, info Info) *Pod {
+	for _, pod := range pods {
+		statuses := append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...)
+		for _, status := range statuses {
+			if status.ContainerID == "" {
+				continue
+			}
+			// the ID is prefixed by the runtime, e.g. containerd://
+			parts := strings.SplitN(status.ContainerID, "://", 2)
+			id := parts[len(parts)-1]
+			if id == info.ID {
+				p := newPod(pod)
+				p.Container = status.Name
+				return p
+			}
+		}
+	}
+	if info.PodUID == "" {
+		return nil
+	}
+	for _, pod := range pods {
+		if pod.Metadata.UID == info.PodUID {
+			return newPod(pod)
+		}
+	}
+	return nil
+}
+
+func newPod(pod kubeletPod) *Pod {
+	p := &Pod{
+		UID:       pod.Metadata.UID,
+		Name:      pod.Metadata.Name,
+		Namespace: pod.Metadata.Namespace,
+		Node:      pod.Spec.NodeName,
+	}
+	// deployments own pods through a replica set named <deployment>-<pod-template-hash>
+	for _, owner := range pod.Metadata.OwnerReferences {
+		hash := pod.Metadata.Labels["pod-template-hash"]
+		if owner.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			p.Deployment = strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+	return p
+}
@@ -0,0 +1,160 @@
+package container
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type staticResolver Info
+
+func (s staticResolver) Resolve(pid int) (Info, error) {
+	return Info(s), nil
+}
+
+func newTestKubelet(t *testing.T, token string) *httptest.Server {
+	server := newUnstartedTestKubelet(t, token)
+	server.Start()
+	return server
+}
+
+func newUnstartedTestKubelet(t *testing.T, token string) *httptest.Server {
+	pods, err := ioutil.ReadFile("testdata/kubelet-pods.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(pods)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeTestToken(t *testing.T, token string) string {
+	dir, err := ioutil.TempDir("", "phunter-kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tokenFile
+}
+
+func TestKubeletResolverByContainerID(t *testing.T) {
+	kubelet := newTestKubelet(t, "secret")
+	base := staticResolver{ID: testContainerID, Name: ShortID(testContainerID)}
+	resolver := NewKubeletResolver(base, kubelet.URL, writeTestToken(t, "secret"), false, "")
+
+	info, err := resolver.Resolve(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Pod{
+		UID:        testPodUID,
+		Name:       "web-5d8f7c9b6-x2k4p",
+		Namespace:  "shop",
+		Container:  "php-fpm",
+		Deployment: "web",
+		Node:       "node-a",
+	}
+	if info.Pod == nil || *info.Pod != expected {
+		t.Fatalf("expected pod %+v, instead got: %+v", expected, info.Pod)
+	}
+	if info.DisplayName() != "shop_web-5d8f7c9b6-x2k4p_php-fpm" {
+		t.Errorf("unexpected display name: %s", info.DisplayName())
+	}
+}
+
+func TestKubeletResolverByPodUID(t *testing.T) {
+	kubelet := newTestKubelet(t, "")
+	base := staticResolver{ID: "cccccccccccc", PodUID: "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f"}
+	resolver := NewKubeletResolver(base, kubelet.URL, "", false, "node-b")
+
+	info, err := resolver.Resolve(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pod == nil || info.Pod.Name != "worker-0" || info.Pod.Deployment != "" || info.Pod.Node != "node-a" {
+		t.Errorf("unexpected pod: %+v", info.Pod)
+	}
+}
+
+func TestKubeletResolverUnavailable(t *testing.T) {
+	kubelet := newTestKubelet(t, "secret")
+	base := staticResolver{ID: testContainerID, Name: ShortID(testContainerID)}
+	resolver := NewKubeletResolver(base, kubelet.URL, writeTestToken(t, "wrong"), false, "")
+
+	info, err := resolver.Resolve(1)
+	if err != nil {
+		t.Fatalf("expected the container without pod metadata, instead got error: %v", err)
+	}
+	if info.Pod != nil || info.ID != testContainerID {
+		t.Errorf("unexpected container info: %+v", info)
+	}
+}
+
+// closingResolver records whether its idle connections were closed
+type closingResolver struct {
+	staticResolver
+	closed bool
+}
+
+func (c *closingResolver) CloseIdleConnections() {
+	c.closed = true
+}
+
+func TestKubeletResolverCloseIdleConnections(t *testing.T) {
+	kubelet := newUnstartedTestKubelet(t, "")
+	closed := make(chan struct{}, 1)
+	kubelet.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	kubelet.Start()
+	base := &closingResolver{staticResolver: staticResolver{ID: testContainerID}}
+	resolver := NewKubeletResolver(base, kubelet.URL, "", false, "")
+	if _, err := resolver.Resolve(1); err != nil {
+		t.Fatal(err)
+	}
+
+	CloseIdleConnections(resolver)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle connection to the kubelet to be closed")
+	}
+	if !base.closed {
+		t.Error("expected the idle connections of the wrapped resolver to be closed")
+	}
+}
+
+func TestMatchPodContainerID(t *testing.T) {
+	var pod kubeletPod
+	pod.Metadata.Name = "web"
+	pod.Status.ContainerStatuses = []kubeletContainerStatus{
+		{Name: "nginx", ContainerID: "containerd://" + testContainerID[2:] + "ab"},
+		{Name: "php-fpm", ContainerID: testContainerID},
+	}
+	// an ID without the runtime prefix is compared whole
+	p := matchPod([]kubeletPod{pod}, Info{ID: testContainerID})
+	if p == nil || p.Container != "php-fpm" {
+		t.Errorf("expected the php-fpm container to match, instead got %+v", p)
+	}
+}
@@ -0,0 +1,220 @@
+package cooldown
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/system"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the reasons a trace is refused, recorded by phunter_traces_refused_total
+const (
+	ReasonPID       = "pid_cooldown"
+	ReasonContainer = "container_cooldown"
+	ReasonTarget    = "target_cooldown"
+	ReasonHourly    = "hourly_limit"
+)
+
+// Policy limits how often traces are started, a limit of 0 is not enforced
+// cooldowns start when a trace finishes so a process isn't traced again straight after
+type Policy struct {
+	PID              time.Duration // before the same process can be traced again
+	Container        time.Duration // before any process in the same container can be traced again
+	Target           time.Duration // before any process of the same target can be traced again
+	MaxTracesPerHour int           // traces started in the last hour across every target
+}
+
+// Key identifies what a trace counts against, the container is empty when it isn't known
+type Key struct {
+	Target    string
+	PID       int
+	StartTime uint64 // start time of the process in clock ticks, so a reused PID doesn't inherit the cooldown
+	Container string
+}
+
+// process identifies a process across PID reuse
+type process struct {
+	pid       int
+	startTime uint64
+}
+
+// RefusedError is returned by Acquire when a trace would break the policy
+type RefusedError struct {
+	Reason string
+	Until  time.Time // when the trace will be allowed
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("trace refused by %s until %s", e.Reason, e.Until.Format(time.RFC3339))
+}
+
+// Limiter enforces a policy on the traces started on the node
+type Limiter struct {
+	clock system.Clock
+
+	mu         sync.Mutex
+	pids       map[process]time.Time // when each cooldown ends
+	containers map[string]time.Time
+	targets    map[string]time.Time
+	started    []time.Time // traces started in the last hour, oldest first
+	running    int
+}
+
+// NewLimiter returns a limiter without any traces, timing the cooldowns with clock
+func NewLimiter(clock system.Clock) *Limiter {
+	return &Limiter{
+		clock:      clock,
+		pids:       make(map[process]time.Time),
+		containers: make(map[string]time.Time),
+		targets:    make(map[string]time.Time),
+	}
+}
+
+// Acquire checks a trace is allowed by the policy and counts it as running until release is called
+// release(true) starts the cooldowns of the trace, the policy passed is used so a reload takes effect on the next
+// trace, and release(false) is for a trace that didn't produce anything so it isn't counted at all
+func (l *Limiter) Acquire(policy Policy, key Key) (release func(traced bool), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check(policy, key); err != nil {
+		return nil, err
+	}
+	started := l.clock.Now()
+	l.started = append(l.started, started)
+	l.running++
+	var once sync.Once
+	return func(traced bool) { once.Do(func() { l.release(policy, key, started, traced) }) }, nil
+}
+
+// Check returns the error Acquire would without counting a trace, e.g. before queueing a trace
+func (l *Limiter) Check(policy Policy, key Key) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.check(policy, key)
+}
+
+func (l *Limiter) check(policy Policy, key Key) error {
+	l.prune(l.clock.Now())
+	if until, ok := l.pids[process{key.PID, key.StartTime}]; ok {
+		return &RefusedError{Reason: ReasonPID, Until: until}
+	}
+	if until, ok := l.containers[key.Container]; ok && key.Container != "" {
+		return &RefusedError{Reason: ReasonContainer, Until: until}
+	}
+	if until, ok := l.targets[key.Target]; ok {
+		return &RefusedError{Reason: ReasonTarget, Until: until}
+	}
+	if policy.MaxTracesPerHour > 0 && len(l.started) >= policy.MaxTracesPerHour {
+		return &RefusedError{Reason: ReasonHourly, Until: l.started[len(l.started)-policy.MaxTracesPerHour].Add(time.Hour)}
+	}
+	return nil
+}
+
+func (l *Limiter) release(policy Policy, key Key, started time.Time, traced bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.running--
+	if !traced {
+		// forget the trace in the hourly limit, unless it has already been pruned
+		for i := len(l.started) - 1; i >= 0; i-- {
+			if l.started[i].Equal(started) {
+				l.started = append(l.started[:i], l.started[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	if policy.PID > 0 {
+		l.pids[process{key.PID, key.StartTime}] = now.Add(policy.PID)
+	}
+	if policy.Container > 0 && key.Container != "" {
+		l.containers[key.Container] = now.Add(policy.Container)
+	}
+	if policy.Target > 0 {
+		l.targets[key.Target] = now.Add(policy.Target)
+	}
+}
+
+// prune forgets the cooldowns that have ended and the traces started over an hour ago
+func (l *Limiter) prune(now time.Time) {
+	for p, until := range l.pids {
+		if !now.Before(until) {
+			delete(l.pids, p)
+		}
+	}
+	for _, cooldowns := range []map[string]time.Time{l.containers, l.targets} {
+		for key, until := range cooldowns {
+			if !now.Before(until) {
+				delete(cooldowns, key)
+			}
+		}
+	}
+	hourAgo := now.Add(-time.Hour)
+	i := 0
+	for i < len(l.started) && !l.started[i].After(hourAgo) {
+		i++
+	}
+	l.started = l.started[i:]
+}
+
+// State is the cooldowns in effect and the traces counted against the limits
+type State struct {
+	Running        int        `json:"running"`
+	TracesLastHour int        `json:"traces_last_hour"`
+	PIDs           []Cooldown `json:"pids"`
+	Containers     []Cooldown `json:"containers"`
+	Targets        []Cooldown `json:"targets"`
+}
+
+// Cooldown is a PID, container or target that can't be traced until the cooldown ends
+type Cooldown struct {
+	Name             string    `json:"name"` // the PID, container ID or target name
+	Until            time.Time `json:"until"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+}
+
+// State returns the cooldowns in effect, soonest to end first
+func (l *Limiter) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.prune(now)
+
+	state := State{
+		Running:        l.running,
+		TracesLastHour: len(l.started),
+		PIDs:           []Cooldown{},
+		Containers:     cooldowns(l.containers, now),
+		Targets:        cooldowns(l.targets, now),
+	}
+	for p, until := range l.pids {
+		state.PIDs = append(state.PIDs, newCooldown(strconv.Itoa(p.pid), until, now))
+	}
+	sortCooldowns(state.PIDs)
+	return state
+}
+
+func cooldowns(until map[string]time.Time, now time.Time) []Cooldown {
+	list := make([]Cooldown, 0, len(until))
+	for name, until := range until {
+		list = append(list, newCooldown(name, until, now))
+	}
+	sortCooldowns(list)
+	return list
+}
+
+func newCooldown(name string, until, now time.Time) Cooldown {
+	return Cooldown{Name: name, Until: until, RemainingSeconds: until.Sub(now).Seconds()}
+}
+
+func sortCooldowns(list []Cooldown) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Until.Equal(list[j].Until) {
+			return list[i].Until.Before(list[j].Until)
+		}
+		return list[i].Name < list[j].Name
+	})
+}
@@ -0,0 +1,131 @@
+package cooldown
+
+import (
+	"errors"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"testing"
+	"time"
+)
+
+func newTestLimiter() (*Limiter, *systemtest.Clock) {
+	clock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	return NewLimiter(clock), clock
+}
+
+func expectRefused(t *testing.T, err error, reason string) {
+	t.Helper()
+	var refused *RefusedError
+	if !errors.As(err, &refused) || refused.Reason != reason {
+		t.Fatalf("expected the trace to be refused by %s, instead got %v", reason, err)
+	}
+}
+
+func TestPIDCooldown(t *testing.T) {
+	l, clock := newTestLimiter()
+	policy := Policy{PID: 10 * time.Minute}
+	key := Key{Target: "php", PID: 42}
+
+	release, err := l.Acquire(policy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cooldown starts once the trace finishes
+	clock.Advance(time.Minute)
+	release(true)
+	release(true)
+	if state := l.State(); state.Running != 0 {
+		t.Errorf("expected releasing twice to count the trace once, instead %d are running", state.Running)
+	}
+
+	clock.Advance(9 * time.Minute)
+	_, err = l.Acquire(policy, key)
+	expectRefused(t, err, ReasonPID)
+	if _, err := l.Acquire(policy, Key{Target: "php", PID: 43}); err != nil {
+		t.Errorf("expected another process to be traced, instead got %v", err)
+	}
+
+	// the PID has been reused by another process
+	if _, err := l.Acquire(policy, Key{Target: "php", PID: 42, StartTime: 1000}); err != nil {
+		t.Errorf("expected a new process with the same PID to be traced, instead got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := l.Acquire(policy, key); err != nil {
+		t.Errorf("expected the process to be traced once the cooldown ended, instead got %v", err)
+	}
+}
+
+func TestReleaseWithoutTrace(t *testing.T) {
+	l, _ := newTestLimiter()
+	policy := Policy{PID: 10 * time.Minute, Target: time.Minute, MaxTracesPerHour: 1}
+	key := Key{Target: "php", PID: 42}
+
+	release, err := l.Acquire(policy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(false)
+	if state := l.State(); state.Running != 0 || state.TracesLastHour != 0 || len(state.PIDs) != 0 || len(state.Targets) != 0 {
+		t.Errorf("expected a trace that didn't run not to be counted, instead got %+v", state)
+	}
+	if _, err := l.Acquire(policy, key); err != nil {
+		t.Errorf("expected the process to be traced again straight away, instead got %v", err)
+	}
+}
+
+func TestContainerAndTargetCooldowns(t *testing.T) {
+	l, clock := newTestLimiter()
+	policy := Policy{Container: 5 * time.Minute, Target: time.Minute}
+
+	release, err := l.Acquire(policy, Key{Target: "php", PID: 42, Container: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(true)
+
+	_, err = l.Acquire(policy, Key{Target: "python", PID: 43, Container: "abc"})
+	expectRefused(t, err, ReasonContainer)
+	_, err = l.Acquire(policy, Key{Target: "php", PID: 44, Container: "def"})
+	expectRefused(t, err, ReasonTarget)
+	// processes without a known container aren't held back by container cooldowns
+	if _, err := l.Acquire(policy, Key{Target: "python", PID: 45}); err != nil {
+		t.Errorf("expected a process without a container to be traced, instead got %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	state := l.State()
+	if len(state.Containers) != 1 || state.Containers[0].Name != "abc" || state.Containers[0].RemainingSeconds != 180 {
+		t.Errorf("unexpected container cooldowns %+v", state.Containers)
+	}
+	if len(state.Targets) != 0 || len(state.PIDs) != 0 {
+		t.Errorf("expected the target cooldown to have ended and no pid cooldowns, instead got %+v", state)
+	}
+}
+
+func TestHourlyLimit(t *testing.T) {
+	l, clock := newTestLimiter()
+	policy := Policy{MaxTracesPerHour: 2}
+	start := clock.Now()
+
+	for pid := 1; pid <= 2; pid++ {
+		release, err := l.Acquire(policy, Key{Target: "php", PID: pid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		release(true)
+		clock.Advance(10 * time.Minute)
+	}
+	_, err := l.Acquire(policy, Key{Target: "php", PID: 3})
+	expectRefused(t, err, ReasonHourly)
+	if refused := err.(*RefusedError); !refused.Until.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the trace to be allowed an hour after the first, instead got %s", refused.Until)
+	}
+
+	clock.Advance(40 * time.Minute)
+	if _, err := l.Acquire(policy, Key{Target: "php", PID: 3}); err != nil {
+		t.Errorf("expected a trace to be allowed an hour after the first, instead got %v", err)
+	}
+	if state := l.State(); state.TracesLastHour != 2 {
+		t.Errorf("expected 2 traces in the last hour, instead got %d", state.TracesLastHour)
+	}
+}
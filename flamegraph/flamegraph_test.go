@@ -0,0 +1,137 @@
+package flamegraph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) string {
+	contents, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestParsePHPSpy(t *testing.T) {
+	expected := readFixture(t, "phpspy.folded")
+	for _, fixture := range []string{"phpspy.trace", "phpspy-single-line.trace"} {
+		t.Run(fixture, func(t *testing.T) {
+			file, err := os.Open("../phpspy/testdata/" + fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			stacks, err := Parse("phpspy", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var folded bytes.Buffer
+			if err := stacks.WriteFolded(&folded); err != nil {
+				t.Fatal(err)
+			}
+			if folded.String() != expected {
+				t.Errorf("expected:\n%s\ninstead got:\n%s", expected, folded.String())
+			}
+			if stacks.Total() != 5 {
+				t.Errorf("expected 5 samples, instead got %d", stacks.Total())
+			}
+		})
+	}
+}
+
+func TestParsePHPSpyWithoutStacks(t *testing.T) {
+	_, err := ParsePHPSpy(strings.NewReader("Failed to find executor_globals\n# mem 0 0\n\n"))
+	if !errors.Is(err, ErrNoSamples) {
+		t.Errorf("expected ErrNoSamples, instead got %v", err)
+	}
+}
+
+func TestParseFolded(t *testing.T) {
+	stacks, err := Parse("collapsed", strings.NewReader(readFixture(t, "phpspy.folded")+"\nmain;work 2\nmain;work 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stacks["main;work"] != 3 || stacks.Total() != 8 {
+		t.Errorf("expected duplicate stacks to be summed, instead got %v", stacks)
+	}
+	if _, err := ParseFolded(strings.NewReader("main;work two\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected the invalid line to be reported, instead got %v", err)
+	}
+	if _, err := Parse("backtrace", strings.NewReader("")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, instead got %v", err)
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	stacks, err := ParseFolded(strings.NewReader(readFixture(t, "phpspy.folded")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var svg bytes.Buffer
+	if err := stacks.WriteSVG(&svg, `php-fpm <4242> & "friends"`); err != nil {
+		t.Fatal(err)
+	}
+
+	// every frame is drawn and the document is well formed despite the <main> and \ in frame names
+	frames := map[string]string{}
+	decoder := xml.NewDecoder(&svg)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected well formed XML: %v", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "g" {
+			var name, width string
+			for _, a := range start.Attr {
+				switch a.Name.Local {
+				case "data-name":
+					name = a.Value
+				case "data-w":
+					width = a.Value
+				}
+			}
+			frames[name] = width
+		}
+	}
+	expected := map[string]string{
+		"all":    "1180.00",
+		"<main>": "1180.00",
+		"App\\Http\\Middleware\\Authenticate::handle":     "236.00",
+		"Illuminate\\Routing\\Controller::callAction":     "944.00",
+		"App\\Http\\Controllers\\ReportController::index": "944.00",
+		"App\\Repositories\\ReportRepository::all":        "236.00",
+		"PDOStatement::execute":                           "236.00",
+		"usleep":                                          "708.00",
+	}
+	if len(frames) != len(expected) {
+		t.Errorf("expected %d frames, instead got %v", len(expected), frames)
+	}
+	for name, width := range expected {
+		if frames[name] != width {
+			t.Errorf("expected %s to be %s wide, instead got %q", name, width, frames[name])
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	if actual := label("usleep", 1000); actual != "usleep" {
+		t.Errorf("expected the full name in a wide frame, instead got %q", actual)
+	}
+	if actual := label("App\\Http\\Controllers\\ReportController::index", 50); actual != "App\\.." {
+		t.Errorf("expected the name to be truncated, instead got %q", actual)
+	}
+	if actual := label("usleep", 20); actual != "" {
+		t.Errorf("expected no label in a narrow frame, instead got %q", actual)
+	}
+}
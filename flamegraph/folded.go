@@ -0,0 +1,123 @@
+package flamegraph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/phpspy"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedFormat is returned when asked to parse a trace format that flame graphs can't be made from
+var ErrUnsupportedFormat = errors.New("unsupported trace format")
+
+// ErrNoSamples is returned when a trace doesn't contain any stacks, e.g. when the tracer failed to attach
+var ErrNoSamples = errors.New("trace doesn't contain any stacks")
+
+// Stacks counts the samples of each stack, keyed by its frames from the root down joined with ;
+// which is the collapsed stack format used by flamegraph.pl
+type Stacks map[string]int
+
+// Parse reads a trace in the format recorded in its metadata, see trace.Output
+func Parse(format string, r io.Reader) (Stacks, error) {
+	switch format {
+	case "phpspy":
+		return ParsePHPSpy(r)
+	case "collapsed":
+		return ParseFolded(r)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+}
+
+// Add counts samples of a stack given its frames from the root down
+func (s Stacks) Add(frames []string, count int) {
+	if len(frames) == 0 || count <= 0 {
+		return
+	}
+	s[strings.Join(frames, ";")] += count
+}
+
+// Total returns the number of samples
+func (s Stacks) Total() int {
+	total := 0
+	for _, count := range s {
+		total += count
+	}
+	return total
+}
+
+// WriteFolded writes one stack per line followed by its sample count, sorted by stack
+func (s Stacks) WriteFolded(w io.Writer) error {
+	stacks := make([]string, 0, len(s))
+	for stack := range s {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(bw, "%s %d\n", stack, s[stack]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ParseFolded reads stacks in the collapsed stack format written by py-spy, rbspy and stackcollapse scripts
+func ParseFolded(r io.Reader) (Stacks, error) {
+	stacks := make(Stacks)
+	scanner := newScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected a stack followed by a sample count", lineNumber)
+		}
+		count, err := strconv.Atoi(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid sample count %q", lineNumber, line[i+1:])
+		}
+		stacks.Add(strings.Split(strings.TrimSpace(line[:i]), ";"), count)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stacks) == 0 {
+		return nil, ErrNoSamples
+	}
+	return stacks, nil
+}
+
+// foldedFrame matches py-spy's "function (file:line)" frames
+var foldedFrame = regexp.MustCompile(`^(.*) \(([^()]+?)(?::(\d+))?\)$`)
+
+// StackFrames splits a collapsed stack into its frames, innermost first like phpspy.Trace
+// the file and line are parsed from py-spy's "function (file:line)" frames
+func StackFrames(stack string) []phpspy.Frame {
+	names := strings.Split(stack, ";")
+	frames := make([]phpspy.Frame, len(names))
+	for i, name := range names {
+		frame := phpspy.Frame{Function: name, Line: -1}
+		if match := foldedFrame.FindStringSubmatch(name); match != nil {
+			frame.Function, frame.File = match[1], match[2]
+			if line, err := strconv.Atoi(match[3]); err == nil {
+				frame.Line = line
+			}
+		}
+		frames[len(names)-1-i] = frame
+	}
+	return frames
+}
+
+// newScanner returns a line scanner that allows the long lines of deep stacks
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return scanner
+}
@@ -0,0 +1,27 @@
+package flamegraph
+
+import (
+	"github.com/daniel-cole/phunter/phpspy"
+	"io"
+)
+
+// ParsePHPSpy folds the stacks written by phpspy by function name, see phpspy.Scanner for the format
+func ParsePHPSpy(r io.Reader) (Stacks, error) {
+	stacks := make(Stacks)
+	scanner := phpspy.NewScanner(r)
+	for scanner.Scan() {
+		trace := scanner.Trace()
+		frames := make([]string, len(trace.Frames))
+		for i, frame := range trace.Frames {
+			frames[len(frames)-1-i] = frame.Function
+		}
+		stacks.Add(frames, 1)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stacks) == 0 {
+		return nil, ErrNoSamples
+	}
+	return stacks, nil
+}
@@ -0,0 +1,210 @@
+package flamegraph
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// layout of the flame graph in pixels, the same as flamegraph.pl's defaults
+const (
+	imageWidth  = 1200
+	framePad    = 10   // left and right padding
+	frameHeight = 16   // height of each frame including the 1px gap above it
+	fontSize    = 12   // font size of the frame labels
+	fontWidth   = 0.59 // average character width as a proportion of the font size
+	minWidth    = 0.1  // frames narrower than this aren't drawn
+	titleHeight = 36   // space above the frames for the title and reset zoom button
+	infoHeight  = 24   // space below the frames for the details of the frame under the pointer
+)
+
+// node is a frame in the call tree built from the stacks
+type node struct {
+	name     string
+	value    int
+	children map[string]*node
+}
+
+func (n *node) child(name string) *node {
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &node{name: name}
+		n.children[name] = c
+	}
+	return c
+}
+
+// frame is a node positioned in the flame graph
+type frame struct {
+	name  string
+	value int
+	depth int
+	x, w  float64
+}
+
+// WriteSVG renders the stacks as an interactive SVG flame graph with the root at the bottom
+// clicking a frame zooms in on it, and hovering over a frame shows its sample count
+func (s Stacks) WriteSVG(w io.Writer, title string) error {
+	root := &node{name: "all"}
+	for stack, count := range s {
+		n := root
+		n.value += count
+		for _, name := range strings.Split(stack, ";") {
+			n = n.child(name)
+			n.value += count
+		}
+	}
+	if root.value == 0 {
+		return ErrNoSamples
+	}
+
+	var frames []frame
+	maxDepth := 0
+	scale := float64(imageWidth-2*framePad) / float64(root.value)
+	var layout func(n *node, depth int, x float64)
+	layout = func(n *node, depth int, x float64) {
+		width := float64(n.value) * scale
+		if width < minWidth {
+			return
+		}
+		frames = append(frames, frame{name: n.name, value: n.value, depth: depth, x: x, w: width})
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		// children are sorted by name like flamegraph.pl so identical stacks line up across graphs
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := n.children[name]
+			layout(child, depth+1, x)
+			x += float64(child.value) * scale
+		}
+	}
+	layout(root, 0, framePad)
+
+	height := titleHeight + (maxDepth+1)*frameHeight + infoHeight
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg">
+<style type="text/css">
+text { font-family: Verdana, sans-serif; font-size: %dpx; fill: rgb(0,0,0); }
+.frame:hover rect { stroke: rgb(0,0,0); stroke-width: 0.5; cursor: pointer; }
+#title { font-size: 17px; text-anchor: middle; }
+#unzoom { cursor: pointer; }
+</style>
+<script type="text/ecmascript"><![CDATA[%s]]></script>
+<rect x="0" y="0" width="100%%" height="100%%" fill="rgb(248,248,248)"/>
+`, imageWidth, height, imageWidth, height, fontSize, fmt.Sprintf(script, imageWidth, framePad, fontSize*fontWidth))
+	fmt.Fprintf(bw, `<text id="title" x="%d" y="24">%s</text>
+<text id="unzoom" x="%d" y="24" style="display: none">Reset Zoom</text>
+<text id="details" x="%d" y="%d"> </text>
+`, imageWidth/2, escape(title), framePad, framePad, height-8)
+
+	for _, f := range frames {
+		y := height - infoHeight - (f.depth+1)*frameHeight
+		info := fmt.Sprintf("%s (%d samples, %.2f%%)", f.name, f.value, 100*float64(f.value)/float64(root.value))
+		fmt.Fprintf(bw, `<g class="frame" data-name="%s" data-x="%.2f" data-w="%.2f" data-depth="%d">`,
+			escape(f.name), f.x, f.w, f.depth)
+		fmt.Fprintf(bw, `<title>%s</title><rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s" rx="2" ry="2"/>`,
+			escape(info), f.x, y, f.w, frameHeight-1, color(f.name))
+		fmt.Fprintf(bw, `<text x="%.2f" y="%.1f">%s</text></g>`+"\n", f.x+3, float64(y)+10.5, escape(label(f.name, f.w)))
+	}
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+// label truncates a frame name to fit in width, the script uses the same rule when zooming
+func label(name string, width float64) string {
+	chars := int(math.Floor((width - 6) / (fontSize * fontWidth)))
+	if chars < 3 {
+		return ""
+	}
+	runes := []rune(name)
+	if len(runes) <= chars {
+		return name
+	}
+	return string(runes[:chars-2]) + ".."
+}
+
+// color returns a colour from flamegraph.pl's hot palette that's the same each time the frame is drawn
+func color(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	v1 := float64(sum&0xff) / 255
+	v2 := float64(sum>>8&0xff) / 255
+	v3 := float64(sum>>16&0xff) / 255
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+int(50*v3), int(230*v1), int(55*v2))
+}
+
+func escape(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// script zooms in on a frame when it's clicked, formatted with the image width, padding and character width
+const script = `
+var width = %d, pad = %d, charWidth = %.2f;
+var frames, details, unzoom;
+window.addEventListener("load", function() {
+	frames = document.getElementsByClassName("frame");
+	details = document.getElementById("details").firstChild;
+	unzoom = document.getElementById("unzoom");
+	for (var i = 0; i < frames.length; i++) {
+		frames[i].addEventListener("click", function() { zoom(this); });
+		frames[i].addEventListener("mouseover", function() { details.nodeValue = this.querySelector("title").textContent; });
+		frames[i].addEventListener("mouseout", function() { details.nodeValue = " "; });
+	}
+	unzoom.addEventListener("click", reset);
+	window.addEventListener("keydown", function(e) { if (e.key === "Escape") reset(); });
+});
+function attr(g, name) { return parseFloat(g.getAttribute("data-" + name)); }
+function fit(g, x, w) {
+	var rect = g.querySelector("rect"), text = g.querySelector("text"), name = g.getAttribute("data-name");
+	rect.setAttribute("x", x);
+	rect.setAttribute("width", w);
+	text.setAttribute("x", x + 3);
+	var chars = Math.floor((w - 6) / charWidth);
+	text.textContent = chars < 3 ? "" : name.length <= chars ? name : name.substring(0, chars - 2) + "..";
+}
+function zoom(target) {
+	var x0 = attr(target, "x"), w0 = attr(target, "w"), d0 = attr(target, "depth");
+	var scale = (width - 2 * pad) / w0, e = 0.01; // positions are rounded to 2 decimal places
+	for (var i = 0; i < frames.length; i++) {
+		var g = frames[i], x = attr(g, "x"), w = attr(g, "w"), d = attr(g, "depth");
+		if (d < d0 && x <= x0 + e && x + w >= x0 + w0 - e) {
+			g.style.display = "";
+			g.style.opacity = "0.5";
+			fit(g, pad, width - 2 * pad);
+		} else if (d >= d0 && x >= x0 - e && x + w <= x0 + w0 + e) {
+			g.style.display = "";
+			g.style.opacity = "";
+			fit(g, pad + (x - x0) * scale, w * scale);
+		} else {
+			g.style.display = "none";
+		}
+	}
+	unzoom.style.display = "";
+}
+function reset() {
+	for (var i = 0; i < frames.length; i++) {
+		var g = frames[i];
+		g.style.display = "";
+		g.style.opacity = "";
+		fit(g, attr(g, "x"), attr(g, "w"));
+	}
+	unzoom.style.display = "none";
+}
+`
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"strconv"
+)
+
+// DefaultMaxProcessSeries is the default cap on the number of per process series of each per process metric
+const DefaultMaxProcessSeries = 1000
+
+// Default is the registry served on /metrics
+var Default = NewRegistry()
+
+var (
+	durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+	PIDsScanned = Default.NewGauge("phunter_pids_scanned",
+		"Number of processes matched by the target on the last check.", "target")
+	ThresholdBreaches = Default.NewCounter("phunter_threshold_breaches_total",
+		"Number of times a process was seen above a threshold.", "target", "type")
+	TriggersFired = Default.NewCounter("phunter_triggers_fired_total",
+		"Number of times a threshold trigger fired a trace.", "target", "type")
+	TracesSkipped = Default.NewCounter("phunter_traces_skipped_total",
+		"Number of checks skipped because the process was already being traced.", "target")
+	TracesStarted = Default.NewCounter("phunter_traces_started_total",
+		"Number of traces started.", "target", "application")
+	TracesSucceeded = Default.NewCounter("phunter_traces_succeeded_total",
+		"Number of traces that completed successfully.", "target", "application")
+	TracesFailed = Default.NewCounter("phunter_traces_failed_total",
+		"Number of traces that failed.", "target", "application")
+	TraceDuration = Default.NewHistogram("phunter_trace_duration_seconds",
+		"How long traces ran for.", durationBuckets, "target", "application")
+	TracesRefused = Default.NewCounter("phunter_traces_refused_total",
+		"Number of traces that were triggered but not started, by disk_space, a cooldown or a queue reason.", "target", "reason")
+	TraceQueueLength = Default.NewGauge("phunter_trace_queue_length",
+		"Number of triggered traces waiting for a worker.")
+	TracesRunning = Default.NewGauge("phunter_traces_running",
+		"Number of traces being run by the workers.")
+	TraceBytes = Default.NewCounter("phunter_trace_bytes_written_total",
+		"Number of bytes written to trace files.", "target", "application")
+	TraceDirTraces = Default.NewGauge("phunter_trace_dir_traces",
+		"Number of traces kept in the trace directory after the last retention run.")
+	TraceDirBytes = Default.NewGauge("phunter_trace_dir_bytes",
+		"Size of the traces kept in the trace directory after the last retention run.")
+	TraceDirFreeBytes = Default.NewGauge("phunter_trace_dir_free_bytes",
+		"Free space on the filesystem containing the trace directory.")
+	RetentionEvictions = Default.NewCounter("phunter_retention_evictions_total",
+		"Number of traces evicted from the trace directory.", "reason")
+	RetentionEvictedBytes = Default.NewCounter("phunter_retention_evicted_bytes_total",
+		"Number of bytes freed by evicting traces.", "reason")
+	Uploads = Default.NewCounter("phunter_uploads_total",
+		"Number of traces uploaded to object storage by result, success, failure or dropped.", "result")
+	UploadRetries = Default.NewCounter("phunter_upload_retries_total",
+		"Number of times uploading a file to object storage was retried.")
+	UploadBytes = Default.NewCounter("phunter_upload_bytes_total",
+		"Number of bytes uploaded to object storage.")
+	UploadQueueLength = Default.NewGauge("phunter_upload_queue_length",
+		"Number of traces waiting to be uploaded to object storage.")
+	Notifications = Default.NewCounter("phunter_notifications_total",
+		"Number of notifications sent by notifier and result, success, failure or dropped.", "notifier", "result")
+	NotificationsSuppressed = Default.NewCounter("phunter_notifications_suppressed_total",
+		"Number of traces that weren't notified because the target's notification rate limit was reached.", "target")
+	CheckDuration = Default.NewHistogram("phunter_check_duration_seconds",
+		"How long each check of the processes took, not including the traces it queued.",
+		durationBuckets)
+	ChecksSkipped = Default.NewCounter("phunter_checks_skipped_total",
+		"Number of checks skipped because the previous check was still running.")
+	ProcessCPU = Default.NewGauge("phunter_process_cpu_percent",
+		"CPU utilisation of a checked process as a percentage of a single CPU.", "target", "pid")
+	ProcessRSS = Default.NewGauge("phunter_process_rss_kib",
+		"Resident memory of a checked process in KiB.", "target", "pid")
+	SeriesDropped = Default.NewCounter("phunter_metrics_series_dropped_total",
+		"Number of updates dropped because the metric reached its series limit.", "metric")
+)
+
+func init() {
+	SetMaxProcessSeries(DefaultMaxProcessSeries)
+}
+
+// SetMaxProcessSeries caps the number of processes the per process metrics are exported for
+// so a target matching thousands of short lived processes can't overwhelm prometheus
+// a limit of 0 disables the per process metrics
+func SetMaxProcessSeries(limit int) {
+	for _, gauge := range []*Gauge{ProcessCPU, ProcessRSS} {
+		if limit <= 0 {
+			gauge.DeleteFunc(func([]string) bool { return true })
+			gauge.SetLimit(0, nil)
+			continue
+		}
+		name := gauge.name
+		gauge.SetLimit(limit, func() { SeriesDropped.Inc(name) })
+	}
+}
+
+// ObserveProcessCPU records the CPU utilisation of a process checked for a target
+func ObserveProcessCPU(target string, pid int, cpu float64) {
+	ProcessCPU.Set(cpu, target, strconv.Itoa(pid))
+}
+
+// ObserveProcessRSS records the resident memory of a process checked for a target
+func ObserveProcessRSS(target string, pid int, rss int64) {
+	ProcessRSS.Set(float64(rss), target, strconv.Itoa(pid))
+}
+
+// RetainProcesses removes the per process series of processes that are no longer checked
+func RetainProcesses(keep func(target string, pid int) bool) {
+	for _, gauge := range []*Gauge{ProcessCPU, ProcessRSS} {
+		gauge.DeleteFunc(func(labelValues []string) bool {
+			pid, err := strconv.Atoi(labelValues[1])
+			return err != nil || !keep(labelValues[0], pid)
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metrics and writes them in the prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter is a value that only goes up, partitioned by its labels
+type Counter struct {
+	*metric
+}
+
+// Gauge is a value that can go up and down, partitioned by its labels
+type Gauge struct {
+	*metric
+}
+
+// Histogram counts observations into cumulative buckets, partitioned by its labels
+type Histogram struct {
+	*metric
+}
+
+// metric is the set of series that share a name
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+	limit  int    // maximum number of series, negative means no limit
+	onDrop func() // called when a new series is dropped because of the limit
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter and gauge value, histogram sum
+	count       uint64   // histogram observations
+	counts      []uint64 // histogram observations per bucket, not cumulative
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, typeCounter, labels, nil)}
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, typeGauge, labels, nil)}
+}
+
+// NewHistogram registers a histogram with the given upper bounds, the +Inf bucket is added automatically
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(name, help, typeHistogram, labels, buckets)}
+}
+
+func (r *Registry) register(name, help, kind string, labels []string, buckets []float64) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if m.name == name {
+			panic(fmt.Sprintf("metric %s is already registered", name))
+		}
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+		limit:   -1,
+	}
+	// metrics without labels are exported straight away rather than after they first change
+	if len(labels) == 0 {
+		m.get(nil)
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.name))
+	}
+	c.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the current value of the series with the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.value(labelValues)
+}
+
+// Set sets the series with the given label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value = v })
+}
+
+// Value returns the current value of the series with the given label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.value(labelValues)
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.update(labelValues, func(s *series) {
+		s.value += v
+		s.count++
+		for i, upperBound := range h.buckets {
+			if v <= upperBound {
+				s.counts[i]++
+				break
+			}
+		}
+	})
+}
+
+// Count returns the number of observations in the series with the given label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.checkLabels(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[seriesKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// SetLimit caps the number of series, once reached new series are dropped and onDrop is called
+// existing series are kept and continue to be updated, a negative limit removes the cap
+func (m *metric) SetLimit(limit int, onDrop func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limit = limit
+	m.onDrop = onDrop
+}
+
+// Delete removes the series with the given label values
+func (m *metric) Delete(labelValues ...string) {
+	m.checkLabels(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, seriesKey(labelValues))
+}
+
+// DeleteFunc removes every series whose label values match
+func (m *metric) DeleteFunc(match func(labelValues []string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.series {
+		if match(s.labelValues) {
+			delete(m.series, key)
+		}
+	}
+}
+
+// Len returns the number of series
+func (m *metric) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.series)
+}
+
+func (m *metric) update(labelValues []string, f func(s *series)) {
+	m.checkLabels(labelValues)
+	m.mu.Lock()
+	s := m.get(labelValues)
+	if s != nil {
+		f(s)
+	}
+	onDrop := m.onDrop
+	m.mu.Unlock()
+
+	// called without holding the lock in case onDrop updates this metric
+	if s == nil && onDrop != nil {
+		onDrop()
+	}
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	m.checkLabels(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[seriesKey(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// get returns the series for the label values, creating it if there is room
+// returns nil when the series would exceed the limit, m.mu must be held
+func (m *metric) get(labelValues []string) *series {
+	key := seriesKey(labelValues)
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	if m.limit >= 0 && len(m.series) >= m.limit {
+		return nil
+	}
+	s := &series{labelValues: append([]string(nil), labelValues...)}
+	if m.kind == typeHistogram {
+		s.counts = make([]uint64, len(m.buckets))
+	}
+	m.series[key] = s
+	return s
+}
+
+func (m *metric) checkLabels(labelValues []string) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v but was given %d values", m.name, m.labels, len(labelValues)))
+	}
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Write writes every metric in the prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the metrics in the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.Write(w)
+	})
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upperBound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				formatLabels(m.labels, s.labelValues, "le", formatValue(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels returns the label set of a series with an optional extra label e.g. le for histogram buckets
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapeLabelValue(extraValue)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
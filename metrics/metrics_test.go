@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeRegistry(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestWriteTextFormat(t *testing.T) {
+	r := NewRegistry()
+	traces := r.NewCounter("test_traces_total", "Number of traces.", "target", "application")
+	pids := r.NewGauge("test_pids", "Number of pids.")
+	duration := r.NewHistogram("test_duration_seconds", "How long it took.", []float64{10, 1}, "target")
+
+	traces.Inc("php", "php")
+	traces.Add(2, "python", "python")
+	traces.Inc("php", "php")
+	pids.Set(3)
+	duration.Observe(0.5, "php")
+	duration.Observe(5, "php")
+	duration.Observe(20, "php")
+
+	expected := `# HELP test_duration_seconds How long it took.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{target="php",le="1"} 1
+test_duration_seconds_bucket{target="php",le="10"} 2
+test_duration_seconds_bucket{target="php",le="+Inf"} 3
+test_duration_seconds_sum{target="php"} 25.5
+test_duration_seconds_count{target="php"} 3
+# HELP test_pids Number of pids.
+# TYPE test_pids gauge
+test_pids 3
+# HELP test_traces_total Number of traces.
+# TYPE test_traces_total counter
+test_traces_total{target="php",application="php"} 2
+test_traces_total{target="python",application="python"} 2
+`
+	if actual := writeRegistry(t, r); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestUnlabelledMetricsExportedBeforeUpdate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter.")
+	r.NewHistogram("test_seconds", "A histogram.", []float64{1})
+
+	actual := writeRegistry(t, r)
+	for _, line := range []string{"test_total 0\n", "test_seconds_bucket{le=\"+Inf\"} 0\n", "test_seconds_count 0\n"} {
+		if !strings.Contains(actual, line) {
+			t.Errorf("expected %q in:\n%s", line, actual)
+		}
+	}
+}
+
+func TestLabelValuesEscaped(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test", "Help with a \\ and\na new line.", "name").Set(1, "a \"quoted\" \\ value\n")
+
+	expected := `# HELP test Help with a \\ and\na new line.
+# TYPE test gauge
+test{name="a \"quoted\" \\ value\n"} 1
+`
+	if actual := writeRegistry(t, r); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestSeriesLimit(t *testing.T) {
+	r := NewRegistry()
+	gauge := r.NewGauge("test", "A gauge.", "pid")
+	dropped := 0
+	gauge.SetLimit(2, func() { dropped++ })
+
+	gauge.Set(1, "1")
+	gauge.Set(2, "2")
+	gauge.Set(3, "3")
+	gauge.Set(4, "1")
+
+	if gauge.Len() != 2 {
+		t.Errorf("expected 2 series, got %d", gauge.Len())
+	}
+	if dropped != 1 {
+		t.Errorf("expected 1 dropped update, got %d", dropped)
+	}
+	if value := gauge.Value("1"); value != 4 {
+		t.Errorf("expected existing series to be updated to 4, got %v", value)
+	}
+	if value := gauge.Value("3"); value != 0 {
+		t.Errorf("expected series over the limit to be dropped, got %v", value)
+	}
+
+	gauge.Delete("2")
+	gauge.Set(3, "3")
+	if value := gauge.Value("3"); value != 3 {
+		t.Errorf("expected series to be added once there was room, got %v", value)
+	}
+}
+
+func TestMaxProcessSeries(t *testing.T) {
+	defer SetMaxProcessSeries(DefaultMaxProcessSeries)
+	defer RetainProcesses(func(string, int) bool { return false })
+
+	SetMaxProcessSeries(2)
+	for pid := 1; pid <= 3; pid++ {
+		ObserveProcessCPU("limited", pid, 50)
+	}
+	if ProcessCPU.Len() != 2 {
+		t.Errorf("expected 2 process series, got %d", ProcessCPU.Len())
+	}
+	if dropped := SeriesDropped.Value("phunter_process_cpu_percent"); dropped != 1 {
+		t.Errorf("expected 1 dropped update, got %v", dropped)
+	}
+
+	RetainProcesses(func(target string, pid int) bool { return pid == 2 })
+	if ProcessCPU.Len() != 1 || ProcessCPU.Value("limited", "2") != 50 {
+		t.Errorf("expected only pid 2 to be retained, got %d series", ProcessCPU.Len())
+	}
+
+	SetMaxProcessSeries(0)
+	ObserveProcessRSS("limited", 2, 1024)
+	if ProcessCPU.Len() != 0 || ProcessRSS.Len() != 0 {
+		t.Errorf("expected per process metrics to be disabled, got %d and %d series", ProcessCPU.Len(), ProcessRSS.Len())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter.").Inc()
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("expected content type %s, got %s", ContentType, contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), "test_total 1\n") {
+		t.Errorf("expected counter in response:\n%s", recorder.Body.String())
+	}
+}
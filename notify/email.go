@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/system"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTimeout is how long sending an email can take
+const smtpTimeout = 30 * time.Second
+
+// Email sends each event as a plain text email
+type Email struct {
+	config config.EmailConfig
+	clock  system.Clock // dates the emails
+	send   func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmail returns a notifier that sends emails by SMTP
+func NewEmail(emailConfig config.EmailConfig) *Email {
+	return &Email{config: emailConfig, clock: system.RealClock, send: sendMail}
+}
+
+func (e *Email) Name() string {
+	return "email"
+}
+
+func (e *Email) Notify(event Event) error {
+	var auth smtp.Auth
+	if e.config.Username != "" {
+		auth = smtp.PlainAuth("", e.config.Username, os.ExpandEnv(e.config.Password), e.config.Host)
+	}
+	addr := net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port))
+	return e.send(addr, auth, e.config.From, e.config.To, e.message(event))
+}
+
+// message returns the email for the event with CRLF line endings
+func (e *Email) message(event Event) []byte {
+	// the summary includes container names so line breaks are removed to keep it in the subject header
+	subject := strings.Join(strings.Fields("phunter: "+event.Summary()), " ")
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.clock.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(event.Text(), "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+	return msg.Bytes()
+}
+
+// sendMail is smtp.SendMail with a timeout so a server that stops responding doesn't hold up other notifications
+func sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server stand-in that accepts PLAIN authentication and records the commands and message it receives
+type fakeSMTP struct {
+	listener net.Listener
+	commands []string
+	message  string
+	done     chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: listener, done: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		s.commands = append(s.commands, command)
+		switch verb := strings.ToUpper(strings.Fields(command + " ")[0]); verb {
+		case "EHLO":
+			fmt.Fprint(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case "AUTH":
+			fmt.Fprint(conn, "235 authenticated\r\n")
+		case "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			s.message = message.String()
+			fmt.Fprint(conn, "250 queued\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	s := newFakeSMTP(t)
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	email := NewEmail(config.EmailConfig{
+		Host:     host,
+		Port:     portNumber,
+		Username: "phunter",
+		Password: "secret",
+		From:     "phunter@example.com",
+		To:       []string{"oncall@example.com", "dev@example.com"},
+	})
+	email.clock = systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+
+	if err := email.Notify(NewEvent(config.NotifyEventStart, newTestConfig(), newTestMetadata("web-4242.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+
+	expectedCommands := []string{"AUTH PLAIN", "MAIL FROM:<phunter@example.com>", "RCPT TO:<oncall@example.com>", "RCPT TO:<dev@example.com>", "DATA", "QUIT"}
+	commands := strings.Join(s.commands, "\n")
+	for _, expected := range expectedCommands {
+		if !strings.Contains(commands, expected) {
+			t.Errorf("expected the %q command to be sent: %v", expected, s.commands)
+		}
+	}
+	for _, expected := range []string{
+		"Subject: phunter: CPU trigger started a trace of PID 4242 in shop_web-abcde on node-1\r\n",
+		"To: oncall@example.com, dev@example.com\r\n",
+		"Date: Sat, 01 Aug 2020 12:00:00 +0000\r\n",
+		"\r\nTrace: http://10.0.0.1:8080/api/v1/traces/web-4242.txt/download\r\n",
+	} {
+		if !strings.Contains(s.message, expected) {
+			t.Errorf("expected the message to contain %q:\n%s", expected, s.message)
+		}
+	}
+}
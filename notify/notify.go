@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/api"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/trace"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultQueueSize is how many notifications can wait to be sent before new notifications are dropped
+const DefaultQueueSize = 100
+
+// Event is a notification that a triggered trace started or that a trace completed
+type Event struct {
+	Type        string // config.NotifyEventStart or config.NotifyEventComplete
+	Node        string
+	Metadata    trace.Metadata
+	Thresholds  process.ThresholdParams // the thresholds of the target that was traced
+	DownloadURL string                  // empty when notify.trace_server_url isn't set
+	Suppressed  int                     // traces of the target that weren't notified because of the rate limit since the last notification
+}
+
+// NewEvent returns the event for a trace traced with traceConfig
+func NewEvent(eventType string, traceConfig config.HunterConfig, metadata trace.Metadata) Event {
+	event := Event{
+		Type:       eventType,
+		Node:       metadata.Node(traceConfig),
+		Metadata:   metadata,
+		Thresholds: traceConfig.ThresholdParams,
+	}
+	if serverURL := os.ExpandEnv(traceConfig.Notify.TraceServerURL); serverURL != "" {
+		event.DownloadURL = fmt.Sprintf("%s%s/%s/download", strings.TrimSuffix(serverURL, "/"), api.TracesPath,
+			url.PathEscape(metadata.TraceFile))
+	}
+	return event
+}
+
+// Summary returns a one line description of the event
+func (e Event) Summary() string {
+	subject := fmt.Sprintf("PID %d", e.Metadata.PID)
+	if c := e.Metadata.Container; c != nil {
+		subject += " in " + c.DisplayName()
+	}
+	subject += " on " + e.Node
+	if e.Type == config.NotifyEventStart {
+		return fmt.Sprintf("%s trigger started a trace of %s", e.Metadata.Trigger, subject)
+	}
+	return fmt.Sprintf("trace of %s %s", subject, e.Metadata.Status)
+}
+
+// Text returns the summary followed by the details of the trace, one per line
+func (e Event) Text() string {
+	m := e.Metadata
+	lines := []string{
+		e.Summary(),
+		fmt.Sprintf("Target: %s (%s)", m.Target, m.Application),
+	}
+	if c := m.Container; c != nil && c.Pod != nil {
+		lines = append(lines, fmt.Sprintf("Pod: %s/%s", c.Pod.Namespace, c.Pod.Name))
+	}
+	lines = append(lines,
+		fmt.Sprintf("CPU: %.1f%% (threshold %.1f%%)", m.CPU, e.Thresholds.CPUThreshold),
+		fmt.Sprintf("RSS: %d KiB (threshold %d KiB)", m.RSS, e.Thresholds.RSSThreshold),
+	)
+	if e.Type == config.NotifyEventComplete {
+		lines = append(lines, fmt.Sprintf("Duration: %s", m.Duration().Round(time.Second)))
+	}
+	if m.Error != "" {
+		lines = append(lines, "Error: "+m.Error)
+	}
+	if e.DownloadURL != "" {
+		lines = append(lines, "Trace: "+e.DownloadURL)
+	} else {
+		lines = append(lines, "Trace: "+m.TraceFile)
+	}
+	if e.Suppressed > 0 {
+		lines = append(lines, fmt.Sprintf("%d earlier traces of this target weren't notified because of the rate limit", e.Suppressed))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Payload is the JSON posted to webhooks
+type Payload struct {
+	Event        string          `json:"event"` // start or complete
+	Summary      string          `json:"summary"`
+	Node         string          `json:"node"`
+	Target       string          `json:"target"`
+	Application  string          `json:"application"`
+	PID          int             `json:"pid"`
+	Container    *container.Info `json:"container,omitempty"`
+	Trigger      string          `json:"trigger"`
+	CPU          float64         `json:"cpu"`
+	CPUThreshold float64         `json:"cpu_threshold"`
+	RSS          int64           `json:"rss"`
+	RSSThreshold int64           `json:"rss_threshold"`
+	Status       string          `json:"status"`
+	Error        string          `json:"error,omitempty"`
+	TraceFile    string          `json:"trace_file"`
+	DownloadURL  string          `json:"download_url,omitempty"`
+	StartTime    time.Time       `json:"start_time"`
+	EndTime      *time.Time      `json:"end_time,omitempty"`
+	Suppressed   int             `json:"suppressed,omitempty"`
+}
+
+// Payload returns the JSON payload for the event
+func (e Event) Payload() Payload {
+	m := e.Metadata
+	return Payload{
+		Event:        e.Type,
+		Summary:      e.Summary(),
+		Node:         e.Node,
+		Target:       m.Target,
+		Application:  m.Application,
+		PID:          m.PID,
+		Container:    m.Container,
+		Trigger:      m.Trigger,
+		CPU:          m.CPU,
+		CPUThreshold: e.Thresholds.CPUThreshold,
+		RSS:          m.RSS,
+		RSSThreshold: e.Thresholds.RSSThreshold,
+		Status:       m.Status,
+		Error:        m.Error,
+		TraceFile:    m.TraceFile,
+		DownloadURL:  e.DownloadURL,
+		StartTime:    m.StartTime,
+		EndTime:      m.EndTime,
+		Suppressed:   e.Suppressed,
+	}
+}
+
+// Notifier sends notifications to a single destination
+type Notifier interface {
+	Name() string
+	Notify(event Event) error
+}
+
+// NewNotifiers returns a notifier for each destination that's configured
+func NewNotifiers(notifyConfig config.NotifyConfig) []Notifier {
+	var notifiers []Notifier
+	if notifyConfig.Webhook.URL != "" {
+		notifiers = append(notifiers, NewWebhook(notifyConfig.Webhook))
+	}
+	if notifyConfig.Slack.WebhookURL != "" {
+		notifiers = append(notifiers, NewSlack(notifyConfig.Slack))
+	}
+	if notifyConfig.Email.Host != "" {
+		notifiers = append(notifiers, NewEmail(notifyConfig.Email))
+	}
+	return notifiers
+}
+
+type job struct {
+	notifiers []Notifier
+	event     Event
+}
+
+// Dispatcher rate limits notifications and sends them in the background
+type Dispatcher struct {
+	jobs         chan job
+	limiter      *rateLimiter
+	newNotifiers func(config.NotifyConfig) []Notifier
+	done         chan struct{} // closed when Run returns
+}
+
+// NewDispatcher returns a dispatcher that queues up to queueSize notifications
+func NewDispatcher(queueSize int) *Dispatcher {
+	return &Dispatcher{
+		jobs:         make(chan job, queueSize),
+		limiter:      newRateLimiter(system.RealClock),
+		newNotifiers: NewNotifiers,
+		done:         make(chan struct{}),
+	}
+}
+
+// Dispatch queues a notification of the event for a trace, returning whether it was queued
+// nothing is queued when no notifiers are configured, the event isn't notified, the target's rate limit
+// has been reached or the queue is full
+func (d *Dispatcher) Dispatch(eventType string, traceConfig config.HunterConfig, metadata trace.Metadata) bool {
+	notifyConfig := traceConfig.Notify
+	if !notifyConfig.Enabled() || !notifyConfig.Notifies(eventType) {
+		return false
+	}
+	allowed, suppressed := d.limiter.allow(eventType, notifyConfig, metadata)
+	if !allowed {
+		logrus.WithFields(logrus.Fields{"trace": metadata.TraceFile, "target": metadata.Target}).
+			Debugf("notification rate limit reached, %s notification suppressed", eventType)
+		return false
+	}
+	event := NewEvent(eventType, traceConfig, metadata)
+	event.Suppressed = suppressed
+	notifiers := d.newNotifiers(notifyConfig)
+	select {
+	case d.jobs <- job{notifiers: notifiers, event: event}:
+		return true
+	default:
+		logrus.WithField("trace", metadata.TraceFile).Errorf("notification queue is full, %s notification dropped", eventType)
+		for _, n := range notifiers {
+			metrics.Notifications.Inc(n.Name(), "dropped")
+		}
+		return false
+	}
+}
+
+// Run sends queued notifications until stopped, the notifications already queued when stopped are still sent
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	defer close(d.done)
+	for {
+		select {
+		case <-stop:
+			for {
+				select {
+				case j := <-d.jobs:
+					j.send()
+				default:
+					return
+				}
+			}
+		case j := <-d.jobs:
+			j.send()
+		}
+	}
+}
+
+// Done returns a channel that's closed once Run has sent the queued notifications and returned
+func (d *Dispatcher) Done() <-chan struct{} {
+	return d.done
+}
+
+func (j job) send() {
+	for _, n := range j.notifiers {
+		log := logrus.WithFields(logrus.Fields{"trace": j.event.Metadata.TraceFile, "notifier": n.Name()})
+		if err := n.Notify(j.event); err != nil {
+			log.Errorf("failed to send %s notification: %v", j.event.Type, err)
+			metrics.Notifications.Inc(n.Name(), "failure")
+			continue
+		}
+		log.Debugf("sent %s notification", j.event.Type)
+		metrics.Notifications.Inc(n.Name(), "success")
+	}
+}
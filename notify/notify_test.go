@@ -0,0 +1,251 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"github.com/daniel-cole/phunter/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConfig() config.HunterConfig {
+	traceConfig := config.Default()
+	traceConfig.TargetName = "web"
+	traceConfig.Notify.TraceServerURL = "http://10.0.0.1:8080/"
+	return traceConfig
+}
+
+func newTestMetadata(traceFile string) trace.Metadata {
+	return trace.Metadata{
+		PID:         4242,
+		Target:      "web",
+		Application: "php",
+		TraceFile:   traceFile,
+		Trigger:     "CPU",
+		CPU:         97.5,
+		RSS:         1024,
+		Status:      trace.TraceStatusRunning,
+		StartTime:   time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC),
+		Container:   &container.Info{Name: "web", Pod: &container.Pod{Name: "web-abcde", Namespace: "shop", Node: "node-1"}},
+	}
+}
+
+func TestEvent(t *testing.T) {
+	event := NewEvent(config.NotifyEventStart, newTestConfig(), newTestMetadata("web-4242.txt"))
+
+	if event.DownloadURL != "http://10.0.0.1:8080/api/v1/traces/web-4242.txt/download" {
+		t.Errorf("unexpected download URL: %s", event.DownloadURL)
+	}
+	if summary := event.Summary(); summary != "CPU trigger started a trace of PID 4242 in shop_web-abcde on node-1" {
+		t.Errorf("unexpected summary: %s", summary)
+	}
+	for _, expected := range []string{"Pod: shop/web-abcde", "CPU: 97.5% (threshold 90.0%)", "RSS: 1024 KiB (threshold 524288 KiB)", event.DownloadURL} {
+		if !strings.Contains(event.Text(), expected) {
+			t.Errorf("expected the text to contain %q: %s", expected, event.Text())
+		}
+	}
+
+	metadata := newTestMetadata("web-4242.txt")
+	endTime := metadata.StartTime.Add(10 * time.Second)
+	metadata.EndTime = &endTime
+	metadata.Status = trace.TraceStatusStopped
+	event = NewEvent(config.NotifyEventComplete, config.Default(), metadata)
+	if event.DownloadURL != "" {
+		t.Errorf("expected no download URL without a trace server URL, instead got %s", event.DownloadURL)
+	}
+	if summary := event.Summary(); summary != "trace of PID 4242 in shop_web-abcde on node-1 stopped" {
+		t.Errorf("unexpected summary: %s", summary)
+	}
+	if !strings.Contains(event.Text(), "Duration: 10s") {
+		t.Errorf("expected the text to include the duration: %s", event.Text())
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	l := newRateLimiter(clock)
+	notifyConfig := config.DefaultNotifyConfig()
+	notifyConfig.RateLimit = 2
+	notifyConfig.RateLimitInterval = 60
+
+	allow := func(eventType, traceFile string) (bool, int) {
+		metadata := newTestMetadata(traceFile)
+		return l.allow(eventType, notifyConfig, metadata)
+	}
+	for _, traceFile := range []string{"1.txt", "2.txt"} {
+		if allowed, _ := allow(config.NotifyEventStart, traceFile); !allowed {
+			t.Fatalf("expected %s to be notified", traceFile)
+		}
+	}
+	if allowed, _ := allow(config.NotifyEventStart, "3.txt"); allowed {
+		t.Fatal("expected the third trace in the interval to be suppressed")
+	}
+	if allowed, _ := allow(config.NotifyEventComplete, "1.txt"); !allowed {
+		t.Error("expected the completion of a notified trace to be notified")
+	}
+	if allowed, _ := allow(config.NotifyEventComplete, "3.txt"); allowed {
+		t.Error("expected the completion of a suppressed trace to be suppressed")
+	}
+	other := newTestMetadata("other.txt")
+	other.Target = "worker"
+	if allowed, _ := l.allow(config.NotifyEventStart, notifyConfig, other); !allowed {
+		t.Error("expected other targets to have their own limit")
+	}
+
+	clock.Advance(61 * time.Second)
+	if allowed, suppressed := allow(config.NotifyEventStart, "4.txt"); !allowed || suppressed != 1 {
+		t.Errorf("expected the trace to be notified with 1 suppressed trace, instead got %v and %d", allowed, suppressed)
+	}
+	if len(l.traces) != 3 {
+		t.Errorf("expected only the running traces to be remembered, instead got %v", l.traces)
+	}
+}
+
+// recorder is a webhook stand-in that records the requests it receives
+type recorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newRecorder(t *testing.T) *recorder {
+	r := &recorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, string(body))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *recorder) received() ([]*http.Request, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request(nil), r.requests...), append([]string(nil), r.bodies...)
+}
+
+func TestDispatcher(t *testing.T) {
+	webhook := newRecorder(t)
+	slack := newRecorder(t)
+	traceConfig := newTestConfig()
+	traceConfig.Notify.Webhook = config.WebhookConfig{URL: webhook.URL + "/hook", Headers: map[string]string{"Authorization": "Bearer token"}}
+	traceConfig.Notify.Slack = config.SlackConfig{WebhookURL: slack.URL, Channel: "#alerts"}
+
+	d := NewDispatcher(DefaultQueueSize)
+	stop := make(chan struct{})
+	go d.Run(stop)
+
+	metadata := newTestMetadata("web-4242.txt")
+	if !d.Dispatch(config.NotifyEventStart, traceConfig, metadata) {
+		t.Fatal("expected the start notification to be queued")
+	}
+	metadata.Status = trace.TraceStatusCompleted
+	if !d.Dispatch(config.NotifyEventComplete, traceConfig, metadata) {
+		t.Fatal("expected the completion notification to be queued")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if requests, _ := slack.received(); len(requests) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for notifications")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-d.Done()
+
+	requests, bodies := webhook.received()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 webhook requests, instead got %d", len(requests))
+	}
+	if requests[0].Header.Get("Authorization") != "Bearer token" || requests[0].URL.Path != "/hook" {
+		t.Errorf("expected the webhook headers and path to be used, instead got %v %s", requests[0].Header, requests[0].URL)
+	}
+	var payload Payload
+	if err := json.Unmarshal([]byte(bodies[1]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != config.NotifyEventComplete || payload.PID != 4242 || payload.Container.Name != "web" ||
+		payload.CPUThreshold != 90 || payload.DownloadURL == "" {
+		t.Errorf("unexpected webhook payload: %+v", payload)
+	}
+
+	_, bodies = slack.received()
+	var message slackMessage
+	if err := json.Unmarshal([]byte(bodies[0]), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Channel != "#alerts" || !strings.Contains(message.Text, "|web-4242.txt>") {
+		t.Errorf("unexpected slack message: %+v", message)
+	}
+}
+
+func TestDispatcherSendsQueuedWhenStopped(t *testing.T) {
+	webhook := newRecorder(t)
+	traceConfig := newTestConfig()
+	traceConfig.Notify.Webhook = config.WebhookConfig{URL: webhook.URL}
+
+	d := NewDispatcher(DefaultQueueSize)
+	if !d.Dispatch(config.NotifyEventComplete, traceConfig, newTestMetadata("web-4242.txt")) {
+		t.Fatal("expected the notification to be queued")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	go d.Run(stop)
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dispatcher to stop")
+	}
+	if requests, _ := webhook.received(); len(requests) != 1 {
+		t.Errorf("expected the queued notification to be sent before stopping, instead got %d requests", len(requests))
+	}
+}
+
+func TestDispatchSkipsDisabledEvents(t *testing.T) {
+	traceConfig := newTestConfig()
+	d := NewDispatcher(1)
+	if d.Dispatch(config.NotifyEventStart, traceConfig, newTestMetadata("1.txt")) {
+		t.Error("expected nothing to be queued without notifiers")
+	}
+	traceConfig.Notify.Webhook.URL = "http://localhost/hook"
+	traceConfig.Notify.Events = []string{config.NotifyEventComplete}
+	if d.Dispatch(config.NotifyEventStart, traceConfig, newTestMetadata("1.txt")) {
+		t.Error("expected events that aren't listed not to be queued")
+	}
+	if !d.Dispatch(config.NotifyEventComplete, traceConfig, newTestMetadata("1.txt")) {
+		t.Error("expected listed events to be queued")
+	}
+	if d.Dispatch(config.NotifyEventComplete, traceConfig, newTestMetadata("2.txt")) {
+		t.Error("expected notifications to be dropped when the queue is full")
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	err := NewSlack(config.SlackConfig{WebhookURL: server.URL + "/services/secret"}).
+		Notify(NewEvent(config.NotifyEventStart, newTestConfig(), newTestMetadata("1.txt")))
+	if err == nil || !strings.Contains(err.Error(), "invalid_token") {
+		t.Fatalf("expected the response to be returned, instead got %v", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the webhook URL to be left out of the error: %v", err)
+	}
+}
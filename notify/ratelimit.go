@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/trace"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits how many traces of each target are notified in each rate_limit_interval
+// the limit applies to traces rather than events, so the completion of a trace is notified if and only if
+// its start was notified
+type rateLimiter struct {
+	mu         sync.Mutex
+	clock      system.Clock
+	sent       map[string][]time.Time // when traces of each target were notified within the interval
+	suppressed map[string]int         // traces of each target suppressed since the last notification
+	traces     map[string]bool        // whether running traces were notified when they started
+}
+
+func newRateLimiter(clock system.Clock) *rateLimiter {
+	return &rateLimiter{
+		clock:      clock,
+		sent:       make(map[string][]time.Time),
+		suppressed: make(map[string]int),
+		traces:     make(map[string]bool),
+	}
+}
+
+// allow returns whether the event can be notified and, if so, how many traces of the target were suppressed
+// since the last notification
+func (l *rateLimiter) allow(eventType string, notifyConfig config.NotifyConfig, metadata trace.Metadata) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if allowed, ok := l.traces[metadata.TraceFile]; ok {
+		if eventType == config.NotifyEventComplete {
+			delete(l.traces, metadata.TraceFile)
+		}
+		return allowed, 0
+	}
+
+	target := metadata.Target
+	allowed := true
+	if notifyConfig.RateLimit > 0 {
+		now := l.clock.Now()
+		windowStart := now.Add(-time.Duration(notifyConfig.RateLimitInterval) * time.Second)
+		var sent []time.Time
+		for _, t := range l.sent[target] {
+			if t.After(windowStart) {
+				sent = append(sent, t)
+			}
+		}
+		if allowed = len(sent) < notifyConfig.RateLimit; allowed {
+			sent = append(sent, now)
+		}
+		l.sent[target] = sent
+	}
+	if eventType == config.NotifyEventStart && notifyConfig.Notifies(config.NotifyEventComplete) {
+		l.traces[metadata.TraceFile] = allowed
+	}
+
+	if !allowed {
+		l.suppressed[target]++
+		metrics.NotificationsSuppressed.Inc(target)
+		return false, 0
+	}
+	suppressed := l.suppressed[target]
+	delete(l.suppressed, target)
+	return true, suppressed
+}
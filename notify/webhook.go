@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpTimeout is how long a webhook has to respond
+const httpTimeout = 10 * time.Second
+
+// Webhook posts each event as JSON, see Payload
+type Webhook struct {
+	config config.WebhookConfig
+	client *http.Client
+}
+
+// NewWebhook returns a notifier for a generic JSON webhook
+func NewWebhook(webhookConfig config.WebhookConfig) *Webhook {
+	return &Webhook{config: webhookConfig, client: &http.Client{Timeout: httpTimeout}}
+}
+
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) Notify(event Event) error {
+	return postJSON(w.client, w.config.URL, w.config.Headers, event.Payload())
+}
+
+// Slack posts each event as a message to a Slack compatible incoming webhook
+type Slack struct {
+	config config.SlackConfig
+	client *http.Client
+}
+
+// slackMessage is the incoming webhook message format, which Mattermost and Rocket.Chat also accept
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// NewSlack returns a notifier for a Slack compatible incoming webhook
+func NewSlack(slackConfig config.SlackConfig) *Slack {
+	return &Slack{config: slackConfig, client: &http.Client{Timeout: httpTimeout}}
+}
+
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+func (s *Slack) Notify(event Event) error {
+	text := event.Text()
+	if event.DownloadURL != "" {
+		text = strings.Replace(text, event.DownloadURL, fmt.Sprintf("<%s|%s>", event.DownloadURL, event.Metadata.TraceFile), 1)
+	}
+	message := slackMessage{Text: text, Channel: s.config.Channel, Username: s.config.Username}
+	return postJSON(s.client, s.config.WebhookURL, nil, message)
+}
+
+// postJSON posts v as JSON to url with environment variables in the url and headers expanded
+// the url isn't included in errors as it often contains a token
+func postJSON(client *http.Client, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, os.ExpandEnv(url), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(interface{ Unwrap() error }); ok {
+			err = urlErr.Unwrap()
+		}
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
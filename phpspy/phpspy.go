@@ -0,0 +1,178 @@
+package phpspy
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frame is a function call on a sampled stack
+type Frame struct {
+	Function string // e.g. App\Http\Controller::index
+	File     string // <internal> for functions implemented in C
+	Line     int    // -1 when unknown
+}
+
+// Request is the request info phpspy captures with -r, parts that weren't captured are empty
+type Request struct {
+	Time   time.Time
+	URI    string
+	Query  string
+	Path   string
+	Cookie string
+	Method string
+}
+
+// Trace is a single sampled stack
+type Trace struct {
+	Frames  []Frame  // innermost frame first
+	Request *Request // nil unless request info was captured
+}
+
+// Scanner reads the traces written by phpspy
+//
+// each frame is written as its depth, function and file:line with the innermost frame at depth 0, e.g.
+//
+//	0 usleep <internal>:-1
+//	1 App\Http\Controller::index /app/src/Http/Controller.php:42
+//	2 <main> /app/public/index.php:7
+//	# 1597152000.123456 /reports?page=2 page=2 /app/public/index.php - GET
+//	# mem 2097152 4194304
+//
+// traces are separated by a blank line in the default multi-line output, or written on a single line with the
+// frames separated by "; " when phpspy is run with -1. Comments start with #, the request info comment is the
+// timestamp followed by the uri, query, path, cookie and method with - for the parts that weren't captured.
+// Other comments such as memory usage and peeked variables are skipped, as are any errors phpspy wrote to the trace
+type Scanner struct {
+	scanner *bufio.Scanner
+	current Trace
+	done    []Trace
+	trace   Trace
+}
+
+// NewScanner returns a scanner that reads traces from r
+func NewScanner(r io.Reader) *Scanner {
+	scanner := bufio.NewScanner(r)
+	// single-line traces of deep stacks can be long
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	return &Scanner{scanner: scanner}
+}
+
+// Scan advances to the next trace, returning false at the end of the input or on an error
+func (s *Scanner) Scan() bool {
+	for len(s.done) == 0 {
+		if !s.scanner.Scan() {
+			s.flush()
+			break
+		}
+		s.parseLine(strings.TrimSpace(s.scanner.Text()))
+	}
+	if len(s.done) == 0 {
+		return false
+	}
+	s.trace, s.done = s.done[0], s.done[1:]
+	return true
+}
+
+// Trace returns the trace read by the last call to Scan
+func (s *Scanner) Trace() Trace {
+	return s.trace
+}
+
+// Err returns the first error reading the input
+func (s *Scanner) Err() error {
+	return s.scanner.Err()
+}
+
+func (s *Scanner) parseLine(line string) {
+	if line == "" {
+		s.flush()
+		return
+	}
+	if strings.HasPrefix(line, "#") {
+		s.parseComment(line)
+		return
+	}
+	parts := strings.Split(line, "; ")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "#") {
+			// comments follow the frames in single-line output, their values may themselves contain "; " so the
+			// comments are only split where the next one starts
+			comments := strings.Join(parts[i:], "; ")
+			for _, comment := range strings.Split(comments, "; #") {
+				s.parseComment(comment)
+			}
+			return
+		}
+		depth, frame, ok := parseFrame(part)
+		if !ok {
+			continue
+		}
+		// every trace starts at depth 0, which also separates single-line traces
+		if depth == 0 {
+			s.flush()
+		}
+		s.current.Frames = append(s.current.Frames, frame)
+	}
+}
+
+// parseFrame parses a frame such as "1 App\Http\Controller::index /app/src/Http/Controller.php:42"
+func parseFrame(s string) (int, Frame, bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return 0, Frame{}, false
+	}
+	depth, err := strconv.Atoi(fields[0])
+	if err != nil || depth < 0 {
+		return 0, Frame{}, false
+	}
+	frame := Frame{Function: fields[1], Line: -1}
+	if len(fields) > 2 {
+		location := strings.Join(fields[2:], " ")
+		frame.File = location
+		if i := strings.LastIndexByte(location, ':'); i >= 0 {
+			if line, err := strconv.Atoi(location[i+1:]); err == nil {
+				frame.File, frame.Line = location[:i], line
+			}
+		}
+	}
+	return depth, frame, true
+}
+
+// parseComment records the request info comment and skips any others
+func (s *Scanner) parseComment(comment string) {
+	fields := strings.Fields(strings.TrimPrefix(comment, "#"))
+	if len(fields) < 2 {
+		return
+	}
+	timestamp, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return
+	}
+	parts := make([]string, 5)
+	for i := range parts {
+		if i+1 < len(fields) && fields[i+1] != "-" {
+			parts[i] = fields[i+1]
+		}
+	}
+	seconds, fraction := math.Modf(timestamp)
+	s.current.Request = &Request{
+		Time:   time.Unix(int64(seconds), int64(fraction*1e9)).UTC(),
+		URI:    parts[0],
+		Query:  parts[1],
+		Path:   parts[2],
+		Cookie: parts[3],
+		Method: parts[4],
+	}
+}
+
+// flush completes the current trace, traces without any frames are dropped
+func (s *Scanner) flush() {
+	if len(s.current.Frames) > 0 {
+		s.done = append(s.done, s.current)
+	}
+	s.current = Trace{}
+}
@@ -0,0 +1,90 @@
+package phpspy
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scanAll(t *testing.T, scanner *Scanner) []Trace {
+	var traces []Trace
+	for scanner.Scan() {
+		traces = append(traces, scanner.Trace())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return traces
+}
+
+func TestScanner(t *testing.T) {
+	for _, fixture := range []string{"phpspy.trace", "phpspy-single-line.trace"} {
+		t.Run(fixture, func(t *testing.T) {
+			file, err := os.Open("testdata/" + fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			traces := scanAll(t, NewScanner(file))
+			if len(traces) != 5 {
+				t.Fatalf("expected 5 traces, instead got %d: %+v", len(traces), traces)
+			}
+
+			expectedFrames := []Frame{
+				{Function: "PDOStatement::execute", File: "<internal>", Line: -1},
+				{Function: "App\\Repositories\\ReportRepository::all", File: "/var/www/app/Repositories/ReportRepository.php", Line: 18},
+				{Function: "App\\Http\\Controllers\\ReportController::index", File: "/var/www/app/Http/Controllers/ReportController.php", Line: 40},
+				{Function: "Illuminate\\Routing\\Controller::callAction", File: "/var/www/vendor/laravel/framework/src/Illuminate/Routing/Controller.php", Line: 54},
+				{Function: "<main>", File: "/var/www/public/index.php", Line: 55},
+			}
+			if !reflect.DeepEqual(traces[1].Frames, expectedFrames) {
+				t.Errorf("expected frames %+v, instead got %+v", expectedFrames, traces[1].Frames)
+			}
+			expectedRequest := &Request{
+				Time:   time.Unix(1597152000, 133512000).UTC(),
+				URI:    "/reports?page=2",
+				Query:  "page=2",
+				Path:   "/var/www/public/index.php",
+				Method: "GET",
+			}
+			if request := traces[1].Request; request == nil || request.URI != expectedRequest.URI ||
+				request.Query != expectedRequest.Query || request.Path != expectedRequest.Path ||
+				request.Cookie != "" || request.Method != expectedRequest.Method ||
+				request.Time.Sub(expectedRequest.Time).Round(time.Millisecond) != 0 {
+				t.Errorf("expected request %+v, instead got %+v", expectedRequest, traces[1].Request)
+			}
+			if request := traces[2].Request; request == nil || request.URI != "/reports/export" || request.Query != "" || request.Method != "POST" {
+				t.Errorf("unexpected request %+v", traces[2].Request)
+			}
+			if traces[3].Request != nil || traces[4].Request != nil {
+				t.Errorf("expected traces without request info not to have a request: %+v %+v", traces[3].Request, traces[4].Request)
+			}
+		})
+	}
+}
+
+func TestScannerWithoutSeparators(t *testing.T) {
+	// a trace file that's still being written may not end with a blank line, and traces start again at depth 0
+	traces := scanAll(t, NewScanner(strings.NewReader("0 a /a.php:1\n1 <main> /a.php:2\n0 b\n1 <main> /a.php:3")))
+	if len(traces) != 2 || traces[0].Frames[0].Function != "a" || traces[1].Frames[0].Function != "b" {
+		t.Fatalf("expected 2 traces, instead got %+v", traces)
+	}
+	if frame := traces[1].Frames[0]; frame.File != "" || frame.Line != -1 {
+		t.Errorf("expected a frame without a location to have no file or line, instead got %+v", frame)
+	}
+}
+
+func TestScannerSingleLineCommentValues(t *testing.T) {
+	// the peeked variable's value looks like request info once split on "; "
+	line := "0 a /a.php:1; # 1597152000.5 /a - /a.php - GET; # varpeek $x@/a.php:1 = b; 1597152001 /b - /b.php - POST\n"
+	traces := scanAll(t, NewScanner(strings.NewReader(line)))
+	if len(traces) != 1 || traces[0].Request == nil {
+		t.Fatalf("expected a trace with a request, instead got %+v", traces)
+	}
+	if request := traces[0].Request; request.URI != "/a" || request.Method != "GET" {
+		t.Errorf("expected the request info comment to be kept, instead got %+v", request)
+	}
+}
@@ -0,0 +1,253 @@
+package pprof
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/daniel-cole/phunter/flamegraph"
+	"github.com/daniel-cole/phunter/phpspy"
+	"io"
+	"strings"
+	"time"
+)
+
+// FileSuffix is appended to the trace file name to give the name of the profile written alongside it
+const FileSuffix = ".pb.gz"
+
+// Options describes when the trace was taken
+type Options struct {
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Profile is a pprof profile of the samples in a trace, see
+// https://github.com/google/pprof/blob/master/proto/profile.proto
+type Profile struct {
+	options Options
+
+	strings     []string
+	stringIndex map[string]int64
+
+	functions     []function
+	functionIndex map[function]uint64
+
+	locations     []location
+	locationIndex map[location]uint64
+
+	samples     []sample
+	sampleIndex map[string]int
+}
+
+// function and location are keyed by value, their IDs are their index in the profile plus one
+type function struct {
+	name, filename int64
+}
+
+type location struct {
+	function uint64
+	line     int64
+}
+
+type sample struct {
+	locations []uint64 // innermost first
+	count     int64
+	labels    []label
+}
+
+type label struct {
+	key, value int64
+}
+
+// Convert reads a trace in the format recorded in its metadata into a profile
+func Convert(format string, r io.Reader, options Options) (*Profile, error) {
+	p := newProfile(options)
+	switch format {
+	case "phpspy":
+		scanner := phpspy.NewScanner(r)
+		for scanner.Scan() {
+			trace := scanner.Trace()
+			var labels []label
+			if request := trace.Request; request != nil {
+				if uri := strings.SplitN(request.URI, "?", 2)[0]; uri != "" {
+					labels = append(labels, p.label("request_uri", uri))
+				}
+				if request.Method != "" {
+					labels = append(labels, p.label("request_method", request.Method))
+				}
+			}
+			p.add(trace.Frames, 1, labels)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case "collapsed":
+		stacks, err := flamegraph.ParseFolded(r)
+		if err != nil {
+			return nil, err
+		}
+		for stack, count := range stacks {
+			p.add(flamegraph.StackFrames(stack), int64(count), nil)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", flamegraph.ErrUnsupportedFormat, format)
+	}
+	if len(p.samples) == 0 {
+		return nil, flamegraph.ErrNoSamples
+	}
+	return p, nil
+}
+
+func newProfile(options Options) *Profile {
+	p := &Profile{
+		options:       options,
+		stringIndex:   make(map[string]int64),
+		functionIndex: make(map[function]uint64),
+		locationIndex: make(map[location]uint64),
+		sampleIndex:   make(map[string]int),
+	}
+	// the string table must start with the empty string
+	p.string("")
+	return p
+}
+
+func (p *Profile) string(s string) int64 {
+	i, ok := p.stringIndex[s]
+	if !ok {
+		i = int64(len(p.strings))
+		p.strings = append(p.strings, s)
+		p.stringIndex[s] = i
+	}
+	return i
+}
+
+func (p *Profile) label(key, value string) label {
+	return label{key: p.string(key), value: p.string(value)}
+}
+
+func (p *Profile) location(frame phpspy.Frame) uint64 {
+	f := function{name: p.string(frame.Function), filename: p.string(frame.File)}
+	functionID, ok := p.functionIndex[f]
+	if !ok {
+		p.functions = append(p.functions, f)
+		functionID = uint64(len(p.functions))
+		p.functionIndex[f] = functionID
+	}
+	l := location{function: functionID}
+	if frame.Line > 0 {
+		l.line = int64(frame.Line)
+	}
+	locationID, ok := p.locationIndex[l]
+	if !ok {
+		p.locations = append(p.locations, l)
+		locationID = uint64(len(p.locations))
+		p.locationIndex[l] = locationID
+	}
+	return locationID
+}
+
+// add counts a stack sampled count times, samples of the same stack with the same labels are merged
+func (p *Profile) add(frames []phpspy.Frame, count int64, labels []label) {
+	if len(frames) == 0 {
+		return
+	}
+	locations := make([]uint64, len(frames))
+	var key strings.Builder
+	for i, frame := range frames {
+		locations[i] = p.location(frame)
+		fmt.Fprintf(&key, "%d,", locations[i])
+	}
+	for _, l := range labels {
+		fmt.Fprintf(&key, ";%d=%d", l.key, l.value)
+	}
+	if i, ok := p.sampleIndex[key.String()]; ok {
+		p.samples[i].count += count
+		return
+	}
+	p.sampleIndex[key.String()] = len(p.samples)
+	p.samples = append(p.samples, sample{locations: locations, count: count, labels: labels})
+}
+
+// Samples returns the number of samples in the profile
+func (p *Profile) Samples() int64 {
+	var total int64
+	for _, s := range p.samples {
+		total += s.count
+	}
+	return total
+}
+
+// Write writes the profile gzipped, as go tool pprof expects
+func (p *Profile) Write(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(p.encode()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (p *Profile) encode() []byte {
+	samplesType := p.string("samples")
+	countUnit := p.string("count")
+	mappingFile := p.string("php")
+
+	var e encoder
+	// sample_type
+	e.message(1, func(e *encoder) {
+		e.int64(1, samplesType)
+		e.int64(2, countUnit)
+	})
+	for _, s := range p.samples {
+		// sample
+		e.message(2, func(e *encoder) {
+			e.packedUint64(1, s.locations)
+			e.packedInt64(2, []int64{s.count})
+			for _, l := range s.labels {
+				e.message(3, func(e *encoder) {
+					e.int64(1, l.key)
+					e.int64(2, l.value)
+				})
+			}
+		})
+	}
+	// a single mapping tells pprof the functions, files and lines are already symbolized
+	e.message(3, func(e *encoder) {
+		e.uint64(1, 1)
+		e.int64(5, mappingFile)
+		e.bool(7, true)
+		e.bool(8, true)
+		e.bool(9, true)
+	})
+	for i, l := range p.locations {
+		// location
+		e.message(4, func(e *encoder) {
+			e.uint64(1, uint64(i+1))
+			e.uint64(2, 1)
+			e.message(4, func(e *encoder) {
+				e.uint64(1, l.function)
+				e.int64(2, l.line)
+			})
+		})
+	}
+	for i, f := range p.functions {
+		// function
+		e.message(5, func(e *encoder) {
+			e.uint64(1, uint64(i+1))
+			e.int64(2, f.name)
+			e.int64(3, f.name)
+			e.int64(4, f.filename)
+		})
+	}
+	for _, s := range p.strings {
+		e.string(6, s)
+	}
+	if !p.options.Start.IsZero() {
+		e.int64(9, p.options.Start.UnixNano())
+	}
+	e.int64(10, p.options.Duration.Nanoseconds())
+	// period_type and period
+	e.message(11, func(e *encoder) {
+		e.int64(1, samplesType)
+		e.int64(2, countUnit)
+	})
+	e.int64(12, 1)
+	return e.buf
+}
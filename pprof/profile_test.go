@@ -0,0 +1,327 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/flamegraph"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decoded is the subset of a profile checked by the tests, read back with a minimal protobuf decoder
+type decoded struct {
+	strings     []string
+	sampleTypes [][2]int64
+	samples     []decodedSample
+	locations   map[uint64][2]uint64 // id -> function id, line
+	functions   map[uint64][2]int64  // id -> name, filename
+	mappings    int
+	timeNanos   int64
+	duration    int64
+	period      int64
+}
+
+type decodedSample struct {
+	locations []uint64
+	values    []int64
+	labels    [][2]int64
+}
+
+type field struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+func readVarint(b []byte) (uint64, []byte, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if len(b) == 0 {
+			return 0, nil, errors.New("truncated varint")
+		}
+		c := b[0]
+		b = b[1:]
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, b, nil
+		}
+	}
+	return 0, nil, errors.New("varint overflow")
+}
+
+func readFields(b []byte) ([]field, error) {
+	var fields []field
+	for len(b) > 0 {
+		key, rest, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		f := field{number: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value, rest, err = readVarint(rest)
+		case wireBytes:
+			var n uint64
+			n, rest, err = readVarint(rest)
+			if err == nil && n > uint64(len(rest)) {
+				err = errors.New("truncated field")
+			}
+			if err == nil {
+				f.bytes, rest = rest[:n], rest[n:]
+			}
+		default:
+			err = fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+		b = rest
+	}
+	return fields, nil
+}
+
+func readPacked(b []byte) ([]uint64, error) {
+	var vs []uint64
+	for len(b) > 0 {
+		v, rest, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+		b = rest
+	}
+	return vs, nil
+}
+
+func mustFields(t *testing.T, b []byte) []field {
+	t.Helper()
+	fields, err := readFields(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func decode(t *testing.T, data []byte) decoded {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := decoded{locations: make(map[uint64][2]uint64), functions: make(map[uint64][2]int64)}
+	for _, f := range mustFields(t, raw) {
+		switch f.number {
+		case 1:
+			var st [2]int64
+			for _, sf := range mustFields(t, f.bytes) {
+				st[sf.number-1] = int64(sf.value)
+			}
+			d.sampleTypes = append(d.sampleTypes, st)
+		case 2:
+			var s decodedSample
+			for _, sf := range mustFields(t, f.bytes) {
+				switch sf.number {
+				case 1:
+					s.locations, err = readPacked(sf.bytes)
+				case 2:
+					var values []uint64
+					values, err = readPacked(sf.bytes)
+					for _, v := range values {
+						s.values = append(s.values, int64(v))
+					}
+				case 3:
+					var l [2]int64
+					for _, lf := range mustFields(t, sf.bytes) {
+						l[lf.number-1] = int64(lf.value)
+					}
+					s.labels = append(s.labels, l)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			d.samples = append(d.samples, s)
+		case 3:
+			d.mappings++
+		case 4:
+			var id uint64
+			var line [2]uint64
+			for _, lf := range mustFields(t, f.bytes) {
+				switch lf.number {
+				case 1:
+					id = lf.value
+				case 4:
+					for _, linef := range mustFields(t, lf.bytes) {
+						line[linef.number-1] = linef.value
+					}
+				}
+			}
+			d.locations[id] = line
+		case 5:
+			var id uint64
+			var fn [2]int64
+			for _, ff := range mustFields(t, f.bytes) {
+				switch ff.number {
+				case 1:
+					id = ff.value
+				case 2:
+					fn[0] = int64(ff.value)
+				case 4:
+					fn[1] = int64(ff.value)
+				}
+			}
+			d.functions[id] = fn
+		case 6:
+			d.strings = append(d.strings, string(f.bytes))
+		case 9:
+			d.timeNanos = int64(f.value)
+		case 10:
+			d.duration = int64(f.value)
+		case 12:
+			d.period = int64(f.value)
+		}
+	}
+	return d
+}
+
+// stack returns a sample's frames innermost first as "function file:line"
+func (d decoded) stack(s decodedSample) []string {
+	frames := make([]string, len(s.locations))
+	for i, id := range s.locations {
+		location := d.locations[id]
+		function := d.functions[location[0]]
+		frames[i] = fmt.Sprintf("%s %s:%d", d.strings[function[0]], d.strings[function[1]], location[1])
+	}
+	return frames
+}
+
+func (d decoded) labels(s decodedSample) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range s.labels {
+		labels[d.strings[l[0]]] = d.strings[l[1]]
+	}
+	return labels
+}
+
+func convertFixture(t *testing.T, name string, options Options) decoded {
+	t.Helper()
+	file, err := os.Open("../phpspy/testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	profile, err := Convert("phpspy", file, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Samples() != 5 {
+		t.Errorf("expected 5 samples, instead got %d", profile.Samples())
+	}
+	var out bytes.Buffer
+	if err := profile.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	return decode(t, out.Bytes())
+}
+
+func TestConvertPHPSpy(t *testing.T) {
+	start := time.Unix(1597152000, 0)
+	for _, fixture := range []string{"phpspy.trace", "phpspy-single-line.trace"} {
+		t.Run(fixture, func(t *testing.T) {
+			d := convertFixture(t, fixture, Options{Start: start, Duration: 30 * time.Second})
+
+			if len(d.strings) == 0 || d.strings[0] != "" {
+				t.Fatalf("expected the string table to start with the empty string, instead got %q", d.strings)
+			}
+			if len(d.sampleTypes) != 1 || d.strings[d.sampleTypes[0][0]] != "samples" || d.strings[d.sampleTypes[0][1]] != "count" {
+				t.Errorf("expected a samples/count sample type, instead got %v", d.sampleTypes)
+			}
+			if d.mappings != 1 || d.period != 1 || d.timeNanos != start.UnixNano() || d.duration != int64(30*time.Second) {
+				t.Errorf("unexpected mappings %d, period %d, time %d or duration %d", d.mappings, d.period, d.timeNanos, d.duration)
+			}
+
+			// the usleep stack was sampled 3 times, twice with different requests and once without
+			if len(d.samples) != 5 {
+				t.Fatalf("expected 5 samples, instead got %d", len(d.samples))
+			}
+			expectedStack := []string{
+				"PDOStatement::execute <internal>:0",
+				"App\\Repositories\\ReportRepository::all /var/www/app/Repositories/ReportRepository.php:18",
+				"App\\Http\\Controllers\\ReportController::index /var/www/app/Http/Controllers/ReportController.php:40",
+				"Illuminate\\Routing\\Controller::callAction /var/www/vendor/laravel/framework/src/Illuminate/Routing/Controller.php:54",
+				"<main> /var/www/public/index.php:55",
+			}
+			if stack := d.stack(d.samples[1]); !reflect.DeepEqual(stack, expectedStack) {
+				t.Errorf("expected stack %q, instead got %q", expectedStack, stack)
+			}
+			expectedLabels := map[string]string{"request_uri": "/reports", "request_method": "GET"}
+			if labels := d.labels(d.samples[1]); !reflect.DeepEqual(labels, expectedLabels) {
+				t.Errorf("expected labels %v, instead got %v", expectedLabels, labels)
+			}
+			if labels := d.labels(d.samples[2]); labels["request_uri"] != "/reports/export" || labels["request_method"] != "POST" {
+				t.Errorf("unexpected labels %v", labels)
+			}
+			if len(d.samples[3].labels) != 0 {
+				t.Errorf("expected a sample without request info to have no labels, instead got %v", d.labels(d.samples[3]))
+			}
+			for i, s := range d.samples {
+				if !reflect.DeepEqual(s.values, []int64{1}) {
+					t.Errorf("expected sample %d to have a count of 1, instead got %v", i, s.values)
+				}
+			}
+			// the ReportController::index function is shared by the locations of lines 40 and 42
+			if len(d.functions) != 7 || len(d.locations) != 8 {
+				t.Errorf("expected 7 functions and 8 locations, instead got %d and %d", len(d.functions), len(d.locations))
+			}
+		})
+	}
+}
+
+func TestConvertMergesSamples(t *testing.T) {
+	folded := "main (app.py:10);handle (app.py:20) 3\nmain (app.py:10);handle (app.py:20) 2\nmain (app.py:10) 1\n"
+	profile, err := Convert("collapsed", strings.NewReader(folded), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := profile.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	d := decode(t, out.Bytes())
+	counts := make(map[string]int64)
+	for _, s := range d.samples {
+		counts[strings.Join(d.stack(s), ";")] += s.values[0]
+	}
+	expected := map[string]int64{
+		"handle app.py:20;main app.py:10": 5,
+		"main app.py:10":                  1,
+	}
+	if !reflect.DeepEqual(counts, expected) || len(d.samples) != 2 {
+		t.Errorf("expected samples %v, instead got %v", expected, counts)
+	}
+	if d.timeNanos != 0 {
+		t.Errorf("expected no start time, instead got %d", d.timeNanos)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	if _, err := Convert("phpspy", strings.NewReader("# only comments\n\n"), Options{}); !errors.Is(err, flamegraph.ErrNoSamples) {
+		t.Errorf("expected ErrNoSamples, instead got %v", err)
+	}
+	if _, err := Convert("json", strings.NewReader(""), Options{}); !errors.Is(err, flamegraph.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, instead got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package pprof
+
+// encoder writes the protocol buffer wire format, only the types used by profile.proto are supported
+// see https://developers.google.com/protocol-buffers/docs/encoding
+type encoder struct {
+	buf []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (e *encoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.buf = append(e.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint64 writes a field, leaving it out when it's the default of 0
+func (e *encoder) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.varint(v)
+}
+
+// int64 writes a field, negative numbers are written as their two's complement like protobuf does
+func (e *encoder) int64(field int, v int64) {
+	e.uint64(field, uint64(v))
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if v {
+		e.uint64(field, 1)
+	}
+}
+
+// string writes a field even when empty, as the string table must start with an empty string
+func (e *encoder) string(field int, s string) {
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) packedUint64(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed encoder
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	e.bytes(field, packed.buf)
+}
+
+func (e *encoder) packedInt64(field int, vs []int64) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed encoder
+	for _, v := range vs {
+		packed.varint(uint64(v))
+	}
+	e.bytes(field, packed.buf)
+}
+
+// message writes an embedded message encoded by f
+func (e *encoder) message(field int, f func(e *encoder)) {
+	var m encoder
+	f(&m)
+	e.bytes(field, m.buf)
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, wireBytes)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
@@ -0,0 +1,145 @@
+package process
+
+import (
+	"sync"
+	"time"
+)
+
+// Sample is the CPU and RSS of a process measured by a check
+type Sample struct {
+	Time time.Time
+	CPU  float64 // utilisation as a percentage of a single CPU since the previous check
+	RSS  int64   // resident memory in KiB
+}
+
+// Value returns the value of the sample compared to the threshold of a threshold type
+func (s Sample) Value(thresholdType string) float64 {
+	if thresholdType == ThresholdTypeRSS {
+		return float64(s.RSS)
+	}
+	return s.CPU
+}
+
+// History is a ring buffer of the most recent samples of a process
+type History struct {
+	mu      sync.Mutex
+	samples []Sample
+	next    int // where the next sample is written
+	full    bool
+}
+
+// NewHistory returns a history that keeps the last size samples
+func NewHistory(size int) *History {
+	if size < 1 {
+		size = 1
+	}
+	return &History{samples: make([]Sample, size)}
+}
+
+// Add records a sample, replacing the oldest sample once the history is full
+func (h *History) Add(sample Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Samples returns the samples in the history, oldest first
+func (h *History) Samples() []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]Sample(nil), h.samples[:h.next]...)
+	}
+	return append(append([]Sample(nil), h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// Size returns how many samples the history keeps
+func (h *History) Size() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.samples)
+}
+
+// Reset forgets every sample, e.g. once the process has been traced so a new window is needed to trace it again
+func (h *History) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next = 0
+	h.full = false
+}
+
+// resize returns a history of the new size keeping the most recent samples
+func (h *History) resize(size int) *History {
+	resized := NewHistory(size)
+	for _, sample := range h.Samples() {
+		resized.Add(sample)
+	}
+	return resized
+}
+
+// Tracker keeps the sample history of each process checked between checks, keyed by target and PID
+type Tracker struct {
+	mu        sync.Mutex
+	processes map[trackerKey]*tracked
+}
+
+type trackerKey struct {
+	target string
+	pid    int
+}
+
+type tracked struct {
+	process ProcessInterface
+	start   uint64 // start time of the process in clock ticks, 0 when it isn't known
+	history *History
+}
+
+// NewTracker returns a tracker without any processes
+func NewTracker() *Tracker {
+	return &Tracker{processes: make(map[trackerKey]*tracked)}
+}
+
+// Track records that a process is being checked for a target, returning its history sized to keep size samples
+// the CPU sample of the previous check is carried over so GetCPU returns the utilisation since that check
+// the history starts again when the PID has been reused by a process with a different start time
+func (t *Tracker) Track(target string, p ProcessInterface, size int) *History {
+	start := uint64(0)
+	if current, ok := p.(*Process); ok {
+		start = current.startTime()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := trackerKey{target: target, pid: p.GetID()}
+	entry, ok := t.processes[key]
+	if !ok || entry.start != start {
+		entry = &tracked{start: start, history: NewHistory(size)}
+		t.processes[key] = entry
+	} else {
+		if current, ok := p.(*Process); ok {
+			previous, _ := entry.process.(*Process)
+			current.follow(previous)
+		}
+		if entry.history.Size() != size {
+			// the trigger windows were changed by a reload
+			entry.history = entry.history.resize(size)
+		}
+	}
+	entry.process = p
+	return entry.history
+}
+
+// Retain forgets the processes keep returns false for, e.g. the processes that have exited
+func (t *Tracker) Retain(keep func(target string, pid int) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.processes {
+		if !keep(key.target, key.pid) {
+			delete(t.processes, key)
+		}
+	}
+}
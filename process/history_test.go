@@ -0,0 +1,110 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func cpuValues(samples []Sample) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.CPU
+	}
+	return values
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	if samples := h.Samples(); len(samples) != 0 {
+		t.Fatalf("expected an empty history, instead got %+v", samples)
+	}
+	for _, cpu := range []float64{1, 2} {
+		h.Add(Sample{CPU: cpu})
+	}
+	if values := cpuValues(h.Samples()); !reflect.DeepEqual(values, []float64{1, 2}) {
+		t.Errorf("expected the samples oldest first, instead got %v", values)
+	}
+	for _, cpu := range []float64{3, 4, 5} {
+		h.Add(Sample{CPU: cpu})
+	}
+	if values := cpuValues(h.Samples()); !reflect.DeepEqual(values, []float64{3, 4, 5}) {
+		t.Errorf("expected the oldest samples to be replaced, instead got %v", values)
+	}
+
+	h.Reset()
+	h.Add(Sample{CPU: 6})
+	if values := cpuValues(h.Samples()); !reflect.DeepEqual(values, []float64{6}) {
+		t.Errorf("expected the samples before the reset to be forgotten, instead got %v", values)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	first := &Process{ID: 42, lastCPU: &cpuSample{ticks: 100}}
+	history := tracker.Track("php", first, 3)
+	history.Add(Sample{CPU: 1})
+	history.Add(Sample{CPU: 2})
+
+	// each check creates a new process which carries on from the previous check
+	second := &Process{ID: 42}
+	if tracker.Track("php", second, 3) != history {
+		t.Error("expected the same history for the process on the next check")
+	}
+	if second.lastCPU == nil || second.lastCPU.ticks != 100 {
+		t.Errorf("expected the CPU sample of the previous check to be carried over, instead got %+v", second.lastCPU)
+	}
+	if other := tracker.Track("python", &Process{ID: 42}, 3); other == history {
+		t.Error("expected each target to have its own history")
+	}
+
+	// a reload changing the trigger windows keeps the most recent samples
+	resized := tracker.Track("php", &Process{ID: 42}, 1)
+	if values := cpuValues(resized.Samples()); !reflect.DeepEqual(values, []float64{2}) {
+		t.Errorf("expected the resized history to keep the most recent sample, instead got %v", values)
+	}
+
+	tracker.Retain(func(target string, pid int) bool { return target == "python" })
+	if samples := tracker.Track("php", &Process{ID: 42}, 1).Samples(); len(samples) != 0 {
+		t.Errorf("expected the history of a forgotten process to start again, instead got %+v", samples)
+	}
+}
+
+func TestTrackerPIDReused(t *testing.T) {
+	root, err := ioutil.TempDir("", "phunter-procfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "10"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeStat := func(start int) {
+		stat := fmt.Sprintf("10 (php) R 1 1 1 0 -1 0 0 0 0 0 100 0 0 0 20 0 1 0 %d 0 0 0\n", start)
+		if err := ioutil.WriteFile(filepath.Join(root, "10", "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := NewTracker()
+	writeStat(5000)
+	history := tracker.Track("php", &Process{ID: 10, FS: testProcFS(root)}, 3)
+	history.Add(Sample{RSS: 1048576})
+	history.Add(Sample{RSS: 1048576})
+	if samples := tracker.Track("php", &Process{ID: 10, FS: testProcFS(root)}, 3).Samples(); len(samples) != 2 {
+		t.Fatalf("expected the history to be kept for the same process, instead got %+v", samples)
+	}
+
+	// the process exited and a new one started with the same PID before the next check
+	writeStat(9000)
+	reused := &Process{ID: 10, FS: testProcFS(root)}
+	if samples := tracker.Track("php", reused, 3).Samples(); len(samples) != 0 {
+		t.Errorf("expected the history to start again for a reused PID, instead got %+v", samples)
+	}
+	if reused.lastCPU != nil {
+		t.Errorf("expected the CPU sample of the previous process not to be carried over, instead got %+v", reused.lastCPU)
+	}
+}
@@ -0,0 +1,135 @@
+package process
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os/user"
+	"regexp"
+	"strconv"
+)
+
+// Matcher selects processes to check by inspecting procfs
+// every criteria that is set must match for a process to be selected
+type Matcher struct {
+	Comm    string `yaml:"comm"`    // regular expression matched against the process name, the same as pgrep
+	Cmdline string `yaml:"cmdline"` // regular expression matched against the full command line e.g. "^php-fpm: pool www"
+	Exe     string `yaml:"exe"`     // absolute path of the executable the process is running
+	PPID    int    `yaml:"ppid"`    // parent process ID
+	User    string `yaml:"user"`    // user name or UID the process is running as
+}
+
+type compiledMatcher struct {
+	comm    *regexp.Regexp
+	cmdline *regexp.Regexp
+	exe     string
+	ppid    int
+	uid     int
+}
+
+func (m Matcher) compile() (*compiledMatcher, error) {
+	c := &compiledMatcher{exe: m.Exe, ppid: m.PPID, uid: -1}
+	var err error
+	if m.Comm != "" {
+		if c.comm, err = regexp.Compile(m.Comm); err != nil {
+			return nil, fmt.Errorf("invalid comm pattern %q: %v", m.Comm, err)
+		}
+	}
+	if m.Cmdline != "" {
+		if c.cmdline, err = regexp.Compile(m.Cmdline); err != nil {
+			return nil, fmt.Errorf("invalid cmdline pattern %q: %v", m.Cmdline, err)
+		}
+	}
+	if m.User != "" {
+		if c.uid, err = lookupUID(m.User); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Validate checks that the patterns compile and the user exists
+func (m Matcher) Validate() error {
+	_, err := m.compile()
+	return err
+}
+
+// lookupUID resolves a user name to a UID, numeric values are treated as a UID as-is
+func lookupUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, fmt.Errorf("failed to find user %s: %v", name, err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func (c *compiledMatcher) match(fs *ProcFS, pid int) (bool, error) {
+	if c.comm != nil || c.ppid > 0 {
+		stat, err := fs.Stat(pid)
+		if err != nil {
+			return false, err
+		}
+		if c.comm != nil && !c.comm.MatchString(stat.Comm) {
+			return false, nil
+		}
+		if c.ppid > 0 && stat.PPID != c.ppid {
+			return false, nil
+		}
+	}
+	if c.uid >= 0 {
+		status, err := fs.Status(pid)
+		if err != nil {
+			return false, err
+		}
+		if status.UID != c.uid {
+			return false, nil
+		}
+	}
+	if c.cmdline != nil {
+		cmdline, err := fs.Cmdline(pid)
+		if err != nil {
+			return false, err
+		}
+		if !c.cmdline.MatchString(cmdline) {
+			return false, nil
+		}
+	}
+	if c.exe != "" {
+		exe, err := fs.Exe(pid)
+		if err != nil {
+			return false, err
+		}
+		if exe != c.exe {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// FindPIDs returns the IDs of all processes that satisfy the matcher
+// an empty list is returned when no processes match
+func (fs *ProcFS) FindPIDs(m Matcher) ([]int, error) {
+	c, err := m.compile()
+	if err != nil {
+		return nil, err
+	}
+	pids, err := fs.PIDs()
+	if err != nil {
+		return nil, err
+	}
+	pidList := []int{}
+	for _, pid := range pids {
+		matched, err := c.match(fs, pid)
+		if err != nil {
+			// processes regularly exit between listing and reading procfs so this isn't treated as a failure
+			logrus.WithField("pid", pid).Tracef("skipping process that could not be inspected: %v", err)
+			continue
+		}
+		if matched {
+			pidList = append(pidList, pid)
+		}
+	}
+	return pidList, nil
+}
@@ -0,0 +1,41 @@
+package process
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindPIDs(t *testing.T) {
+	fs := testProcFS("testdata/proc")
+
+	tests := []struct {
+		name     string
+		matcher  Matcher
+		expected []int
+	}{
+		{"comm", Matcher{Comm: "php-fpm"}, []int{4200, 4242, 4243}},
+		{"comm anchored", Matcher{Comm: "^nginx$"}, []int{5000}},
+		{"workers only", Matcher{Cmdline: "^php-fpm: pool www"}, []int{4242}},
+		{"all pools", Matcher{Comm: "php-fpm", Cmdline: "^php-fpm: pool "}, []int{4242, 4243}},
+		{"exe", Matcher{Exe: "/usr/sbin/php-fpm7.4"}, []int{4200, 4242, 4243}},
+		{"parent", Matcher{PPID: 4200}, []int{4242, 4243}},
+		{"user", Matcher{Comm: "php-fpm", User: "33"}, []int{4242}},
+		{"no match", Matcher{Comm: "python"}, []int{}},
+	}
+
+	for _, test := range tests {
+		pids, err := fs.FindPIDs(test.matcher)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(pids, test.expected) {
+			t.Errorf("%s: expected %v, instead got: %v", test.name, test.expected, pids)
+		}
+	}
+}
+
+func TestFindPIDsInvalidPattern(t *testing.T) {
+	if _, err := testProcFS("testdata/proc").FindPIDs(Matcher{Cmdline: "php-fpm: pool ("}); err == nil {
+		t.Error("expected an error for an invalid cmdline pattern")
+	}
+}
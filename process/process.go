@@ -3,57 +3,150 @@ package process
 import (
 	"errors"
 	"fmt"
-	"os/exec"
-	"strconv"
-	"strings"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
+// clock is replaced by a fake in tests
+var clock system.Clock = system.RealClock
+
+// ErrNoCPUSample is returned by GetCPU until there is a previous sample to measure the utilisation since
+var ErrNoCPUSample = errors.New("no previous CPU sample")
+
 type ProcessInterface interface {
 	GetCPU() (float64, error)
 	GetRSS() (int64, error)
 	GetID() int
 	PrintPIDResourceUsage() error
 	FindContainerName() (string, error)
+	FindContainer() (container.Info, error)
 }
 
 // Process represents a process running on the system
 type Process struct {
-	ID int
+	ID       int
+	FS       *ProcFS            // procfs to read process statistics from, /proc is used when nil
+	Resolver container.Resolver // finds the container the process is running in
+
+	mu      sync.Mutex
+	lastCPU *cpuSample // the previous CPU sample taken, used to calculate utilisation between samples
+}
+
+type cpuSample struct {
+	ticks  uint64  // utime + stime
+	uptime float64 // system uptime in seconds when the sample was taken
+	start  uint64  // start time of the process in clock ticks, which tells a reused PID apart
+}
+
+// follow carries over the CPU sample of a previous check of the process
+func (p *Process) follow(previous *Process) {
+	if previous == nil || previous == p {
+		return
+	}
+	previous.mu.Lock()
+	lastCPU := previous.lastCPU
+	previous.mu.Unlock()
+	p.mu.Lock()
+	p.lastCPU = lastCPU
+	p.mu.Unlock()
+}
+
+// startTime returns the start time of the process in clock ticks, 0 when it can't be read
+func (p *Process) startTime() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stat, err := p.procFS().Stat(p.ID)
+	if err != nil {
+		return 0
+	}
+	return stat.StartTime
+}
+
+// procFS returns the procfs to read the process from, p.mu must be held as it's set on first use
+func (p *Process) procFS() *ProcFS {
+	if p.FS == nil {
+		p.FS = NewProcFS(DefaultProcRoot)
+	}
+	return p.FS
 }
 
-// GetCPU returns the current CPU utilisation of the specified process
+// GetCPU returns the CPU utilisation of the specified process as a percentage of a single CPU since the previous call
+// the first call, or the first after the PID was reused, only takes a sample and returns ErrNoCPUSample
 func (p *Process) GetCPU() (float64, error) {
-	cmd := fmt.Sprintf("top -bp %d -n1 | awk '/%d/{print $9}'", p.ID, p.ID)
-	result, err := exec.Command("bash", "-c", cmd).Output()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fs := p.procFS()
+	stat, err := fs.Stat(p.ID)
 	if err != nil {
 		return -1, err
 	}
-	pidCPU, err := strconv.ParseFloat(tidyPSOutput(string(result)), 64)
+	uptime, err := fs.Uptime()
 	if err != nil {
-		return -1, errors.New(fmt.Sprintf("failed to parse process cpu, process probably dissapeared. error: %v", err))
+		return -1, err
 	}
-	return pidCPU, err
+
+	sample := &cpuSample{ticks: stat.UTime + stat.STime, uptime: uptime, start: stat.StartTime}
+	previous := p.lastCPU
+	p.lastCPU = sample
+	if previous == nil || sample.start != previous.start || sample.uptime <= previous.uptime || sample.ticks < previous.ticks {
+		return -1, ErrNoCPUSample
+	}
+
+	cpuSeconds := float64(sample.ticks-previous.ticks) / float64(fs.ClockTicks)
+	return cpuSeconds / (sample.uptime - previous.uptime) * 100, nil
 }
 
 // GetRSS returns the current resident memory in KiB of the specified process
 func (p *Process) GetRSS() (int64, error) {
-	result, err := exec.Command("ps", "-p", strconv.Itoa(p.ID), "-o", "rss=").Output()
-	if err != nil {
-		return -1, err
-	}
-	pidRSS, err := strconv.ParseInt(tidyPSOutput(string(result)), 10, 64)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fs := p.procFS()
+	statm, err := fs.StatM(p.ID)
 	if err != nil {
 		return -1, err
 	}
-	return pidRSS, err
+	return statm.Resident * fs.PageSize / 1024, nil
 }
 
 func (p *Process) GetID() int {
 	return p.ID
 }
 
+// FindContainer returns the container that the process is running in
+func (p *Process) FindContainer() (container.Info, error) {
+	if p.Resolver == nil {
+		return container.Info{}, errors.New("no container resolver configured")
+	}
+	logrus.WithField("pid", p.ID).Debugf("attempting to find container by ID")
+	info, err := p.Resolver.Resolve(p.ID)
+	if err != nil {
+		logrus.WithField("pid", p.ID).Errorf("failed to find container, %v", err)
+		return container.Info{}, err
+	}
+	return info, nil
+}
+
+// FindContainerName returns the name of the container that the process is running in
+func (p *Process) FindContainerName() (string, error) {
+	info, err := p.FindContainer()
+	if err != nil {
+		return "", err
+	}
+	return info.Name, nil
+}
+
 func (p *Process) PrintPIDResourceUsage() error {
 	cpu, err := p.GetCPU()
+	if errors.Is(err, ErrNoCPUSample) {
+		// measure the utilisation over the next second
+		<-clock.After(time.Second)
+		cpu, err = p.GetCPU()
+	}
 	if err != nil {
 		return err
 	}
@@ -65,27 +158,8 @@ func (p *Process) PrintPIDResourceUsage() error {
 	return nil
 }
 
-// GetPIDListByCommand returns the list of process IDs returned from the command
-// runs pgrep <command> on the system to obtain the list
+// GetPIDListByCommand returns the IDs of processes with a name matching the command pattern
+// the pattern is matched the same way as pgrep <command> but procfs is read directly
 func GetPIDListByCommand(command string) ([]int, error) {
-	result, err := exec.Command("pgrep", command).Output()
-	if err != nil {
-		return nil, err
-	}
-	// trim newline character on end
-	foundPIDs := strings.Split(strings.TrimRight(string(result), "\r\n"), "\n")
-	var pidList []int
-	for _, pidAsStr := range foundPIDs {
-		pidInt, err := strconv.Atoi(pidAsStr)
-		if err != nil {
-			return nil, err
-		}
-		pidList = append(pidList, pidInt)
-	}
-	return pidList, nil
-}
-
-// Remove any spaces and newline characters from output so it can be parsed into the appropriate primitive
-func tidyPSOutput(output string) string {
-	return strings.TrimLeft(strings.TrimRight(strings.TrimSpace(output), "\n"), "\n")
+	return NewProcFS(DefaultProcRoot).FindPIDs(Matcher{Comm: command})
 }
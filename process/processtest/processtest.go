@@ -0,0 +1,75 @@
+// Package processtest provides a process for tests of the packages that check and trace processes
+package processtest
+
+import (
+	"github.com/daniel-cole/phunter/container"
+	"sync"
+)
+
+// Process is a process for tests, it's above the default thresholds unless samples are scripted
+type Process struct {
+	ID int
+
+	// CPU and RSS are returned in turn by GetCPU and GetRSS, the last value is repeated once they run out
+	CPU []float64
+	RSS []int64
+	Err error // returned by GetCPU and GetRSS instead of a sample when set
+
+	mu       sync.Mutex
+	cpuCalls int
+	rssCalls int
+}
+
+func (p *Process) FindContainerName() (string, error) {
+	return "container", nil
+}
+
+func (p *Process) FindContainer() (container.Info, error) {
+	return container.Info{ID: "0123456789ab", Name: "container"}, nil
+}
+
+// GetCPU returns the next scripted CPU sample, 200 when none are scripted, or Err when it's set
+func (p *Process) GetCPU() (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return 0, p.Err
+	}
+	if len(p.CPU) == 0 {
+		return 200, nil
+	}
+	cpu := p.CPU[scripted(p.cpuCalls, len(p.CPU))]
+	p.cpuCalls++
+	return cpu, nil
+}
+
+// GetRSS returns the next scripted RSS sample in KiB, 1048576 when none are scripted, or Err when it's set
+func (p *Process) GetRSS() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return 0, p.Err
+	}
+	if len(p.RSS) == 0 {
+		return 1048576, nil
+	}
+	rss := p.RSS[scripted(p.rssCalls, len(p.RSS))]
+	p.rssCalls++
+	return rss, nil
+}
+
+// scripted returns the index of the scripted value for a call, repeating the last value
+func scripted(call, values int) int {
+	if call >= values {
+		return values - 1
+	}
+	return call
+}
+
+func (p *Process) GetID() int {
+	return p.ID
+}
+
+func (p *Process) PrintPIDResourceUsage() error {
+	return nil
+}
@@ -0,0 +1,278 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultProcRoot is where procfs is mounted on a standard linux system
+	DefaultProcRoot = "/proc"
+
+	// defaultClockTicks is USER_HZ, which is 100 on every architecture linux currently supports
+	defaultClockTicks = 100
+)
+
+// ProcFS reads process information directly from a procfs mount
+type ProcFS struct {
+	Root       string // where procfs is mounted, e.g. /proc or /host/proc
+	ClockTicks int64  // the unit utime, stime and starttime are reported in (USER_HZ)
+	PageSize   int64  // size of a memory page in bytes, used to convert statm pages into KiB
+}
+
+// Stat holds the fields phunter uses from /proc/[pid]/stat
+type Stat struct {
+	PID       int
+	Comm      string
+	State     string
+	PPID      int
+	UTime     uint64 // clock ticks spent in user mode
+	STime     uint64 // clock ticks spent in kernel mode
+	StartTime uint64 // clock ticks after system boot that the process started
+}
+
+// Status holds the fields phunter uses from /proc/[pid]/status
+type Status struct {
+	Name  string
+	PPID  int
+	UID   int   // real user ID
+	VmRSS int64 // resident set size in KiB
+}
+
+// StatM holds the memory usage from /proc/[pid]/statm measured in pages
+type StatM struct {
+	Size     int64
+	Resident int64
+	Shared   int64
+}
+
+// Info identifies a process, it's recorded in the trace metadata
+type Info struct {
+	Comm    string `json:"comm"`
+	Cmdline string `json:"cmdline"`
+	Exe     string `json:"exe,omitempty"` // not readable for processes phunter doesn't have ptrace access to
+	PPID    int    `json:"ppid"`
+	UID     int    `json:"uid"`
+	User    string `json:"user,omitempty"` // resolved using the users known to phunter, not the process's container
+}
+
+// NewProcFS returns a ProcFS rooted at root, falling back to DefaultProcRoot when root is empty
+func NewProcFS(root string) *ProcFS {
+	if root == "" {
+		root = DefaultProcRoot
+	}
+	return &ProcFS{
+		Root:       root,
+		ClockTicks: defaultClockTicks,
+		PageSize:   int64(os.Getpagesize()),
+	}
+}
+
+// Path returns the path to a file under /proc/[pid]
+func (fs *ProcFS) Path(pid int, name string) string {
+	return filepath.Join(fs.Root, strconv.Itoa(pid), name)
+}
+
+// Stat parses /proc/[pid]/stat
+func (fs *ProcFS) Stat(pid int) (Stat, error) {
+	data, err := fs.readPIDFile(pid, "stat")
+	if err != nil {
+		return Stat{}, err
+	}
+	return parseStat(string(data))
+}
+
+// Status parses /proc/[pid]/status
+func (fs *ProcFS) Status(pid int) (Status, error) {
+	data, err := fs.readPIDFile(pid, "status")
+	if err != nil {
+		return Status{}, err
+	}
+	return parseStatus(string(data))
+}
+
+// StatM parses /proc/[pid]/statm
+func (fs *ProcFS) StatM(pid int) (StatM, error) {
+	data, err := fs.readPIDFile(pid, "statm")
+	if err != nil {
+		return StatM{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return StatM{}, fmt.Errorf("unexpected statm format for pid %d: %q", pid, string(data))
+	}
+	var values [3]int64
+	for i := range values {
+		values[i], err = strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return StatM{}, fmt.Errorf("failed to parse statm for pid %d: %v", pid, err)
+		}
+	}
+	return StatM{Size: values[0], Resident: values[1], Shared: values[2]}, nil
+}
+
+// Cmdline returns the command line of the process with arguments separated by spaces
+// kernel threads and zombie processes have an empty command line
+func (fs *ProcFS) Cmdline(pid int) (string, error) {
+	data, err := fs.readPIDFile(pid, "cmdline")
+	if err != nil {
+		return "", err
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	return strings.Join(args, " "), nil
+}
+
+// Exe returns the path of the executable the process is running
+func (fs *ProcFS) Exe(pid int) (string, error) {
+	exe, err := os.Readlink(fs.Path(pid, "exe"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// Info returns the identity of the process
+func (fs *ProcFS) Info(pid int) (Info, error) {
+	stat, err := fs.Stat(pid)
+	if err != nil {
+		return Info{}, err
+	}
+	status, err := fs.Status(pid)
+	if err != nil {
+		return Info{}, err
+	}
+	cmdline, err := fs.Cmdline(pid)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Comm: stat.Comm, Cmdline: cmdline, PPID: stat.PPID, UID: status.UID}
+	if exe, err := fs.Exe(pid); err == nil {
+		info.Exe = exe
+	}
+	if u, err := user.LookupId(strconv.Itoa(status.UID)); err == nil {
+		info.User = u.Username
+	}
+	return info, nil
+}
+
+// PIDs returns the ID of every process currently visible in procfs
+func (fs *ProcFS) PIDs() ([]int, error) {
+	entries, err := ioutil.ReadDir(fs.Root)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// Uptime returns the number of seconds since the system booted from /proc/uptime
+func (fs *ProcFS) Uptime() (float64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(fs.Root, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("unexpected empty uptime")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func (fs *ProcFS) readPIDFile(pid int, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fs.Path(pid, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s for pid %d, process probably disappeared: %v", name, pid, err)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// parseStat parses the contents of /proc/[pid]/stat. The comm field is wrapped in parentheses and may itself
+// contain spaces or parentheses so the remaining fields are taken from after the last closing parenthesis
+func parseStat(data string) (Stat, error) {
+	start := strings.IndexByte(data, '(')
+	end := strings.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return Stat{}, fmt.Errorf("unexpected stat format: %q", data)
+	}
+
+	var stat Stat
+	var err error
+	stat.PID, err = strconv.Atoi(strings.TrimSpace(data[:start]))
+	if err != nil {
+		return Stat{}, fmt.Errorf("failed to parse stat pid: %v", err)
+	}
+	stat.Comm = data[start+1 : end]
+
+	// fields are numbered from 3 (state) onwards in proc(5)
+	fields := strings.Fields(data[end+1:])
+	if len(fields) < 20 {
+		return Stat{}, fmt.Errorf("unexpected number of stat fields: %d", len(fields))
+	}
+	stat.State = fields[0]
+	if stat.PPID, err = strconv.Atoi(fields[1]); err != nil {
+		return Stat{}, fmt.Errorf("failed to parse stat ppid: %v", err)
+	}
+	if stat.UTime, err = strconv.ParseUint(fields[11], 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("failed to parse stat utime: %v", err)
+	}
+	if stat.STime, err = strconv.ParseUint(fields[12], 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("failed to parse stat stime: %v", err)
+	}
+	if stat.StartTime, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("failed to parse stat starttime: %v", err)
+	}
+	return stat, nil
+}
+
+func parseStatus(data string) (Status, error) {
+	var status Status
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "Name":
+			status.Name = value
+		case "PPid":
+			status.PPID, err = strconv.Atoi(value)
+		case "Uid":
+			// real, effective, saved set and filesystem UIDs
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				status.UID, err = strconv.Atoi(fields[0])
+			}
+		case "VmRSS":
+			status.VmRSS, err = strconv.ParseInt(strings.TrimSuffix(value, " kB"), 10, 64)
+		}
+		if err != nil {
+			return Status{}, fmt.Errorf("failed to parse status field %s: %v", key, err)
+		}
+	}
+	return status, scanner.Err()
+}
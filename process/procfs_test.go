@@ -0,0 +1,165 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testProcFS(root string) *ProcFS {
+	fs := NewProcFS(root)
+	fs.PageSize = 4096
+	return fs
+}
+
+func TestProcFSStat(t *testing.T) {
+	stat, err := testProcFS("testdata/proc").Stat(4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Comm != "php-fpm: pool (www)" {
+		t.Errorf("unexpected comm: %q", stat.Comm)
+	}
+	if stat.PPID != 4200 || stat.UTime != 2500 || stat.STime != 500 || stat.StartTime != 72794 {
+		t.Errorf("unexpected stat: %+v", stat)
+	}
+}
+
+func TestProcFSStatus(t *testing.T) {
+	status, err := testProcFS("testdata/proc").Status(4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Status{Name: "php-fpm", PPID: 4200, UID: 33, VmRSS: 30720}
+	if status != expected {
+		t.Errorf("expected status %+v, instead got: %+v", expected, status)
+	}
+}
+
+func TestProcFSInfo(t *testing.T) {
+	info, err := testProcFS("testdata/proc").Info(4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Comm != "php-fpm: pool (www)" || info.PPID != 4200 || info.UID != 33 || info.Exe != "/usr/sbin/php-fpm7.4" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.Cmdline != "php-fpm: pool www" {
+		t.Errorf("unexpected cmdline: %q", info.Cmdline)
+	}
+}
+
+func TestProcessGetRSS(t *testing.T) {
+	p := &Process{ID: 4242, FS: testProcFS("testdata/proc")}
+	rss, err := p.GetRSS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss != 30720 {
+		t.Errorf("expected RSS to be 30720 KiB, instead got: %d", rss)
+	}
+}
+
+func TestProcessGetCPUFirstSample(t *testing.T) {
+	p := &Process{ID: 4242, FS: testProcFS("testdata/proc")}
+	// the average since the process started isn't returned as the current utilisation
+	if _, err := p.GetCPU(); !errors.Is(err, ErrNoCPUSample) {
+		t.Errorf("expected no CPU sample on the first call, instead got: %v", err)
+	}
+	if p.lastCPU == nil || p.lastCPU.ticks != 3000 {
+		t.Errorf("expected the first call to take a sample, instead got %+v", p.lastCPU)
+	}
+}
+
+func TestProcessGetCPUBetweenSamples(t *testing.T) {
+	root, err := ioutil.TempDir("", "phunter-procfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "10"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSample := func(uptime float64, utime, stime int) {
+		stat := fmt.Sprintf("10 (php) R 1 1 1 0 -1 0 0 0 0 0 %d %d 0 0 20 0 1 0 0 0 0 0\n", utime, stime)
+		if err := ioutil.WriteFile(filepath.Join(root, "10", "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "uptime"), []byte(fmt.Sprintf("%.2f 0.00\n", uptime)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Process{ID: 10, FS: testProcFS(root)}
+	writeSample(100, 100, 0)
+	if _, err := p.GetCPU(); !errors.Is(err, ErrNoCPUSample) {
+		t.Fatalf("expected no CPU sample on the first call, instead got: %v", err)
+	}
+
+	// 150 ticks of user and system time in 1 second is 1.5 CPUs
+	writeSample(101, 200, 50)
+	cpu, err := p.GetCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(cpu-150) > 0.001 {
+		t.Errorf("expected CPU to be 150%%, instead got: %.3f", cpu)
+	}
+}
+
+func TestProcessDisappeared(t *testing.T) {
+	p := &Process{ID: 999999, FS: testProcFS("testdata/proc")}
+	if _, err := p.GetCPU(); err == nil {
+		t.Error("expected an error for a process that does not exist")
+	}
+	if _, err := p.GetRSS(); err == nil {
+		t.Error("expected an error for a process that does not exist")
+	}
+}
+
+func TestProcessDefaultProcFSConcurrently(t *testing.T) {
+	// the procfs is set on first use, which mustn't race between samples taken at the same time
+	p := &Process{ID: os.Getpid()}
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.GetRSS()
+		done <- err
+	}()
+	if _, err := p.GetCPU(); err != nil && !errors.Is(err, ErrNoCPUSample) {
+		t.Error(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrintPIDResourceUsageWaitsForSecondSample(t *testing.T) {
+	fakeClock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	clock = fakeClock
+	defer func() { clock = system.RealClock }()
+
+	p := &Process{ID: 4242, FS: testProcFS("testdata/proc")}
+	done := make(chan error, 1)
+	go func() { done <- p.PrintPIDResourceUsage() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fakeClock.Waiters() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the second CPU sample to be scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fakeClock.Advance(time.Second)
+	// the uptime of the fixture doesn't advance so there's still no utilisation to print
+	if err := <-done; !errors.Is(err, ErrNoCPUSample) {
+		t.Errorf("expected a second sample to be taken, instead got %v", err)
+	}
+}
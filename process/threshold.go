@@ -1,8 +1,7 @@
 package process
 
 import (
-	"github.com/sirupsen/logrus"
-	"time"
+	"fmt"
 )
 
 const (
@@ -10,170 +9,191 @@ const (
 	ThresholdTypeRSS = "RSS"
 )
 
+// trigger policies decide from the sample history whether a threshold fires a trace
+const (
+	TriggerPolicyCount   = "count"   // at least trigger count of the last trigger window samples are above the threshold
+	TriggerPolicyAverage = "average" // the average of the last trigger window samples is above the threshold
+)
+
 var thresholdTypes = []string{ThresholdTypeRSS, ThresholdTypeCPU}
 
 type ThresholdParams struct {
-	CPUThreshold    float64 `yaml:"cpu_threshold"`     // the threshold at which to trigger a trace based on CPU
-	CPUTriggerCount int     `yaml:"cpu_trigger_count"` // number of times CPU threshold should be reached before triggering a trace
-	CPUTriggerDelay int     `yaml:"cpu_trigger_delay"` // how long to wait before the next CPU check when CPU trigger count > 1
-	RSSThreshold    int64   `yaml:"rss_threshold"`     // the threshold on at which to trigger a trace based on RSS
-	RSSTriggerCount int     `yaml:"rss_trigger_count"` // number of times RSS threshold should be reached before triggering a trace
-	RSSTriggerDelay int     `yaml:"rss_trigger_delay"` // how long to wait before the next RSS check when RSS trigger count > 1
+	CPUThreshold     float64 `yaml:"cpu_threshold"`      // the threshold at which to trigger a trace based on CPU
+	CPUTriggerCount  int     `yaml:"cpu_trigger_count"`  // number of samples above the CPU threshold needed to trigger a trace
+	CPUTriggerWindow int     `yaml:"cpu_trigger_window"` // number of recent samples the CPU trigger is decided from, 0 is the trigger count
+	CPUTriggerPolicy string  `yaml:"cpu_trigger_policy"` // count or average, see TriggerPolicyCount
+	CPUTriggerDelay  int     `yaml:"cpu_trigger_delay"`  // deprecated and ignored, still accepted so older configuration files load
+	RSSThreshold     int64   `yaml:"rss_threshold"`      // the threshold on at which to trigger a trace based on RSS
+	RSSTriggerCount  int     `yaml:"rss_trigger_count"`  // number of samples above the RSS threshold needed to trigger a trace
+	RSSTriggerWindow int     `yaml:"rss_trigger_window"` // number of recent samples the RSS trigger is decided from, 0 is the trigger count
+	RSSTriggerPolicy string  `yaml:"rss_trigger_policy"` // count or average, see TriggerPolicyCount
+	RSSTriggerDelay  int     `yaml:"rss_trigger_delay"`  // deprecated and ignored, still accepted so older configuration files load
 }
 
-type Thresholds struct {
-	CPU bool
-	RSS bool
+// trigger is the part of the threshold params for one threshold type
+type trigger struct {
+	thresholdType string
+	threshold     float64
+	count         int
+	window        int
+	policy        string
 }
 
-func CheckThresholds(p ProcessInterface, thresholdParams ThresholdParams) (Thresholds, error) {
-	pid := p.GetID()
-	var thresholdReached Thresholds
-	cpuThresholdReached, err := checkCPUThreshold(p, thresholdParams)
-	if err != nil {
-		return Thresholds{}, err
+func (params ThresholdParams) trigger(thresholdType string) (trigger, error) {
+	t := trigger{thresholdType: thresholdType}
+	switch thresholdType {
+	case ThresholdTypeRSS:
+		t.threshold, t.count, t.window, t.policy = float64(params.RSSThreshold), params.RSSTriggerCount,
+			params.RSSTriggerWindow, params.RSSTriggerPolicy
+	case ThresholdTypeCPU:
+		t.threshold, t.count, t.window, t.policy = params.CPUThreshold, params.CPUTriggerCount,
+			params.CPUTriggerWindow, params.CPUTriggerPolicy
+	default:
+		return trigger{}, fmt.Errorf("unknown threshold type %q", thresholdType)
 	}
-	if cpuThresholdReached {
-		logrus.WithField("pid", pid).Infof("CPU threshold reached")
-		thresholdReached.CPU = true
+	if t.count < 1 {
+		t.count = 1
 	}
-
-	rssThresholdReached, err := checkRSSThreshold(p, thresholdParams)
-	if err != nil {
-		return Thresholds{}, err
+	if t.window < t.count {
+		t.window = t.count
 	}
-	if rssThresholdReached {
-		logrus.WithField("pid", pid).Infof("RSS threshold reached")
-		thresholdReached.RSS = true
+	if t.policy == "" {
+		t.policy = TriggerPolicyCount
 	}
-	return thresholdReached, err
+	return t, nil
 }
 
-// CheckThresholdTriggers checks to see if any of the thresholds for a particular process have been exceeded
-// this takes into account the specified amount of times a threshold should be reached before triggerring
-// returns the threshold type (RSS or CPU) and true if the process has reached the specified threshold
-func CheckThresholdTriggers(p ProcessInterface, thresholds Thresholds, thresholdParams ThresholdParams) (string, bool) {
-
-	trigger := make(chan string)
-	abort := make(chan struct{})
+// HistorySize returns how many samples of a process need to be kept to evaluate its triggers
+func (params ThresholdParams) HistorySize() int {
+	size := 0
 	for _, thresholdType := range thresholdTypes {
-		go func(thresholdType string) {
-			if checkTrigger(p, thresholds, thresholdParams, thresholdType) {
-				trigger <- thresholdType
-			} else {
-				abort <- struct{}{}
-			}
-		}(thresholdType)
-	}
-
-	checkedTriggers := 0
-	numTriggerChecks := len(thresholdTypes)
-	for checkedTriggers < numTriggerChecks {
-		select {
-		case thresholdType := <-trigger:
-			return thresholdType, true
-		case <-abort:
-			checkedTriggers++
+		if t, err := params.trigger(thresholdType); err == nil && t.window > size {
+			size = t.window
 		}
 	}
-	return "", false
+	return size
 }
 
-func checkCPUThreshold(p ProcessInterface, thresholdParams ThresholdParams) (bool, error) {
-	pid := p.GetID()
-	pidCPU, err := p.GetCPU()
+// Describe returns when a threshold fires a trace, for logging the configuration
+func (params ThresholdParams) Describe(thresholdType string) (string, error) {
+	t, err := params.trigger(thresholdType)
 	if err != nil {
-		return false, err
+		return "", err
+	}
+	if t.policy == TriggerPolicyAverage {
+		return fmt.Sprintf("average of the last %d samples above %.2f", t.window, t.threshold), nil
 	}
+	return fmt.Sprintf("%d of the last %d samples above %.2f", t.count, t.window, t.threshold), nil
+}
 
-	if pidCPU > thresholdParams.CPUThreshold {
-		logrus.WithField("pid", pid).Infof("CPU above threshold: %2.f/%2.f", pidCPU, thresholdParams.CPUThreshold)
-		return true, nil
+// Problems returns what's wrong with the trigger windows and policies, the caller checks the thresholds and counts
+func (params ThresholdParams) Problems() []string {
+	var problems []string
+	for _, t := range []struct {
+		name          string
+		count, window int
+		policy        string
+	}{
+		{"cpu", params.CPUTriggerCount, params.CPUTriggerWindow, params.CPUTriggerPolicy},
+		{"rss", params.RSSTriggerCount, params.RSSTriggerWindow, params.RSSTriggerPolicy},
+	} {
+		if t.window < 0 {
+			problems = append(problems, fmt.Sprintf("%s_trigger_window must not be negative", t.name))
+		} else if t.window > 0 && t.window < t.count {
+			problems = append(problems, fmt.Sprintf("%s_trigger_window must be at least %s_trigger_count", t.name, t.name))
+		}
+		switch t.policy {
+		case "", TriggerPolicyCount, TriggerPolicyAverage:
+		default:
+			problems = append(problems, fmt.Sprintf("%s_trigger_policy must be %s or %s", t.name, TriggerPolicyCount, TriggerPolicyAverage))
+		}
 	}
-	logrus.WithField("pid", pid).Tracef("current process CPU: %2.f", pidCPU)
-	return false, nil
+	return problems
 }
 
-func checkRSSThreshold(p ProcessInterface, thresholdParams ThresholdParams) (bool, error) {
-	pid := p.GetID()
+// Evaluation is the outcome of evaluating the sample history of a process against one of its thresholds
+type Evaluation struct {
+	Type      string  // the threshold type, CPU or RSS
+	Policy    string  // the trigger policy
+	Threshold float64 // the threshold the samples were compared to
+	Samples   int     // how many samples were evaluated, at most the trigger window
+	Above     int     // how many of the samples were above the threshold
+	Required  int     // how many samples need to be above the threshold with the count policy
+	Average   float64 // the average of the samples
+	Last      float64 // the most recent sample
+	Fired     bool
+}
 
-	pidRSS, err := p.GetRSS()
-	if err != nil {
-		return false, err
+// Overage returns how far over the threshold the process is as a ratio of the threshold, the average is
+// compared with the average policy and the most recent sample otherwise
+func (e Evaluation) Overage() float64 {
+	value := e.Last
+	if e.Policy == TriggerPolicyAverage {
+		value = e.Average
 	}
-	if pidRSS > thresholdParams.RSSThreshold {
-		logrus.WithField("pid", pid).Infof("RSS above threshold: %d/%d", pidRSS, thresholdParams.RSSThreshold)
-		return true, nil
+	if e.Threshold <= 0 {
+		return value
+	}
+	return value / e.Threshold
+}
+
+func (e Evaluation) String() string {
+	if e.Policy == TriggerPolicyAverage {
+		return fmt.Sprintf("%s average %.2f of the last %d samples against threshold %.2f", e.Type, e.Average, e.Samples, e.Threshold)
 	}
-	logrus.WithField("pid", pid).Tracef("current process RSS: %d", pidRSS)
-	return false, nil
+	return fmt.Sprintf("%s above threshold %.2f in %d/%d of the last %d samples", e.Type, e.Threshold, e.Above, e.Required, e.Samples)
 }
 
-func checkTrigger(p ProcessInterface, thresholds Thresholds, thresholdParams ThresholdParams, thresholdType string) bool {
+// Evaluate decides from the sample history of a process, oldest first, whether a threshold fires a trace
+// the RSS threshold is evaluated first, returning the evaluation of the threshold that fired
+func (params ThresholdParams) Evaluate(samples []Sample) (Evaluation, bool) {
+	for _, thresholdType := range thresholdTypes {
+		t, err := params.trigger(thresholdType)
+		if err != nil {
+			continue
+		}
+		if e := t.evaluate(samples); e.Fired {
+			return e, true
+		}
+	}
+	return Evaluation{}, false
+}
 
-	pid := p.GetID()
-	logrus.WithField("pid", pid).Debugf("checking if trigger conditions met")
-	var checkDelay int
-	var thresholdReached bool
-	var triggerCount int
+// Evaluations returns the evaluation of each threshold, for logging why a process wasn't traced
+func (params ThresholdParams) Evaluations(samples []Sample) []Evaluation {
+	var evaluations []Evaluation
+	for _, thresholdType := range thresholdTypes {
+		if t, err := params.trigger(thresholdType); err == nil {
+			evaluations = append(evaluations, t.evaluate(samples))
+		}
+	}
+	return evaluations
+}
 
-	switch thresholdType {
-	case ThresholdTypeRSS:
-		thresholdReached = thresholds.RSS
-		triggerCount = thresholdParams.RSSTriggerCount
-		checkDelay = thresholdParams.RSSTriggerDelay
-	case ThresholdTypeCPU:
-		thresholdReached = thresholds.CPU
-		triggerCount = thresholdParams.CPUTriggerCount
-		checkDelay = thresholdParams.CPUTriggerDelay
-	default:
-		panic("unknown threshold type")
-	}
-
-	// checkTriggers is only called once the initial trigger event is fired
-	if thresholdReached && triggerCount <= 1 {
-		logrus.WithField("pid", pid).Infof("trigger count is <=1 - trigger fired after initial check for %s", thresholdType)
-		return true
-	}
-
-	trigger := make(chan bool)
-
-	var err error
-
-	go func() {
-		for check := 1; check <= triggerCount; check++ {
-			thresholds, err = CheckThresholds(p, thresholdParams)
-			if err != nil {
-				logrus.WithField("pid", pid).Errorf("something went wrong when checking thresholds for trigger: %v", err)
-				trigger <- false
-			}
-			aboveThreshold := false
-			switch thresholdType {
-			case ThresholdTypeRSS:
-				aboveThreshold = thresholds.RSS
-			case ThresholdTypeCPU:
-				aboveThreshold = thresholds.CPU
-			}
-
-			if aboveThreshold {
-				if check >= triggerCount {
-					logrus.WithField("pid", pid).Infof("%s trigger count reached %d/%d. Trigger fired",
-						thresholdType, check, triggerCount)
-					trigger <- true
-					return
-				}
-				logrus.WithField("pid", pid).Infof("%s trigger count %d/%d. Waiting %d seconds before next check",
-					thresholdType, check, triggerCount, checkDelay)
-				time.Sleep(time.Second * time.Duration(checkDelay))
-			} else {
-				// thresholdParams was not reached so do not trigger
-				logrus.WithField("pid", pid).
-					Debugf("%s trigger was not fired as it was below threshold", thresholdType)
-				trigger <- false
-				return
-			}
+func (t trigger) evaluate(samples []Sample) Evaluation {
+	if len(samples) > t.window {
+		samples = samples[len(samples)-t.window:]
+	}
+	e := Evaluation{Type: t.thresholdType, Policy: t.policy, Threshold: t.threshold, Samples: len(samples), Required: t.count}
+	if len(samples) == 0 {
+		return e
+	}
+	total := 0.0
+	for _, sample := range samples {
+		value := sample.Value(t.thresholdType)
+		total += value
+		if value > t.threshold {
+			e.Above++
 		}
-		trigger <- false
-	}()
-	return <-trigger
+	}
+	e.Average = total / float64(len(samples))
+	e.Last = samples[len(samples)-1].Value(t.thresholdType)
+	switch t.policy {
+	case TriggerPolicyAverage:
+		// the window has to be full so a single spike after the process started doesn't fire it
+		e.Fired = len(samples) == t.window && e.Average > t.threshold
+	default:
+		e.Fired = e.Above >= t.count
+	}
+	return e
 }
@@ -1,156 +1,176 @@
 package process
 
 import (
+	"github.com/daniel-cole/phunter/process/processtest"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 var testThresholdParams = ThresholdParams{
 	CPUThreshold:    100,
 	CPUTriggerCount: 3,
-	CPUTriggerDelay: 5,
 	RSSThreshold:    1024,
 	RSSTriggerCount: 3,
-	RSSTriggerDelay: 5,
 }
 
-func TestCheckThresholdsAbove(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
+// cpuSamples returns samples with the CPU values given and an RSS below the test threshold
+func cpuSamples(values ...float64) []Sample {
+	samples := make([]Sample, len(values))
+	for i, value := range values {
+		samples[i] = Sample{CPU: value, RSS: 512}
 	}
+	return samples
+}
 
-	aboveCPUThreshold, err := checkCPUThreshold(p, testThresholdParams)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !aboveCPUThreshold {
-		t.Error("expected process to be above CPU threshold")
+func TestEvaluateCount(t *testing.T) {
+	params := testThresholdParams
+	params.CPUTriggerCount = 3
+	params.CPUTriggerWindow = 5
+
+	tests := []struct {
+		name     string
+		samples  []Sample
+		expected bool
+	}{
+		{"no samples", nil, false},
+		{"too few samples above", cpuSamples(150, 150), false},
+		{"consecutive samples above", cpuSamples(150, 150, 150), true},
+		{"samples above within the window", cpuSamples(150, 50, 150, 50, 150), true},
+		{"samples above outside the window", cpuSamples(150, 150, 50, 50, 50, 150, 150), false},
+		{"equal to the threshold isn't above", cpuSamples(100, 100, 100, 100, 100), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evaluation, fired := params.Evaluate(test.samples)
+			if fired != test.expected {
+				t.Errorf("expected fired to be %v, instead got %v: %s", test.expected, fired, params.Evaluations(test.samples)[1])
+			}
+			if fired && evaluation.Type != ThresholdTypeCPU {
+				t.Errorf("expected the CPU trigger to fire, instead got %s", evaluation.Type)
+			}
+		})
 	}
+}
 
-	aboveRSSThreshold, err := checkRSSThreshold(p, testThresholdParams)
-	if err != nil {
-		t.Fatal(err)
+func TestEvaluateCountWindowDefaultsToCount(t *testing.T) {
+	// without a window the trigger needs trigger count consecutive samples above the threshold like before
+	if _, fired := testThresholdParams.Evaluate(cpuSamples(150, 150, 50, 150, 150)); fired {
+		t.Error("expected samples above either side of a sample below not to fire")
 	}
-	if !aboveRSSThreshold {
-		t.Error("expected process to be above RSS threshold")
+	if _, fired := testThresholdParams.Evaluate(cpuSamples(50, 150, 150, 150)); !fired {
+		t.Error("expected the last 3 samples above to fire")
 	}
-
 }
 
-func TestCheckThresholdsBelow(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
-	}
-
+func TestEvaluateAverage(t *testing.T) {
 	params := testThresholdParams
-	params.CPUThreshold = 300
-	params.RSSThreshold = 2097152
-
-	aboveCPUThreshold, err := checkCPUThreshold(p, params)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if aboveCPUThreshold {
-		t.Error("expected process to be below CPU threshold")
-	}
-
-	aboveRSSThreshold, err := checkRSSThreshold(p, params)
-	if err != nil {
-		t.Fatal(err)
-	}
-	processRSS, err := p.GetRSS()
-	if err != nil {
-		t.Fatal("failed to get RSS for process")
-	}
-	if aboveRSSThreshold {
-		t.Errorf("expected process to be below RSS threshold, threshold: %d RSS: %d",
-			params.RSSThreshold, processRSS)
+	params.CPUTriggerPolicy = TriggerPolicyAverage
+	params.CPUTriggerCount = 1
+	params.CPUTriggerWindow = 4
+
+	tests := []struct {
+		name     string
+		samples  []Sample
+		expected bool
+	}{
+		{"window not full", cpuSamples(400, 400, 400), false},
+		{"average above", cpuSamples(40, 200, 100, 90), true},
+		{"average below", cpuSamples(40, 200, 100, 50), false},
+		{"only the window is averaged", cpuSamples(0, 0, 150, 150, 150, 150), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evaluation, fired := params.Evaluate(test.samples)
+			if fired != test.expected {
+				t.Errorf("expected fired to be %v, instead got %v: %s", test.expected, fired, params.Evaluations(test.samples)[1])
+			}
+			if fired && (evaluation.Policy != TriggerPolicyAverage || evaluation.Samples != 4 || evaluation.Overage() <= 1) {
+				t.Errorf("unexpected evaluation %+v", evaluation)
+			}
+		})
 	}
 }
 
-func TestCheckThresholds(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
-	}
-	thresholds, err := CheckThresholds(p, testThresholdParams)
-	if err != nil {
-		t.Fatal(err)
+func TestEvaluateScriptedProcess(t *testing.T) {
+	params := testThresholdParams
+	params.CPUTriggerCount = 2
+	p := &processtest.Process{ID: 42, CPU: []float64{150, 50, 150, 150}, RSS: []int64{512}}
+	history := NewHistory(params.HistorySize())
+
+	for i := 1; i <= 4; i++ {
+		cpu, _ := p.GetCPU()
+		rss, _ := p.GetRSS()
+		history.Add(Sample{CPU: cpu, RSS: rss})
+		if _, fired := params.Evaluate(history.Samples()); fired != (i == 4) {
+			t.Errorf("expected the trigger to fire only on the fourth sample, instead fired %v on sample %d", fired, i)
+		}
 	}
-	if !thresholds.CPU || !thresholds.RSS {
-		t.Error("expected both CPU and RSS to be above the threshold")
+	// the last scripted sample is repeated
+	if cpu, _ := p.GetCPU(); cpu != 150 {
+		t.Errorf("expected the last sample to be repeated, instead got %.2f", cpu)
 	}
 }
 
-func TestCheckThresholdTriggers(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
-	}
-
+func TestEvaluateRSSFirst(t *testing.T) {
 	params := testThresholdParams
 	params.RSSTriggerCount = 2
-	params.RSSTriggerDelay = 1
-	params.RSSThreshold = 1024
+	params.CPUTriggerCount = 2
+	samples := []Sample{{CPU: 200, RSS: 2048}, {CPU: 200, RSS: 2048}}
 
-	thresholds, err := CheckThresholds(p, params)
-	if err != nil {
-		t.Fatal(err)
+	evaluation, fired := params.Evaluate(samples)
+	if !fired || evaluation.Type != ThresholdTypeRSS {
+		t.Errorf("expected the RSS trigger to fire first, instead got %+v", evaluation)
 	}
-	triggerType, triggered := CheckThresholdTriggers(p, thresholds, params)
-	if !triggered {
-		t.Error("expected check threshold triggers to trigger")
+	if expected := "RSS above threshold 1024.00 in 2/2 of the last 2 samples"; evaluation.String() != expected {
+		t.Errorf("expected %q, instead got %q", expected, evaluation.String())
 	}
-	if triggerType != ThresholdTypeRSS {
-		t.Errorf("expected trigger type to be %s, instead got: %s", ThresholdTypeRSS, triggerType)
+	if overage := evaluation.Overage(); overage != 2 {
+		t.Errorf("expected the RSS to be twice the threshold, instead got %.2f", overage)
 	}
 }
 
-func TestRacyCheckThresholdTriggers(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
+func TestHistorySize(t *testing.T) {
+	params := testThresholdParams
+	if size := params.HistorySize(); size != 3 {
+		t.Errorf("expected the history size to default to the largest trigger count, instead got %d", size)
 	}
+	params.RSSTriggerWindow = 10
+	if size := params.HistorySize(); size != 10 {
+		t.Errorf("expected the history size to be the largest trigger window, instead got %d", size)
+	}
+}
 
+func TestThresholdParamsProblems(t *testing.T) {
 	params := testThresholdParams
-	params.RSSTriggerCount = 2
-	params.RSSTriggerDelay = 1
-	params.RSSThreshold = 1024
-	params.CPUTriggerCount = 2
-	params.CPUTriggerDelay = 1
-	params.CPUThreshold = 50
+	params.CPUTriggerWindow = 2
+	params.RSSTriggerWindow = -1
+	params.RSSTriggerPolicy = "median"
 
-	thresholds, err := CheckThresholds(p, params)
-	if err != nil {
-		t.Fatal(err)
+	expected := []string{
+		"cpu_trigger_window must be at least cpu_trigger_count",
+		"rss_trigger_window must not be negative",
+		"rss_trigger_policy must be count or average",
 	}
-	_, triggered := CheckThresholdTriggers(p, thresholds, params)
-	if !triggered {
-		t.Error("expected check threshold triggers to trigger")
+	if problems := params.Problems(); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected problems %q, instead got %q", expected, problems)
 	}
-}
-
-func TestCheckThresholdTriggerCPUOnly(t *testing.T) {
-	var p ProcessInterface
-	p = &MockProcess{
-		ID: 1,
+	if problems := testThresholdParams.Problems(); len(problems) != 0 {
+		t.Errorf("expected no problems, instead got %q", problems)
 	}
+}
 
+func TestDescribe(t *testing.T) {
 	params := testThresholdParams
-	params.CPUTriggerCount = 2
-	params.CPUTriggerDelay = 1
-	params.CPUThreshold = 50
-
-	thresholds, err := CheckThresholds(p, params)
-	if err != nil {
-		t.Fatal(err)
+	params.CPUTriggerPolicy = TriggerPolicyAverage
+	params.CPUTriggerWindow = 6
+	if description, err := params.Describe(ThresholdTypeCPU); err != nil || !strings.HasPrefix(description, "average of the last 6 samples") {
+		t.Errorf("unexpected description %q: %v", description, err)
 	}
-	triggerType, triggered := CheckThresholdTriggers(p, thresholds, params)
-	if !triggered {
-		t.Error("expected check threshold triggers to trigger")
+	if description, err := params.Describe(ThresholdTypeRSS); err != nil || description != "3 of the last 3 samples above 1024.00" {
+		t.Errorf("unexpected description %q: %v", description, err)
 	}
-	if triggerType != ThresholdTypeCPU {
-		t.Errorf("expected trigger type to be %s, instead got: %s", ThresholdTypeCPU, triggerType)
+	if _, err := params.Describe("IO"); err == nil {
+		t.Error("expected an error describing an unknown threshold type")
 	}
 }
@@ -0,0 +1,191 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ReasonAge   = "age"
+	ReasonSize  = "size"
+	ReasonCount = "count"
+)
+
+// ErrInsufficientSpace is returned by CheckFreeSpace when the filesystem has less free space than the policy allows
+var ErrInsufficientSpace = errors.New("insufficient free space")
+
+// Policy limits the traces kept in a directory, a limit of 0 is not enforced
+type Policy struct {
+	MaxAge        time.Duration // traces last modified longer ago than this are evicted
+	MaxTotalBytes int64         // the oldest traces are evicted until the directory uses no more than this
+	MaxFiles      int           // the oldest traces are evicted until no more than this many are kept
+	MinFreeBytes  int64         // new traces are refused when the filesystem has less free space than this
+}
+
+// Dir is a directory of traces where each trace may have sidecar files that are evicted along with it
+type Dir struct {
+	Path string
+
+	// Group returns the name of the trace a file belongs to, so sidecar files are evicted with their trace
+	// files that aren't part of a trace return false and are never counted or evicted
+	Group func(name string) (string, bool)
+
+	// InUse reports whether a trace is still being written, traces in use are never evicted
+	InUse func(trace string) bool
+}
+
+// Eviction is a trace removed by Enforce
+type Eviction struct {
+	Trace  string
+	Reason string // age, size or count
+	Bytes  int64  // size of the trace and its sidecar files
+}
+
+// Result describes the directory after the policy was enforced
+type Result struct {
+	Evicted []Eviction
+	Traces  int   // number of traces kept
+	Bytes   int64 // size of the traces kept
+}
+
+// entry is a trace and its sidecar files
+type entry struct {
+	name    string
+	files   []string
+	bytes   int64
+	modTime time.Time // the most recent modification of any of the files
+}
+
+// enforcing stops scheduled and pre trace enforcement evicting the same traces at the same time
+var enforcing sync.Mutex
+
+// Enforce evicts traces, oldest first, until the directory is within the policy
+// traces older than the max age are evicted first, then the oldest traces until the size and count limits are met
+func (d Dir) Enforce(policy Policy, now time.Time) (Result, error) {
+	enforcing.Lock()
+	defer enforcing.Unlock()
+
+	entries, err := d.entries()
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	var kept []entry
+	for _, e := range entries {
+		result.Traces++
+		result.Bytes += e.bytes
+		if policy.MaxAge > 0 && now.Sub(e.modTime) > policy.MaxAge && !d.inUse(e.name) {
+			if err := d.evict(e, ReasonAge, &result); err != nil {
+				return result, err
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	for _, e := range kept {
+		var reason string
+		switch {
+		case policy.MaxTotalBytes > 0 && result.Bytes > policy.MaxTotalBytes:
+			reason = ReasonSize
+		case policy.MaxFiles > 0 && result.Traces > policy.MaxFiles:
+			reason = ReasonCount
+		default:
+			return result, nil
+		}
+		if d.inUse(e.name) {
+			continue
+		}
+		if err := d.evict(e, reason, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (d Dir) evict(e entry, reason string, result *Result) error {
+	for _, file := range e.files {
+		if err := os.Remove(filepath.Join(d.Path, file)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to evict trace %s: %v", e.name, err)
+		}
+	}
+	result.Evicted = append(result.Evicted, Eviction{Trace: e.name, Reason: reason, Bytes: e.bytes})
+	result.Traces--
+	result.Bytes -= e.bytes
+	return nil
+}
+
+func (d Dir) inUse(trace string) bool {
+	return d.InUse != nil && d.InUse(trace)
+}
+
+// entries returns the traces in the directory, oldest first
+func (d Dir) entries() ([]entry, error) {
+	infos, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	byName := make(map[string]*entry)
+	var entries []*entry
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name, ok := d.Group(info.Name())
+		if !ok {
+			continue
+		}
+		e, ok := byName[name]
+		if !ok {
+			e = &entry{name: name}
+			byName[name] = e
+			entries = append(entries, e)
+		}
+		e.files = append(e.files, info.Name())
+		e.bytes += info.Size()
+		if info.ModTime().After(e.modTime) {
+			e.modTime = info.ModTime()
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	result := make([]entry, len(entries))
+	for i, e := range entries {
+		result[i] = *e
+	}
+	return result, nil
+}
+
+// FreeBytes returns the space available to unprivileged users on the filesystem containing path
+func FreeBytes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// CheckFreeSpace returns ErrInsufficientSpace when the filesystem containing path has less free space than the policy
+func CheckFreeSpace(path string, policy Policy) (int64, error) {
+	free, err := FreeBytes(path)
+	if err != nil {
+		return 0, err
+	}
+	if policy.MinFreeBytes > 0 && free < policy.MinFreeBytes {
+		return free, fmt.Errorf("%w: %d bytes free on the filesystem containing %s, %d required",
+			ErrInsufficientSpace, free, path, policy.MinFreeBytes)
+	}
+	return free, nil
+}
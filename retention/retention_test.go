@@ -0,0 +1,137 @@
+package retention
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestDir creates traces a, b, c and d of 100 bytes, each with a 10 byte sidecar
+// last modified 4, 3, 2 and 1 hours ago, and an older file which isn't a trace
+func newTestDir(t *testing.T) Dir {
+	path, err := ioutil.TempDir("", "phunter-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+
+	for i, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		modTime := testNow.Add(-time.Duration(4-i) * time.Hour)
+		for file, size := range map[string]int{name: 100, name + ".meta.json": 10} {
+			filePath := filepath.Join(path, file)
+			if err := ioutil.WriteFile(filePath, make([]byte, size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	unrelated := filepath.Join(path, "unrelated.log")
+	if err := ioutil.WriteFile(unrelated, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(unrelated, testNow.Add(-time.Hour*24), testNow.Add(-time.Hour*24)); err != nil {
+		t.Fatal(err)
+	}
+	return Dir{
+		Path: path,
+		Group: func(name string) (string, bool) {
+			trace := strings.TrimSuffix(name, ".meta.json")
+			return trace, strings.HasSuffix(trace, ".txt")
+		},
+	}
+}
+
+func remaining(t *testing.T, dir Dir) []string {
+	infos, err := ioutil.ReadDir(dir.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func evicted(result Result) []string {
+	var traces []string
+	for _, eviction := range result.Evicted {
+		traces = append(traces, eviction.Trace+":"+eviction.Reason)
+	}
+	return traces
+}
+
+func TestEnforce(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		inUse    string
+		expected []string
+	}{
+		{name: "no limits", policy: Policy{}},
+		{name: "max age", policy: Policy{MaxAge: 150 * time.Minute}, expected: []string{"a.txt:age", "b.txt:age"}},
+		{name: "max total bytes", policy: Policy{MaxTotalBytes: 250}, expected: []string{"a.txt:size", "b.txt:size"}},
+		{name: "max files", policy: Policy{MaxFiles: 3}, expected: []string{"a.txt:count"}},
+		{
+			name:     "combined",
+			policy:   Policy{MaxAge: 210 * time.Minute, MaxTotalBytes: 300, MaxFiles: 1},
+			expected: []string{"a.txt:age", "b.txt:size", "c.txt:count"},
+		},
+		{name: "in use", policy: Policy{MaxFiles: 2}, inUse: "a.txt", expected: []string{"b.txt:count", "c.txt:count"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := newTestDir(t)
+			dir.InUse = func(trace string) bool { return trace == test.inUse }
+
+			result, err := dir.Enforce(test.policy, testNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := evicted(result); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v to be evicted, instead got %v", test.expected, actual)
+			}
+			kept := 4 - len(test.expected)
+			if result.Traces != kept || result.Bytes != int64(kept*110) {
+				t.Errorf("expected %d traces to be kept, instead got %d traces of %d bytes", kept, result.Traces, result.Bytes)
+			}
+			if files := remaining(t, dir); len(files) != kept*2+1 {
+				t.Errorf("expected traces to be evicted with their sidecars and other files kept, instead %v remain", files)
+			}
+		})
+	}
+}
+
+func TestEnforceMissingDir(t *testing.T) {
+	dir := Dir{Path: "testdata/missing", Group: func(name string) (string, bool) { return name, true }}
+	result, err := dir.Enforce(Policy{MaxFiles: 1}, testNow)
+	if err != nil || result.Traces != 0 {
+		t.Errorf("expected a missing directory to be empty, instead got %+v: %v", result, err)
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := newTestDir(t)
+
+	free, err := CheckFreeSpace(dir.Path, Policy{})
+	if err != nil || free <= 0 {
+		t.Fatalf("expected free space to be reported without a floor, instead got %d: %v", free, err)
+	}
+	if _, err := CheckFreeSpace(dir.Path, Policy{MinFreeBytes: 1}); err != nil {
+		t.Errorf("expected more than 1 byte to be free: %v", err)
+	}
+	_, err = CheckFreeSpace(dir.Path, Policy{MinFreeBytes: math.MaxInt64})
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected ErrInsufficientSpace, instead got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Scheduler runs a check every interval, a check is never started while the previous check is still running
+type Scheduler struct {
+	clock    system.Clock
+	interval func() time.Duration
+	check    func(ctx context.Context)
+}
+
+// New returns a scheduler running check every interval, the interval is read again when the configuration is reloaded
+func New(interval func() time.Duration, check func(ctx context.Context)) *Scheduler {
+	return &Scheduler{clock: system.RealClock, interval: interval, check: check}
+}
+
+// Run runs the checks until the context is cancelled, returning once the running check has finished
+// the context passed to the check is cancelled at the same time
+func (s *Scheduler) Run(ctx context.Context, reloaded <-chan struct{}) {
+	interval := s.interval()
+	ticker := s.clock.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// holds a value while a check is running
+	running := make(chan struct{}, 1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			select {
+			case running <- struct{}{}:
+			default:
+				logrus.Warnf("skipping check, the previous check is still running after %s", interval)
+				metrics.ChecksSkipped.Inc()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-running }()
+				s.check(ctx)
+			}()
+		case <-reloaded:
+			if newInterval := s.interval(); newInterval != interval {
+				logrus.Infof("check interval changed from %s to %s", interval, newInterval)
+				ticker.Stop()
+				interval = newInterval
+				ticker = s.clock.NewTicker(interval)
+			}
+		}
+	}
+}
+
+// CheckProcesses calls check for each process concurrently and waits for them to return, returning the errors
+// by PID, processes aren't checked once the context is cancelled
+func CheckProcesses(ctx context.Context, processes []process.ProcessInterface,
+	check func(ctx context.Context, p process.ProcessInterface) error) map[int]error {
+
+	errs := make([]error, len(processes))
+	var wg sync.WaitGroup
+	for i, p := range processes {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, p process.ProcessInterface) {
+			defer wg.Done()
+			errs[i] = check(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	failed := make(map[int]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[processes[i].GetID()] = err
+		}
+	}
+	return failed
+}
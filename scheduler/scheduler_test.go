@@ -0,0 +1,201 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/process/processtest"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startScheduler runs a scheduler on a fake clock, returning a channel closed when Run returns
+func startScheduler(t *testing.T, ctx context.Context, interval func() time.Duration, reloaded <-chan struct{},
+	check func(ctx context.Context)) (*systemtest.Clock, <-chan struct{}) {
+
+	clock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	s := New(interval, check)
+	s.clock = clock
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, reloaded)
+		close(done)
+	}()
+	waitFor(t, func() bool { return clock.Waiters() == 1 }, "the ticker to be created")
+	return clock, done
+}
+
+func waitFor(t *testing.T, condition func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func wait(t *testing.T, c <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func constantInterval() time.Duration { return 10 * time.Second }
+
+func TestRunChecksEachTick(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	clock, done := startScheduler(t, ctx, constantInterval, nil, func(context.Context) {
+		finished <- struct{}{}
+	})
+
+	if intervals := clock.Intervals(); !reflect.DeepEqual(intervals, []time.Duration{10 * time.Second}) {
+		t.Errorf("expected the ticker to tick every check interval, instead got %v", intervals)
+	}
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Second)
+		wait(t, finished, "the check to finish")
+	}
+	cancel()
+	wait(t, done, "the scheduler to stop")
+	if clock.Waiters() != 0 {
+		t.Error("expected the ticker to be stopped")
+	}
+}
+
+func TestRunSkipsOverlappingChecks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var checks int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	clock, done := startScheduler(t, ctx, constantInterval, nil, func(context.Context) {
+		atomic.AddInt32(&checks, 1)
+		close(started)
+		<-release
+	})
+	skipped := metrics.ChecksSkipped.Value()
+
+	clock.Advance(10 * time.Second)
+	wait(t, started, "the check to start")
+	for i := 1; i <= 2; i++ {
+		clock.Advance(10 * time.Second)
+		waitFor(t, func() bool { return metrics.ChecksSkipped.Value() == skipped+float64(i) }, "the check to be skipped")
+	}
+	close(release)
+	cancel()
+	wait(t, done, "the scheduler to stop")
+
+	if checks != 1 || metrics.ChecksSkipped.Value() != skipped+2 {
+		t.Errorf("expected the ticks while the check was running to be skipped, instead ran %d checks and skipped %.0f",
+			checks, metrics.ChecksSkipped.Value()-skipped)
+	}
+}
+
+func TestRunWaitsForTheRunningCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var finished int32
+	clock, done := startScheduler(t, ctx, constantInterval, nil, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+
+	clock.Advance(10 * time.Second)
+	wait(t, started, "the check to start")
+	cancel()
+	wait(t, done, "the scheduler to stop")
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("expected the scheduler to stop once the running check finished")
+	}
+}
+
+func TestRunReloadsInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	seconds := 10
+	interval := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Duration(seconds) * time.Second
+	}
+	reloaded := make(chan struct{})
+	finished := make(chan struct{})
+	clock, done := startScheduler(t, ctx, interval, reloaded, func(context.Context) {
+		finished <- struct{}{}
+	})
+
+	// a reload that doesn't change the interval keeps the ticker
+	reloaded <- struct{}{}
+	mu.Lock()
+	seconds = 30
+	mu.Unlock()
+	reloaded <- struct{}{}
+	// received once the previous reload has been handled
+	reloaded <- struct{}{}
+
+	if intervals := clock.Intervals(); !reflect.DeepEqual(intervals, []time.Duration{30 * time.Second}) {
+		t.Errorf("expected the ticker to be replaced by one ticking every 30s, instead got %v", intervals)
+	}
+	clock.Advance(30 * time.Second)
+	wait(t, finished, "the check to finish")
+	cancel()
+	wait(t, done, "the scheduler to stop")
+}
+
+func TestCheckProcesses(t *testing.T) {
+	processes := make([]process.ProcessInterface, 50)
+	for i := range processes {
+		processes[i] = &processtest.Process{ID: i + 1}
+	}
+	var checked int32
+	failed := CheckProcesses(context.Background(), processes, func(ctx context.Context, p process.ProcessInterface) error {
+		atomic.AddInt32(&checked, 1)
+		if _, err := p.GetCPU(); err != nil {
+			return err
+		}
+		if p.GetID()%10 == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if checked != 50 {
+		t.Errorf("expected every process to be checked, instead checked %d", checked)
+	}
+	if len(failed) != 5 {
+		t.Errorf("expected the errors of 5 processes, instead got %v", failed)
+	}
+	for pid := range failed {
+		if pid%10 != 0 {
+			t.Errorf("unexpected error for pid %d", pid)
+		}
+	}
+}
+
+func TestCheckProcessesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := CheckProcesses(ctx, []process.ProcessInterface{&processtest.Process{ID: 1}},
+		func(context.Context, process.ProcessInterface) error {
+			t.Error("expected no process to be checked once cancelled")
+			return nil
+		})
+	if len(failed) != 0 {
+		t.Errorf("expected no errors, instead got %v", failed)
+	}
+}
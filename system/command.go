@@ -0,0 +1,63 @@
+package system
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// CommandRunner starts commands, tests replace ExecRunner with a systemtest.Runner
+type CommandRunner interface {
+	Start(args []string, stdout, stderr io.Writer) (Command, error)
+}
+
+// Command is a started command
+type Command interface {
+	Wait() error
+	Signal(sig os.Signal) error
+	Kill() error
+	ExitCode() int // -1 until the command has exited, or when it was killed by a signal
+}
+
+// ExecRunner runs commands as child processes
+var ExecRunner CommandRunner = execRunner{}
+
+type execRunner struct{}
+
+func (execRunner) Start(args []string, stdout, stderr io.Writer) (Command, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execCommand{cmd: cmd, exitCode: -1}, nil
+}
+
+// execCommand records the exit code once Wait returns, as the process state can't be read while Wait is running
+type execCommand struct {
+	cmd *exec.Cmd
+
+	mu       sync.Mutex
+	exitCode int
+}
+
+func (c *execCommand) Wait() error {
+	err := c.cmd.Wait()
+	c.mu.Lock()
+	if c.cmd.ProcessState != nil {
+		c.exitCode = c.cmd.ProcessState.ExitCode()
+	}
+	c.mu.Unlock()
+	return err
+}
+
+func (c *execCommand) Signal(sig os.Signal) error { return c.cmd.Process.Signal(sig) }
+func (c *execCommand) Kill() error                { return c.cmd.Process.Kill() }
+
+func (c *execCommand) ExitCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exitCode
+}
@@ -0,0 +1,35 @@
+package system
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExecRunner(t *testing.T) {
+	var stdout bytes.Buffer
+	command, err := ExecRunner.Start([]string{"echo", "dryrun"}, &stdout, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := command.Wait(); err != nil || command.ExitCode() != 0 || stdout.String() != "dryrun\n" {
+		t.Errorf("expected echo to exit with status 0, instead got %v %d %q", err, command.ExitCode(), stdout.String())
+	}
+}
+
+func TestExecRunnerExitCodeWhileWaiting(t *testing.T) {
+	command, err := ExecRunner.Start([]string{"sleep", "0.2"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+	// read while Wait is running, e.g. when a tracer couldn't be killed
+	if code := command.ExitCode(); code != -1 {
+		t.Errorf("expected exit code -1 while the command is running, instead got %d", code)
+	}
+	if err := <-done; err != nil || command.ExitCode() != 0 {
+		t.Errorf("expected sleep to exit with status 0, instead got %v %d", err, command.ExitCode())
+	}
+}
@@ -0,0 +1,276 @@
+// Package systemtest provides a fake clock and command runner for tests of the packages that wait or run commands
+package systemtest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/system"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Clock is a system.Clock whose time only passes when advanced, timers and tickers fire as the time passes them
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a timer from After, or a ticker when interval is set
+type waiter struct {
+	when     time.Time
+	interval time.Duration
+	c        chan time.Time
+	stopped  bool
+}
+
+// NewClock returns a fake clock starting at now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After fires straight away when d isn't positive, like time.After
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w.c
+	}
+	c.waiters = append(c.waiters, w)
+	return w.c
+}
+
+func (c *Clock) NewTicker(d time.Duration) system.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{when: c.now.Add(d), interval: d, c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &ticker{clock: c, waiter: w}
+}
+
+// Advance moves the time forward, firing the timers and tickers that are due
+// like time.Ticker, ticks are dropped when the last tick hasn't been received
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.stopped {
+			continue
+		}
+		for !w.when.After(c.now) {
+			select {
+			case w.c <- w.when:
+			default:
+			}
+			if w.interval == 0 {
+				w.stopped = true
+				break
+			}
+			w.when = w.when.Add(w.interval)
+		}
+		if !w.stopped {
+			waiting = append(waiting, w)
+		}
+	}
+	c.waiters = waiting
+}
+
+// Waiters returns the number of timers and tickers that haven't fired or been stopped
+// tests wait for it to change to know the code under test is waiting on the clock
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiting := 0
+	for _, w := range c.waiters {
+		if !w.stopped {
+			waiting++
+		}
+	}
+	return waiting
+}
+
+// Intervals returns the intervals of the tickers that haven't been stopped
+func (c *Clock) Intervals() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var intervals []time.Duration
+	for _, w := range c.waiters {
+		if !w.stopped && w.interval != 0 {
+			intervals = append(intervals, w.interval)
+		}
+	}
+	return intervals
+}
+
+type ticker struct {
+	clock  *Clock
+	waiter *waiter
+}
+
+func (t *ticker) C() <-chan time.Time { return t.waiter.c }
+
+func (t *ticker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.waiter.stopped = true
+}
+
+// Runner starts a Command for each command instead of running it and records the commands started
+type Runner struct {
+	// New returns the command started for args, a command that runs until it's interrupted or killed when nil
+	New func(args []string) *Command
+
+	mu       sync.Mutex
+	started  [][]string
+	commands []*Command
+}
+
+func (r *Runner) Start(args []string, stdout, stderr io.Writer) (system.Command, error) {
+	c := NewCommand()
+	if r.New != nil {
+		c = r.New(args)
+	}
+	if c.StartErr != nil {
+		return nil, c.StartErr
+	}
+	r.mu.Lock()
+	r.started = append(r.started, args)
+	r.commands = append(r.commands, c)
+	r.mu.Unlock()
+	c.start(stdout)
+	return c, nil
+}
+
+// Started returns the arguments of the commands started
+func (r *Runner) Started() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.started...)
+}
+
+// Commands returns the commands started
+func (r *Runner) Commands() []*Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Command(nil), r.commands...)
+}
+
+// Command is a command that runs until the test calls Exit, or until it's interrupted or killed
+type Command struct {
+	StartErr        error  // returned by Start instead of starting the command
+	Output          string // written to stdout when started
+	InterruptOutput string // written to stdout when interrupted before exiting, e.g. a tracer flushing its trace
+	IgnoreInterrupt bool   // keeps running when interrupted so it has to be killed
+
+	mu       sync.Mutex
+	stdout   io.Writer
+	exitCode int
+	err      error
+	exited   chan struct{}
+	signals  []os.Signal
+}
+
+// NewCommand returns a command that runs until it's interrupted or killed
+func NewCommand() *Command {
+	return &Command{exitCode: -1, exited: make(chan struct{})}
+}
+
+func (c *Command) start(stdout io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdout = stdout
+	if c.Output != "" {
+		_, _ = io.WriteString(stdout, c.Output)
+	}
+}
+
+// Exit makes the command exit by itself with the exit code, a command that has exited is left alone
+func (c *Command) Exit(code int) {
+	var err error
+	if code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	c.exit(code, err)
+}
+
+func (c *Command) exit(code int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.exited:
+		return
+	default:
+	}
+	c.exitCode = code
+	c.err = err
+	close(c.exited)
+}
+
+func (c *Command) Wait() error {
+	<-c.exited
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Command) Signal(sig os.Signal) error {
+	c.mu.Lock()
+	select {
+	case <-c.exited:
+		c.mu.Unlock()
+		return errors.New("os: process already finished")
+	default:
+	}
+	c.signals = append(c.signals, sig)
+	ignore := c.IgnoreInterrupt || sig != os.Interrupt
+	if !ignore && c.InterruptOutput != "" {
+		_, _ = io.WriteString(c.stdout, c.InterruptOutput)
+	}
+	c.mu.Unlock()
+	if !ignore {
+		c.exit(0, nil)
+	}
+	return nil
+}
+
+func (c *Command) Kill() error {
+	c.mu.Lock()
+	select {
+	case <-c.exited:
+		c.mu.Unlock()
+		return errors.New("os: process already finished")
+	default:
+	}
+	c.signals = append(c.signals, os.Kill)
+	c.mu.Unlock()
+	c.exit(-1, errors.New("signal: killed"))
+	return nil
+}
+
+func (c *Command) ExitCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exitCode
+}
+
+// Signals returns the signals sent to the command, os.Kill when it was killed
+func (c *Command) Signals() []os.Signal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]os.Signal(nil), c.signals...)
+}
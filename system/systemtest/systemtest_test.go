@@ -0,0 +1,115 @@
+package systemtest
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	after := clock.After(time.Minute)
+	ticker := clock.NewTicker(20 * time.Second)
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("expected the timer not to fire before it's due")
+	default:
+	}
+	// like time.Ticker the ticks that aren't received are dropped
+	if tick := <-ticker.C(); !tick.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("expected the first tick to be kept, instead got %s", tick)
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("expected the second tick to be dropped, instead got %s", tick)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if fired := <-after; !fired.Equal(start.Add(time.Minute)) || !clock.Now().Equal(fired) {
+		t.Errorf("expected the timer to fire after a minute, instead got %s", fired)
+	}
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected a tick every 20 seconds, instead got %s", tick)
+	}
+	if waiters := clock.Waiters(); waiters != 1 {
+		t.Errorf("expected only the ticker to be waiting once the timer fired, instead got %d", waiters)
+	}
+
+	// like time.After a timer that's already due fires straight away
+	select {
+	case fired := <-clock.After(0):
+		if !fired.Equal(clock.Now()) {
+			t.Errorf("expected the timer to fire at the current time, instead got %s", fired)
+		}
+	default:
+		t.Error("expected a timer without a duration to fire straight away")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("expected a stopped ticker not to tick")
+	default:
+	}
+	if clock.Waiters() != 0 || len(clock.Intervals()) != 0 {
+		t.Error("expected nothing to be waiting once the ticker was stopped")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	runner := &Runner{New: func(args []string) *Command {
+		c := NewCommand()
+		c.Output = "started\n"
+		c.InterruptOutput = "flushed\n"
+		return c
+	}}
+	command, err := runner.Start([]string{"phpspy", "-p", "42"}, &stdout, &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.ExitCode() != -1 {
+		t.Error("expected a running command not to have an exit code")
+	}
+	if err := command.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := command.Wait(); err != nil || command.ExitCode() != 0 || stdout.String() != "started\nflushed\n" {
+		t.Errorf("expected the command to flush its output and exit when interrupted, instead got %v %d %q",
+			err, command.ExitCode(), stdout.String())
+	}
+	if command.Kill() == nil {
+		t.Error("expected killing a command that has exited to fail")
+	}
+	if started := runner.Started(); !reflect.DeepEqual(started, [][]string{{"phpspy", "-p", "42"}}) {
+		t.Errorf("unexpected commands started %q", started)
+	}
+
+	ignoring := NewCommand()
+	ignoring.IgnoreInterrupt = true
+	runner.New = func([]string) *Command { return ignoring }
+	if _, err := runner.Start([]string{"gdb"}, &stdout, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	_ = ignoring.Signal(os.Interrupt)
+	if ignoring.ExitCode() != -1 {
+		t.Error("expected a command ignoring interrupts to keep running")
+	}
+	_ = ignoring.Kill()
+	if err := ignoring.Wait(); err == nil || ignoring.ExitCode() != -1 {
+		t.Errorf("expected a killed command to fail, instead got %v %d", err, ignoring.ExitCode())
+	}
+
+	exiting := NewCommand()
+	exiting.Exit(3)
+	if err := exiting.Wait(); err == nil || err.Error() != "exit status 3" || exiting.ExitCode() != 3 {
+		t.Errorf("expected the command to exit with status 3, instead got %v %d", err, exiting.ExitCode())
+	}
+}
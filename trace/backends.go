@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"strconv"
+	"text/template"
+)
+
+func init() {
+	Register("php", newPHPSpyTracer)
+	Register("python", newPySpyTracer)
+	Register("ruby", newRbSpyTracer)
+	Register("native", newNativeTracer)
+	Register("command", newCommandTracer)
+}
+
+// phpSpyTracer traces php processes with phpspy
+type phpSpyTracer struct {
+	config config.PHPSpyConfig
+}
+
+func newPHPSpyTracer(config config.HunterConfig) (Tracer, error) {
+	if err := config.PHPSpyConfig.Validate(); err != nil {
+		return nil, err
+	}
+	return &phpSpyTracer{config: config.PHPSpyConfig}, nil
+}
+
+func (t *phpSpyTracer) Command(target Target) ([]string, error) {
+	return append([]string{"phpspy"}, t.config.Args(target.PID, target.Version)...), nil
+}
+
+func (t *phpSpyTracer) Output() Output {
+	// phpspy stops by itself once the limit or time limit is reached
+	bounded := t.config.Limit > 0 || t.config.TimeLimitMS > 0
+	return Output{Format: "phpspy", Extension: "trace", Bounded: bounded}
+}
+
+// pySpyTracer traces python processes with py-spy, writing the samples as collapsed stacks
+type pySpyTracer struct {
+	config config.PySpyConfig
+}
+
+func newPySpyTracer(config config.HunterConfig) (Tracer, error) {
+	return &pySpyTracer{config: config.PySpyConfig}, nil
+}
+
+func (t *pySpyTracer) Command(target Target) ([]string, error) {
+	command := []string{"py-spy", "record",
+		"--pid", strconv.Itoa(target.PID),
+		"--duration", strconv.Itoa(target.Duration),
+		"--format", "raw",
+		"--output", "/dev/stdout",
+	}
+	if t.config.Rate > 0 {
+		command = append(command, "--rate", strconv.Itoa(t.config.Rate))
+	}
+	if t.config.Native {
+		command = append(command, "--native")
+	}
+	if t.config.Subprocesses {
+		command = append(command, "--subprocesses")
+	}
+	if t.config.Idle {
+		command = append(command, "--idle")
+	}
+	if t.config.NonBlocking {
+		command = append(command, "--nonblocking")
+	}
+	return command, nil
+}
+
+func (t *pySpyTracer) Output() Output {
+	return Output{Format: "collapsed", Extension: "txt", Bounded: true}
+}
+
+// rbSpyTracer traces ruby processes with rbspy, writing the samples as collapsed stacks
+type rbSpyTracer struct {
+	config config.RbSpyConfig
+}
+
+func newRbSpyTracer(config config.HunterConfig) (Tracer, error) {
+	return &rbSpyTracer{config: config.RbSpyConfig}, nil
+}
+
+func (t *rbSpyTracer) Command(target Target) ([]string, error) {
+	command := []string{"rbspy", "record",
+		"--pid", strconv.Itoa(target.PID),
+		"--duration", strconv.Itoa(target.Duration),
+		"--format", "collapsed",
+		"--file", "/dev/stdout",
+		"--silent",
+	}
+	if t.config.Rate > 0 {
+		command = append(command, "--rate", strconv.Itoa(t.config.Rate))
+	}
+	if t.config.Subprocesses {
+		command = append(command, "--subprocesses")
+	}
+	return command, nil
+}
+
+func (t *rbSpyTracer) Output() Output {
+	return Output{Format: "collapsed", Extension: "txt", Bounded: true}
+}
+
+// nativeTracer takes a single backtrace of every thread in the process with eu-stack or gdb
+type nativeTracer struct {
+	config config.NativeTracerConfig
+}
+
+func newNativeTracer(cfg config.HunterConfig) (Tracer, error) {
+	switch cfg.NativeTracerConfig.Tool {
+	case "", config.NativeToolEUStack, config.NativeToolGDB:
+		return &nativeTracer{config: cfg.NativeTracerConfig}, nil
+	default:
+		return nil, fmt.Errorf("unsupported native tracer tool: %s", cfg.NativeTracerConfig.Tool)
+	}
+}
+
+func (t *nativeTracer) Command(target Target) ([]string, error) {
+	pid := strconv.Itoa(target.PID)
+	if t.config.Tool == config.NativeToolGDB {
+		return []string{"gdb", "-p", pid, "-batch", "-ex", "thread apply all bt"}, nil
+	}
+	return []string{"eu-stack", "-p", pid}, nil
+}
+
+func (t *nativeTracer) Output() Output {
+	return Output{Format: "backtrace", Extension: "txt", Bounded: true}
+}
+
+// commandTracer runs an arbitrary command where each argument is a template rendered with the Target
+// e.g. ["perf", "record", "-p", "{{.PID}}", "-o", "/dev/stdout", "--", "sleep", "{{.Duration}}"]
+type commandTracer struct {
+	args   []*template.Template
+	output Output
+}
+
+func newCommandTracer(config config.HunterConfig) (Tracer, error) {
+	if len(config.CommandTracerConfig.Args) == 0 {
+		return nil, errors.New("command tracer requires args")
+	}
+	t := &commandTracer{
+		output: Output{
+			Format:    config.CommandTracerConfig.OutputFormat,
+			Extension: config.CommandTracerConfig.Extension,
+			Bounded:   config.CommandTracerConfig.Bounded,
+		},
+	}
+	if t.output.Format == "" {
+		t.output.Format = "raw"
+	}
+	if t.output.Extension == "" {
+		t.output.Extension = "trace"
+	}
+	for i, arg := range config.CommandTracerConfig.Args {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command tracer argument %q: %v", arg, err)
+		}
+		t.args = append(t.args, tmpl)
+	}
+	return t, nil
+}
+
+func (t *commandTracer) Command(target Target) ([]string, error) {
+	command := make([]string, 0, len(t.args))
+	for _, tmpl := range t.args {
+		var arg bytes.Buffer
+		if err := tmpl.Execute(&arg, target); err != nil {
+			return nil, fmt.Errorf("failed to render command tracer argument: %v", err)
+		}
+		command = append(command, arg.String())
+	}
+	return command, nil
+}
+
+func (t *commandTracer) Output() Output {
+	return t.output
+}
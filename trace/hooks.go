@@ -0,0 +1,67 @@
+package trace
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"sync"
+)
+
+// HookFunc is called with the metadata of a trace and the configuration it was traced with
+type HookFunc func(config config.HunterConfig, metadata Metadata)
+
+// hook is a registered HookFunc, a pointer so it can be found again when unregistering
+type hook struct {
+	f HookFunc
+}
+
+var (
+	hooksMu       sync.Mutex
+	startHooks    []*hook
+	completeHooks []*hook
+)
+
+// OnStart registers f to be called once a trigger has fired a trace and its metadata has been written
+// f is called from the goroutine that runs the trace so shouldn't block, the returned func unregisters it
+func OnStart(f HookFunc) func() {
+	return register(&startHooks, f)
+}
+
+// OnComplete registers f to be called once each trace has stopped and its files have been closed
+// f is called from the goroutine that ran the trace so shouldn't block, the returned func unregisters it
+func OnComplete(f HookFunc) func() {
+	return register(&completeHooks, f)
+}
+
+func register(hooks *[]*hook, f HookFunc) func() {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	h := &hook{f: f}
+	*hooks = append(*hooks, h)
+	return func() {
+		hooksMu.Lock()
+		defer hooksMu.Unlock()
+		for i, registered := range *hooks {
+			if registered == h {
+				*hooks = append((*hooks)[:i], (*hooks)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func traceStarted(config config.HunterConfig, metadata Metadata) {
+	runHooks(&startHooks, config, metadata)
+}
+
+func traceCompleted(config config.HunterConfig, metadata Metadata) {
+	runHooks(&completeHooks, config, metadata)
+}
+
+func runHooks(hooks *[]*hook, config config.HunterConfig, metadata Metadata) {
+	hooksMu.Lock()
+	registered := append([]*hook(nil), *hooks...)
+	hooksMu.Unlock()
+
+	for _, h := range registered {
+		h.f(config, metadata)
+	}
+}
@@ -0,0 +1,122 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/process"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MetadataSuffix is appended to the trace file name to give the name of its metadata sidecar file
+const MetadataSuffix = ".meta.json"
+
+const (
+	TraceStatusRunning   = "running"
+	TraceStatusCompleted = "completed" // the tracer exited by itself
+	TraceStatusStopped   = "stopped"   // the tracer was stopped after the trace duration
+	TraceStatusFailed    = "failed"
+	// the tracer was stopped by shutdown before the trace duration, the trace only covers the time it ran
+	TraceStatusInterrupted = "interrupted"
+)
+
+// Metadata is written as JSON alongside each trace so the trace can be understood after the node is gone
+type Metadata struct {
+	PID          int                    `json:"pid"`
+	Target       string                 `json:"target"`
+	Application  string                 `json:"application"`
+	OutputFormat string                 `json:"output_format"`
+	TraceFile    string                 `json:"trace_file"`
+	Trigger      string                 `json:"trigger"` // the threshold type that fired the trace, CPU or RSS
+	CPU          float64                `json:"cpu"`     // CPU utilisation measured when the trace was triggered
+	RSS          int64                  `json:"rss"`     // RSS in KiB measured when the trace was triggered
+	Samples      []Sample               `json:"samples,omitempty"`
+	PprofFile    string                 `json:"pprof_file,omitempty"` // the trace converted to a pprof profile, see phpspy.write_pprof
+	Process      *process.Info          `json:"process,omitempty"`
+	Container    *container.Info        `json:"container,omitempty"`
+	Command      []string               `json:"command"` // the tracer argv
+	Status       string                 `json:"status"`
+	ExitCode     *int                   `json:"exit_code,omitempty"` // -1 when the tracer was killed
+	Error        string                 `json:"error,omitempty"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      *time.Time             `json:"end_time,omitempty"` // not set while the trace is running
+	Config       map[string]interface{} `json:"config,omitempty"`   // the configuration of the target that was traced
+}
+
+// Sample is a value measured while checking whether a threshold had been reached
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"` // CPU or RSS
+	Value float64   `json:"value"`
+}
+
+// Duration returns how long the trace ran for, or 0 if it's still running
+func (m Metadata) Duration() time.Duration {
+	if m.EndTime == nil {
+		return 0
+	}
+	return m.EndTime.Sub(m.StartTime)
+}
+
+// Node returns the kubernetes node the trace was taken on, falling back to the configured node name then the hostname
+func (m Metadata) Node(config config.HunterConfig) string {
+	if c := m.Container; c != nil && c.Pod != nil && c.Pod.Node != "" {
+		return c.Pod.Node
+	}
+	if node := os.ExpandEnv(config.Kubernetes.NodeName); node != "" {
+		return node
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// MetadataFileName returns the name of the metadata sidecar file for a trace
+func MetadataFileName(traceFileName string) string {
+	return traceFileName + MetadataSuffix
+}
+
+// writeMetadata writes the metadata sidecar file for a trace
+// the file is written under a temporary name and renamed into place so the API never reads a partly written file
+func writeMetadata(traceDir string, metadata Metadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := MetadataFileName(metadata.TraceFile)
+	tmpFile, err := ioutil.TempFile(traceDir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(traceDir, name))
+}
+
+// ReadMetadata reads the metadata sidecar file for a trace
+func ReadMetadata(traceDir, traceFileName string) (Metadata, error) {
+	data, err := ioutil.ReadFile(filepath.Join(traceDir, MetadataFileName(traceFileName)))
+	if err != nil {
+		return Metadata{}, err
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse metadata for trace %s: %v", traceFileName, err)
+	}
+	return metadata, nil
+}
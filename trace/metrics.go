@@ -0,0 +1,53 @@
+package trace
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// sampleProcess measures the CPU and RSS of a process for its history, recording them and any threshold breaches
+func sampleProcess(p process.ProcessInterface, config config.HunterConfig) (process.Sample, error) {
+	cpu, err := p.GetCPU()
+	if err != nil {
+		return process.Sample{}, err
+	}
+	rss, err := p.GetRSS()
+	if err != nil {
+		return process.Sample{}, err
+	}
+	pid := p.GetID()
+	metrics.ObserveProcessCPU(config.TargetName, pid, cpu)
+	metrics.ObserveProcessRSS(config.TargetName, pid, rss)
+	if cpu > config.ThresholdParams.CPUThreshold {
+		metrics.ThresholdBreaches.Inc(config.TargetName, process.ThresholdTypeCPU)
+	}
+	if rss > config.ThresholdParams.RSSThreshold {
+		metrics.ThresholdBreaches.Inc(config.TargetName, process.ThresholdTypeRSS)
+	}
+	logrus.WithField("pid", pid).Tracef("current process CPU: %.2f RSS: %d", cpu, rss)
+	return process.Sample{Time: clock.Now(), CPU: cpu, RSS: rss}, nil
+}
+
+// triggerSamples returns the CPU and RSS of each sample in the history for the trace metadata
+func triggerSamples(history []process.Sample) []Sample {
+	samples := make([]Sample, 0, 2*len(history))
+	for _, s := range history {
+		samples = append(samples,
+			Sample{Time: s.Time, Type: process.ThresholdTypeCPU, Value: s.CPU},
+			Sample{Time: s.Time, Type: process.ThresholdTypeRSS, Value: float64(s.RSS)})
+	}
+	return samples
+}
+
+// recordTrace records the outcome of a trace that was started at startTime
+func recordTrace(config config.HunterConfig, startTime time.Time, err error) {
+	metrics.TraceDuration.Observe(clock.Now().Sub(startTime).Seconds(), config.TargetName, config.Application)
+	if err != nil {
+		metrics.TracesFailed.Inc(config.TargetName, config.Application)
+		return
+	}
+	metrics.TracesSucceeded.Inc(config.TargetName, config.Application)
+}
@@ -0,0 +1,32 @@
+package trace
+
+import (
+	"github.com/daniel-cole/phunter/pprof"
+	"os"
+	"path/filepath"
+)
+
+// writeProfile converts a finished trace to a pprof profile written alongside it, returning the profile's file name
+func writeProfile(traceDir string, metadata Metadata) (string, error) {
+	traceFile, err := os.Open(filepath.Join(traceDir, metadata.TraceFile))
+	if err != nil {
+		return "", err
+	}
+	defer traceFile.Close()
+
+	profile, err := pprof.Convert(metadata.OutputFormat, traceFile, pprof.Options{Start: metadata.StartTime, Duration: metadata.Duration()})
+	if err != nil {
+		return "", err
+	}
+	profileFileName := metadata.TraceFile + pprof.FileSuffix
+	profileFile, err := os.Create(filepath.Join(traceDir, profileFileName))
+	if err != nil {
+		return "", err
+	}
+	if err := profile.Write(profileFile); err != nil {
+		profileFile.Close()
+		os.Remove(profileFile.Name())
+		return "", err
+	}
+	return profileFileName, profileFile.Close()
+}
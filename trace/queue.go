@@ -0,0 +1,249 @@
+package trace
+
+import (
+	"container/heap"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"sync"
+)
+
+// the reasons a queued trace is dropped, recorded by phunter_traces_refused_total
+const (
+	ReasonQueueFull       = "queue_full"
+	ReasonContainerQueued = "container_queued"
+	ReasonCoalesced       = "coalesced"
+	ReasonStopped         = "stopped"
+)
+
+// job is a triggered trace waiting for a worker
+type job struct {
+	container string  // the container the process is running in, empty when it isn't known
+	priority  float64 // how far over its threshold the process is, the furthest over is traced first
+	seq       uint64  // jobs with the same priority are traced in the order they were queued
+
+	run  func()              // traces the process
+	drop func(reason string) // called instead of run when the job is dropped
+}
+
+// jobHeap orders jobs by priority then by when they were queued
+type jobHeap []*job
+
+func (h jobHeap) Len() int            { return len(h) }
+func (h jobHeap) Less(i, j int) bool  { return before(h[i], h[j]) }
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*job)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return j
+}
+
+// before reports whether job a is traced before job b
+func before(a, b *job) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+// Queue runs triggered traces on a bounded pool of workers, traces waiting for a worker are ordered
+// by how far over the threshold the process is
+type Queue struct {
+	config func() config.QueueConfig
+	wake   chan struct{}
+	wg     sync.WaitGroup // the running traces
+	done   chan struct{}  // closed when Run returns
+
+	mu         sync.Mutex
+	jobs       jobHeap
+	seq        uint64
+	running    int
+	containers map[string]int // the containers with a running trace
+	stopped    bool
+}
+
+// NewQueue returns a queue that reads the number of workers and queue limits from config on each change
+// so a reload takes effect as traces finish
+func NewQueue(config func() config.QueueConfig) *Queue {
+	return &Queue{config: config, wake: make(chan struct{}, 1), done: make(chan struct{}), containers: make(map[string]int)}
+}
+
+// enqueue queues a job, returning false if it was dropped instead
+func (q *Queue) enqueue(j *job) bool {
+	q.mu.Lock()
+	dropped, reason := q.add(j)
+	q.updateMetrics()
+	q.mu.Unlock()
+
+	for _, d := range dropped {
+		d.drop(reason)
+	}
+	q.signal()
+	for _, d := range dropped {
+		if d == j {
+			return false
+		}
+	}
+	return true
+}
+
+// add queues a job applying the queue config, returning the jobs dropped to make room for it, or the job itself
+func (q *Queue) add(j *job) ([]*job, string) {
+	if q.stopped {
+		return []*job{j}, ReasonStopped
+	}
+	queueConfig := q.config()
+
+	if j.container != "" {
+		switch queueConfig.SameContainer {
+		case config.SameContainerDrop:
+			if q.containers[j.container] > 0 || q.queued(j.container) != nil {
+				return []*job{j}, ReasonContainerQueued
+			}
+		case config.SameContainerCoalesce:
+			if queued := q.queued(j.container); queued != nil {
+				if queued.priority >= j.priority {
+					return []*job{j}, ReasonCoalesced
+				}
+				q.remove(queued)
+				q.push(j)
+				return []*job{queued}, ReasonCoalesced
+			}
+		}
+	}
+
+	if queueConfig.MaxQueued > 0 && len(q.jobs) >= queueConfig.MaxQueued {
+		lowest := q.lowest()
+		if lowest.priority >= j.priority {
+			return []*job{j}, ReasonQueueFull
+		}
+		q.remove(lowest)
+		q.push(j)
+		return []*job{lowest}, ReasonQueueFull
+	}
+	q.push(j)
+	return nil, ""
+}
+
+func (q *Queue) push(j *job) {
+	q.seq++
+	j.seq = q.seq
+	heap.Push(&q.jobs, j)
+}
+
+func (q *Queue) remove(j *job) {
+	for i, queued := range q.jobs {
+		if queued == j {
+			heap.Remove(&q.jobs, i)
+			return
+		}
+	}
+}
+
+// queued returns the job queued for a container
+func (q *Queue) queued(container string) *job {
+	for _, j := range q.jobs {
+		if j.container == container {
+			return j
+		}
+	}
+	return nil
+}
+
+// lowest returns the job that would be traced last
+func (q *Queue) lowest() *job {
+	var lowest *job
+	for _, j := range q.jobs {
+		if lowest == nil || before(lowest, j) {
+			lowest = j
+		}
+	}
+	return lowest
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts queued traces while there are free workers until stopped, the traces still queued are dropped
+// when stopped and running traces are left to finish
+func (q *Queue) Run(stop <-chan struct{}) {
+	defer close(q.done)
+	for {
+		for q.startNext() {
+		}
+		select {
+		case <-stop:
+			q.mu.Lock()
+			q.stopped = true
+			dropped := q.jobs
+			q.jobs = nil
+			q.updateMetrics()
+			q.mu.Unlock()
+			for _, j := range dropped {
+				j.drop(ReasonStopped)
+			}
+			return
+		case <-q.wake:
+		}
+	}
+}
+
+// startNext starts the next queued trace on a worker, returning false when there are no free workers or queued traces
+func (q *Queue) startNext() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 || q.running >= q.config().Workers {
+		return false
+	}
+	j := heap.Pop(&q.jobs).(*job)
+	q.running++
+	q.wg.Add(1)
+	if j.container != "" {
+		q.containers[j.container]++
+	}
+	q.updateMetrics()
+
+	go func() {
+		defer q.finished(j)
+		j.run()
+	}()
+	return true
+}
+
+func (q *Queue) finished(j *job) {
+	q.mu.Lock()
+	q.running--
+	if j.container != "" {
+		if q.containers[j.container]--; q.containers[j.container] <= 0 {
+			delete(q.containers, j.container)
+		}
+	}
+	q.updateMetrics()
+	q.mu.Unlock()
+	q.wg.Done()
+	q.signal()
+}
+
+// Wait waits for Run to return once stopped and the running traces to finish, e.g. once they have been
+// interrupted on shutdown
+func (q *Queue) Wait() {
+	<-q.done
+	q.wg.Wait()
+}
+
+// idle reports whether there are no queued or running traces
+func (q *Queue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs) == 0 && q.running == 0
+}
+
+func (q *Queue) updateMetrics() {
+	metrics.TraceQueueLength.Set(float64(len(q.jobs)))
+	metrics.TracesRunning.Set(float64(q.running))
+}
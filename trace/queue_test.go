@@ -0,0 +1,238 @@
+package trace
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testJobs records the order test jobs are run and the reasons they're dropped
+type testJobs struct {
+	mu      sync.Mutex
+	run     []string
+	dropped map[string]string
+	block   chan struct{} // held by running jobs until closed
+}
+
+func newTestJobs() *testJobs {
+	return &testJobs{dropped: make(map[string]string), block: make(chan struct{})}
+}
+
+func (r *testJobs) job(name, container string, priority float64) *job {
+	return &job{
+		container: container,
+		priority:  priority,
+		run: func() {
+			r.mu.Lock()
+			r.run = append(r.run, name)
+			r.mu.Unlock()
+			<-r.block
+		},
+		drop: func(reason string) {
+			r.mu.Lock()
+			r.dropped[name] = reason
+			r.mu.Unlock()
+		},
+	}
+}
+
+func (r *testJobs) ran() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.run...)
+}
+
+func newTestQueue(queueConfig config.QueueConfig) *Queue {
+	return NewQueue(func() config.QueueConfig { return queueConfig })
+}
+
+// runQueue runs the queue until every queued job has run
+func runQueue(t *testing.T, q *Queue) {
+	t.Helper()
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+	waitIdle(t, q)
+}
+
+func TestQueueOrdersByPriority(t *testing.T) {
+	jobs := newTestJobs()
+	close(jobs.block)
+	q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerQueue})
+
+	q.enqueue(jobs.job("low", "", 1.1))
+	q.enqueue(jobs.job("high", "", 3))
+	q.enqueue(jobs.job("mid", "", 2))
+	q.enqueue(jobs.job("mid again", "", 2))
+	runQueue(t, q)
+
+	expected := []string{"high", "mid", "mid again", "low"}
+	if ran := jobs.ran(); !reflect.DeepEqual(ran, expected) {
+		t.Errorf("expected the jobs to run in order %q, instead got %q", expected, ran)
+	}
+}
+
+func TestQueueWorkers(t *testing.T) {
+	jobs := newTestJobs()
+	q := newTestQueue(config.QueueConfig{Workers: 2, SameContainer: config.SameContainerQueue})
+	for _, name := range []string{"a", "b", "c"} {
+		q.enqueue(jobs.job(name, "", 1))
+	}
+
+	if !q.startNext() || !q.startNext() {
+		t.Fatal("expected a job to start on each worker")
+	}
+	if q.startNext() {
+		t.Error("expected no job to start without a free worker")
+	}
+	close(jobs.block)
+	runQueue(t, q)
+	if ran := jobs.ran(); len(ran) != 3 {
+		t.Errorf("expected the queued job to run once a worker was free, instead got %q", ran)
+	}
+}
+
+func TestQueueMaxQueued(t *testing.T) {
+	jobs := newTestJobs()
+	q := newTestQueue(config.QueueConfig{Workers: 1, MaxQueued: 2, SameContainer: config.SameContainerQueue})
+
+	q.enqueue(jobs.job("a", "", 2))
+	q.enqueue(jobs.job("b", "", 1.5))
+	if q.enqueue(jobs.job("c", "", 1.2)) {
+		t.Error("expected a job lower than every queued job not to be queued when the queue is full")
+	}
+	if !q.enqueue(jobs.job("d", "", 3)) {
+		t.Error("expected a job higher than the lowest queued job to be queued when the queue is full")
+	}
+
+	expected := map[string]string{"c": ReasonQueueFull, "b": ReasonQueueFull}
+	if !reflect.DeepEqual(jobs.dropped, expected) {
+		t.Errorf("expected dropped jobs %v, instead got %v", expected, jobs.dropped)
+	}
+}
+
+func TestQueueSameContainer(t *testing.T) {
+	t.Run("queue", func(t *testing.T) {
+		jobs := newTestJobs()
+		q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerQueue})
+		if !q.enqueue(jobs.job("a", "abc", 1)) || !q.enqueue(jobs.job("b", "abc", 2)) {
+			t.Error("expected both jobs for the container to be queued")
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		jobs := newTestJobs()
+		q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerDrop})
+		q.enqueue(jobs.job("a", "abc", 1))
+		if q.enqueue(jobs.job("b", "abc", 2)) {
+			t.Error("expected a job for a container with a queued job to be dropped")
+		}
+		if !q.startNext() {
+			t.Fatal("expected the queued job to start")
+		}
+		if q.enqueue(jobs.job("c", "abc", 2)) {
+			t.Error("expected a job for a container with a running job to be dropped")
+		}
+		if !q.enqueue(jobs.job("d", "def", 1)) || !q.enqueue(jobs.job("e", "", 1)) || !q.enqueue(jobs.job("f", "", 1)) {
+			t.Error("expected jobs for other or unknown containers to be queued")
+		}
+		close(jobs.block)
+		runQueue(t, q)
+
+		expected := map[string]string{"b": ReasonContainerQueued, "c": ReasonContainerQueued}
+		if !reflect.DeepEqual(jobs.dropped, expected) {
+			t.Errorf("expected dropped jobs %v, instead got %v", expected, jobs.dropped)
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		jobs := newTestJobs()
+		close(jobs.block)
+		q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerCoalesce})
+		q.enqueue(jobs.job("a", "abc", 1))
+		if !q.enqueue(jobs.job("b", "abc", 2)) {
+			t.Error("expected a job further over its threshold to replace the queued job")
+		}
+		if q.enqueue(jobs.job("c", "abc", 1.5)) {
+			t.Error("expected a job less over its threshold to be coalesced into the queued job")
+		}
+		runQueue(t, q)
+
+		if ran := jobs.ran(); !reflect.DeepEqual(ran, []string{"b"}) {
+			t.Errorf("expected only the job furthest over its threshold to run, instead got %q", ran)
+		}
+		expected := map[string]string{"a": ReasonCoalesced, "c": ReasonCoalesced}
+		if !reflect.DeepEqual(jobs.dropped, expected) {
+			t.Errorf("expected dropped jobs %v, instead got %v", expected, jobs.dropped)
+		}
+	})
+}
+
+func TestQueueStop(t *testing.T) {
+	jobs := newTestJobs()
+	q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerQueue})
+	q.enqueue(jobs.job("running", "", 2))
+	q.enqueue(jobs.job("queued", "", 1))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.Run(stop)
+		close(done)
+	}()
+	for len(jobs.ran()) == 0 {
+		q.signal()
+	}
+	close(stop)
+	<-done
+
+	if q.enqueue(jobs.job("late", "", 1)) {
+		t.Error("expected a job queued once stopped to be dropped")
+	}
+	close(jobs.block)
+	q.Wait()
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	expected := map[string]string{"queued": ReasonStopped, "late": ReasonStopped}
+	if !reflect.DeepEqual(jobs.dropped, expected) || !reflect.DeepEqual(jobs.run, []string{"running"}) {
+		t.Errorf("expected the running job to finish and the others to be dropped, instead ran %q and dropped %v", jobs.run, jobs.dropped)
+	}
+}
+
+func TestQueueDroppedJobReleasesPIDLockOnce(t *testing.T) {
+	pid := math.MaxInt32 - 2
+	lock, _, ok := lockTrace(pid, "php")
+	if !ok {
+		t.Fatal("expected the pid to be locked")
+	}
+	var other *pidLock
+	j := &job{
+		container: "abc",
+		run:       func() {},
+		drop: func(reason string) {
+			lock.release()
+			// another target's check locks the pid as soon as the dropped job releases it
+			other, _, _ = lockTrace(pid, "worker")
+		},
+	}
+	q := newTestQueue(config.QueueConfig{Workers: 1, SameContainer: config.SameContainerDrop})
+	q.enqueue(&job{container: "abc", run: func() {}, drop: func(string) {}})
+	if q.enqueue(j) {
+		t.Fatal("expected the job for a container with a queued job to be dropped")
+	}
+	if other == nil {
+		t.Fatal("expected the pid to be locked by the other target once the job was dropped")
+	}
+	defer other.release()
+
+	// as AttemptTrace releases the lock when the job wasn't queued
+	lock.release()
+	mu.Lock()
+	holder := tracePIDMap[pid]
+	mu.Unlock()
+	if holder != "worker" {
+		t.Errorf("expected the lock held by the worker target to survive, instead the pid is locked by %q", holder)
+	}
+}
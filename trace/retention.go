@@ -0,0 +1,76 @@
+package trace
+
+import (
+	"errors"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/pprof"
+	"github.com/daniel-cole/phunter/retention"
+	"github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ReasonDiskSpace is recorded by phunter_traces_refused_total when a trace is refused below the free space floor
+const ReasonDiskSpace = "disk_space"
+
+// traceFilePattern matches the names runTracer gives trace files, [<container>-]<pid>-<RFC3339 timestamp>.<extension>
+var traceFilePattern = regexp.MustCompile(`^(.+-)?[0-9]+-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}(Z|[+-][0-9]{2}:[0-9]{2})\.[^./]+$`)
+
+// RetentionDir returns the trace directory with each trace grouped with its metadata file and pprof profile
+// and the traces currently being written excluded from eviction
+// files not named like a trace or one of its sidecars are left alone so trace_dir can be shared
+func RetentionDir(traceDir string) retention.Dir {
+	return retention.Dir{
+		Path: traceDir,
+		Group: func(name string) (string, bool) {
+			trace := strings.TrimSuffix(strings.TrimSuffix(name, MetadataSuffix), pprof.FileSuffix)
+			return trace, traceFilePattern.MatchString(trace)
+		},
+		InUse: Running,
+	}
+}
+
+// EnforceRetention evicts the oldest traces until the trace directory is within the retention limits
+func EnforceRetention(config config.HunterConfig) error {
+	result, err := RetentionDir(config.TraceDir).Enforce(config.Retention.Policy(), clock.Now())
+	for _, eviction := range result.Evicted {
+		logrus.WithFields(logrus.Fields{"trace": eviction.Trace, "reason": eviction.Reason}).
+			Infof("evicted trace of %d bytes", eviction.Bytes)
+		metrics.RetentionEvictions.Inc(eviction.Reason)
+		metrics.RetentionEvictedBytes.Add(float64(eviction.Bytes), eviction.Reason)
+	}
+	if err != nil {
+		return err
+	}
+	metrics.TraceDirTraces.Set(float64(result.Traces))
+	metrics.TraceDirBytes.Set(float64(result.Bytes))
+	return nil
+}
+
+// prepareTraceDir creates the trace directory and makes room for a new trace
+// the trace is refused when the filesystem is still below the free space floor
+func prepareTraceDir(config config.HunterConfig) error {
+	log := logrus.WithField("target", config.TargetName)
+	if err := os.MkdirAll(config.TraceDir, 0600); err != nil {
+		log.Errorf("failed to create trace directory: %s", config.TraceDir)
+		return err
+	}
+	if err := EnforceRetention(config); err != nil {
+		log.Errorf("failed to enforce trace retention: %v", err)
+	}
+
+	free, err := retention.CheckFreeSpace(config.TraceDir, config.Retention.Policy())
+	if errors.Is(err, retention.ErrInsufficientSpace) {
+		log.Warnf("refusing to start trace: %v", err)
+		metrics.TracesRefused.Inc(config.TargetName, ReasonDiskSpace)
+		return err
+	}
+	if err != nil {
+		log.Errorf("failed to check free space in the trace directory: %v", err)
+		return nil
+	}
+	metrics.TraceDirFreeBytes.Set(float64(free))
+	return nil
+}
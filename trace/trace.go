@@ -1,164 +1,452 @@
 package trace
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/cooldown"
+	"github.com/daniel-cole/phunter/metrics"
 	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/system"
 	"github.com/sirupsen/logrus"
 	"os"
-	"os/exec"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// boundedTracerGracePeriod is how long a bounded tracer can run past the trace duration before it is stopped
+const boundedTracerGracePeriod = 30 * time.Second
+
+// tracerStopGracePeriod is how long a tracer has to exit after being interrupted before it is killed
+const tracerStopGracePeriod = 10 * time.Second
+
 var (
-	mu          sync.Mutex
-	tracePIDMap map[int]bool
+	mu           sync.Mutex
+	tracePIDMap  map[int]string  // the target each pid is locked for, shared by every target as only one tracer can attach
+	activeTraces map[string]bool // trace files being written, which retention mustn't evict
+
+	// clock and runner are replaced by fakes in tests
+	clock  system.Clock         = system.RealClock
+	runner system.CommandRunner = system.ExecRunner
+
+	// cooldowns limits how often processes are traced once their traces finish
+	cooldowns = cooldown.NewLimiter(clock)
 )
 
 func init() {
-	tracePIDMap = make(map[int]bool)
+	tracePIDMap = make(map[int]string)
+	activeTraces = make(map[string]bool)
 }
 
-// AttemptTrace will trace the specified process ID for the specified duration
-func AttemptTrace(p process.ProcessInterface, thresholds process.Thresholds, config config.HunterConfig) error {
+// AttemptTrace samples the CPU and RSS of a process into its history and queues a trace of the process when
+// a trigger fires from the history, processes that are already being traced or queued are skipped without an error
+// the trace is interrupted when the context is cancelled
+func AttemptTrace(ctx context.Context, p process.ProcessInterface, history *process.History, queue *Queue, config config.HunterConfig) error {
 
 	pid := p.GetID()
 
-	mu.Lock()
-
 	// check if pid already has a running trace
 	logrus.WithField("pid", pid).Tracef("checking if trace already running")
-	if tracePIDMap[pid] {
-		mu.Unlock()
-		logrus.WithField("pid", pid).Tracef("trace already running")
-		return errors.New(fmt.Sprintf("trace already running"))
+	// the pid is locked while it's queued or traced, or checked by another target matching it, which is expected
+	lock, target, ok := lockTrace(pid, config.TargetName)
+	if !ok {
+		logrus.WithField("pid", pid).Debugf("not checking process: trace already running for target %s", target)
+		metrics.TracesSkipped.Inc(config.TargetName)
+		return nil
 	}
 
 	// no trace running, safe to start new trace
 	logrus.WithField("pid", pid).Debugf("checking if trace should be triggered")
-	tracePIDMap[pid] = true
-	mu.Unlock()
+	// the pid stays locked while the trace is queued, the job unlocks it once run or dropped
+	queued := false
+	defer func() {
+		if !queued {
+			lock.release()
+		}
+	}()
 
-	if thresholdType, trigger := process.CheckThresholdTriggers(p, thresholds, config.ThresholdParams); trigger {
-		logrus.WithField("pid", pid).Infof("%s trigger fired trace", thresholdType)
-		err := runTrace(p, config)
-		if err != nil {
-			logrus.WithField("pid", pid).Error("failed to run trace")
-			unlockTrace(pid)
-			return err
+	sample, err := sampleProcess(p, config)
+	if errors.Is(err, process.ErrNoCPUSample) {
+		// the CPU utilisation is measured from the next check
+		logrus.WithField("pid", pid).Debug("took first CPU sample")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	history.Add(sample)
+	samples := history.Samples()
+	evaluation, fired := config.ThresholdParams.Evaluate(samples)
+	if !fired {
+		for _, e := range config.ThresholdParams.Evaluations(samples) {
+			logrus.WithField("pid", pid).Debugf("trigger not fired: %s", e)
 		}
+		return nil
+	}
+
+	logrus.WithField("pid", pid).Infof("%s trigger fired: %s", evaluation.Type, evaluation)
+	metrics.TriggersFired.Inc(config.TargetName, evaluation.Type)
+
+	containerInfo, err := findContainer(p, config)
+	if err != nil {
+		logrus.WithField("pid", pid).Error("failed to get container name for process")
+		return err
+	}
+	// the history is kept while the trace is refused so the process is traced once allowed if it's still over
+	key := cooldownKey(p, config, containerInfo)
+	if err := cooldowns.Check(config.Cooldown.Policy(), key); err != nil {
+		return refuseTrace(pid, config, err)
 	}
 
-	unlockTrace(pid)
-	logrus.WithField("pid", pid).Trace("finished trace")
+	trigger := Trigger{Type: evaluation.Type, CPU: sample.CPU, RSS: sample.RSS, Samples: triggerSamples(samples)}
+	drop := func(reason string) {
+		lock.release()
+		logrus.WithField("pid", pid).Infof("not tracing process: trace dropped from the queue by %s", reason)
+		metrics.TracesRefused.Inc(config.TargetName, reason)
+	}
+	j := &job{
+		container: key.Container,
+		priority:  evaluation.Overage(),
+		run: func() {
+			// the queue may start a trace as it's being stopped
+			if ctx.Err() != nil {
+				drop(ReasonStopped)
+				return
+			}
+			defer lock.release()
+			if err := startTrace(ctx, p, history, config, key, trigger, containerInfo); err != nil {
+				logrus.WithField("pid", pid).Errorf("failed to run trace: %v", err)
+			}
+		},
+		drop: drop,
+	}
+	queued = queue.enqueue(j)
+	if queued {
+		logrus.WithField("pid", pid).Debug("queued trace")
+	}
 	return nil
 }
 
-func unlockTrace(pid int) {
-	mu.Lock()
-	tracePIDMap[pid] = false
-	mu.Unlock()
-}
-
-func runTrace(p process.ProcessInterface, config config.HunterConfig) error {
-	switch config.Application {
-	case "php":
-		err := runPHPTrace(p,
-			config.ApplicationVersion,
-			config.TraceDuration,
-			config.TraceDir,
-			config.Docker,
-			config.Timezone,
-			config.Dryrun,
-			config.PHPSpyConfig,
-		)
-		if err != nil {
-			logrus.WithField("pid", p.GetID()).Errorf("failed to run trace %v", err)
-			return err
-		}
-	default:
-		logrus.Fatal("unsupported application")
+// startTrace runs a queued trace once the cooldowns allow it, they are checked again as other traces may have
+// finished or started while it was queued, the cooldowns only start when the tracer ran
+// the history is kept when the trace is refused so the process is traced once allowed if it's still over
+func startTrace(ctx context.Context, p process.ProcessInterface, history *process.History, config config.HunterConfig,
+	key cooldown.Key, trigger Trigger, containerInfo *container.Info) error {
+
+	release, err := cooldowns.Acquire(config.Cooldown.Policy(), key)
+	if err != nil {
+		return refuseTrace(p.GetID(), config, err)
+	}
+	// a new window of samples is needed before the process is traced again
+	history.Reset()
+
+	traced, err := runTrace(ctx, p, config, trigger, containerInfo)
+	release(traced)
+	if err != nil {
+		return err
 	}
+	logrus.WithField("pid", p.GetID()).Trace("finished trace")
 	return nil
 }
 
-func runPHPTrace(p process.ProcessInterface, phpVersion string, traceDuration int, traceDir string, docker bool,
-	timezone string, dryrun bool, spyConfig config.PHPSpyConfig) error {
+// refuseTrace records a trace refused by the cooldowns, returning any other error
+func refuseTrace(pid int, config config.HunterConfig, err error) error {
+	var refused *cooldown.RefusedError
+	if errors.As(err, &refused) {
+		logrus.WithField("pid", pid).Infof("not tracing process: %v", err)
+		metrics.TracesRefused.Inc(config.TargetName, refused.Reason)
+		return nil
+	}
+	return err
+}
 
-	var err error
-	var containerName string
-	var traceFileName string
+// findContainer returns the container the process is running in, nil when no container resolver is configured
+func findContainer(p process.ProcessInterface, config config.HunterConfig) (*container.Info, error) {
+	if config.ContainerResolverType() == "" {
+		return nil, nil
+	}
+	info, err := p.FindContainer()
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
 
-	pid := p.GetID()
-	loc, _ := time.LoadLocation(timezone)
-	timestamp := time.Now().In(loc).Format(time.RFC3339)
-	// attempt to get the container name if docker has been set to true
-	if docker {
-		containerName, err = p.FindContainerName()
-		if err != nil {
-			logrus.WithField("pid", pid).Error("failed to get container name for process")
-			return err
+// cooldownKey returns what a trace of the process counts against, the start time is left as 0 when it can't be read
+func cooldownKey(p process.ProcessInterface, config config.HunterConfig, containerInfo *container.Info) cooldown.Key {
+	key := cooldown.Key{Target: config.TargetName, PID: p.GetID()}
+	if stat, err := process.NewProcFS(config.ProcRoot).Stat(key.PID); err == nil {
+		key.StartTime = stat.StartTime
+	}
+	if containerInfo != nil {
+		key.Container = containerInfo.ID
+		if key.Container == "" {
+			key.Container = containerInfo.Name
 		}
-		traceFileName = fmt.Sprintf("%s-%d-%s.trace", containerName, pid, timestamp)
+	}
+	return key
+}
+
+// CooldownState returns the cooldowns in effect and the traces counted against the cooldown limits
+func CooldownState() cooldown.State {
+	return cooldowns.State()
+}
+
+// pidLock is a lock on a pid held by a target while it's checked, queued and traced
+type pidLock struct {
+	pid  int
+	once sync.Once
+}
+
+// lockTrace locks the pid for the target, returning the target holding the lock when it's already locked
+func lockTrace(pid int, target string) (*pidLock, string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if holder, ok := tracePIDMap[pid]; ok {
+		return nil, holder, false
+	}
+	tracePIDMap[pid] = target
+	return &pidLock{pid: pid}, target, true
+}
+
+// release unlocks the pid, only the first call unlocks it as another target may have locked the pid since
+func (l *pidLock) release() {
+	l.once.Do(func() {
+		mu.Lock()
+		delete(tracePIDMap, l.pid)
+		mu.Unlock()
+	})
+}
+
+func setTraceFileInUse(traceFileName string, inUse bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if inUse {
+		activeTraces[traceFileName] = true
 	} else {
-		traceFileName = fmt.Sprintf("%d-%s.trace", pid, timestamp)
+		delete(activeTraces, traceFileName)
 	}
+}
+
+// Running reports whether a tracer in this process is writing the trace file, a trace whose metadata has no end time
+// but isn't running was interrupted by phunter exiting before it could record the outcome
+func Running(traceFileName string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return activeTraces[traceFileName]
+}
+
+// Trigger describes why a trace was started
+type Trigger struct {
+	Type    string   // the threshold type that fired the trace, CPU or RSS
+	CPU     float64  // the last CPU utilisation measured before the trace
+	RSS     int64    // the last RSS in KiB measured before the trace
+	Samples []Sample // the values in the sample history the trigger fired from
+}
 
-	logrus.WithField("pid", pid).Infof("trace will be written to %s", traceFileName)
+// runTrace runs a trace of the process, returning whether the tracer ran and wrote a trace file
+func runTrace(ctx context.Context, p process.ProcessInterface, config config.HunterConfig, trigger Trigger,
+	containerInfo *container.Info) (traced bool, err error) {
 
-	err = os.MkdirAll(traceDir, 0600)
+	if err := prepareTraceDir(config); err != nil {
+		return false, err
+	}
+	metrics.TracesStarted.Inc(config.TargetName, config.Application)
+	startTime := clock.Now()
+	defer func() { recordTrace(config, startTime, err) }()
+
+	tracer, err := NewTracer(config)
 	if err != nil {
-		logrus.WithField("pid", pid).Errorf("failed to create trace directory: %s", traceDir)
-		return err
+		logrus.WithField("pid", p.GetID()).Errorf("failed to create tracer: %v", err)
+		return false, err
 	}
-	traceFile, err := os.Create(fmt.Sprintf("%s/%s", traceDir, traceFileName))
+	traced, err = runTracer(ctx, p, tracer, config, trigger, containerInfo)
 	if err != nil {
-		return err
+		logrus.WithField("pid", p.GetID()).Errorf("failed to run trace %v", err)
+		return traced, err
 	}
+	return traced, nil
+}
+
+// runTracer runs the tracer against the process for the trace duration, the tracer is interrupted when the context
+// is cancelled and the trace kept as a partial trace, traced is true once the tracer has started writing the trace file
+func runTracer(ctx context.Context, p process.ProcessInterface, tracer Tracer, config config.HunterConfig, trigger Trigger,
+	containerInfo *container.Info) (traced bool, err error) {
 
-	var traceCommand *exec.Cmd
-	if dryrun {
-		traceCommand = exec.Command("echo", "dryrun")
+	var traceFileName string
+
+	pid := p.GetID()
+	log := logrus.WithFields(logrus.Fields{"pid": pid, "target": config.TargetName, "application": config.Application})
+	output := tracer.Output()
+	loc, _ := time.LoadLocation(config.Timezone)
+	startTime := clock.Now().In(loc)
+	timestamp := startTime.Format(time.RFC3339)
+	metadata := Metadata{
+		PID:          pid,
+		Target:       config.TargetName,
+		Application:  config.Application,
+		OutputFormat: output.Format,
+		Trigger:      trigger.Type,
+		CPU:          trigger.CPU,
+		RSS:          trigger.RSS,
+		Samples:      trigger.Samples,
+		StartTime:    startTime,
+		Status:       TraceStatusRunning,
+	}
+	if metadata.Config, err = config.Snapshot(); err != nil {
+		log.Errorf("failed to record configuration in trace metadata: %v", err)
+	}
+	if processInfo, err := process.NewProcFS(config.ProcRoot).Info(pid); err != nil {
+		log.Errorf("failed to record process in trace metadata: %v", err)
+	} else {
+		metadata.Process = &processInfo
+	}
+
+	// the container is resolved when the trace is queued if a container resolver has been configured
+	if containerInfo != nil {
+		metadata.Container = containerInfo
+		log = log.WithFields(containerInfo.LogFields())
+		traceFileName = fmt.Sprintf("%s-%d-%s.%s", containerInfo.DisplayName(), pid, timestamp, output.Extension)
 	} else {
-		traceCommand = exec.Command("phpspy",
-			fmt.Sprintf("-V%s", phpVersion), "-p", strconv.Itoa(pid),
-			"-T", spyConfig.Threads,
-			"-s", spyConfig.Sleep,
-			"-H", spyConfig.Rate,
-			"-l", spyConfig.Limit,
-		)
+		traceFileName = fmt.Sprintf("%d-%s.%s", pid, timestamp, output.Extension)
 	}
+	metadata.TraceFile = traceFileName
 
-	logrus.WithField("pid", pid).Debugf("trace command: %s", traceCommand)
+	// built before the trace file is created so a tracer that can't run doesn't leave an empty trace behind
+	traceDuration := config.TraceDuration
+	command := []string{"echo", "dryrun"}
+	if !config.Dryrun {
+		command, err = tracer.Command(Target{PID: pid, Version: config.ApplicationVersion, Duration: traceDuration})
+		if err != nil {
+			log.Errorf("failed to build trace command: %v", err)
+			return false, err
+		}
+	}
+	metadata.Command = command
 
-	traceCommand.Stdout = traceFile
-	traceCommand.Stderr = traceFile
+	log.Infof("trace will be written to %s", traceFileName)
 
-	if err := traceCommand.Start(); err != nil {
-		return err
+	traceDir := config.TraceDir
+	// registered first so it runs after every other deferred call has closed the files and recorded the outcome
+	metadataWritten := false
+	defer func() {
+		if metadataWritten {
+			traceCompleted(config, metadata)
+		}
+	}()
+	setTraceFileInUse(traceFileName, true)
+	defer setTraceFileInUse(traceFileName, false)
+	traceFile, err := os.Create(fmt.Sprintf("%s/%s", traceDir, traceFileName))
+	if err != nil {
+		return false, err
+	}
+	defer traceFile.Close()
+	defer func() {
+		if info, err := traceFile.Stat(); err == nil {
+			metrics.TraceBytes.Add(float64(info.Size()), config.TargetName, config.Application)
+		}
+	}()
+
+	var traceCommand system.Command
+
+	if err := writeMetadata(traceDir, metadata); err != nil {
+		log.Errorf("failed to write trace metadata: %v", err)
+	} else {
+		metadataWritten = true
+		traceStarted(config, metadata)
+	}
+	// the outcome is recorded once the tracer has stopped so running traces can be told apart
+	defer func() {
+		endTime := clock.Now().In(loc)
+		metadata.EndTime = &endTime
+		if err != nil {
+			metadata.Status = TraceStatusFailed
+			metadata.Error = err.Error()
+		}
+		if traceCommand != nil {
+			exitCode := traceCommand.ExitCode()
+			metadata.ExitCode = &exitCode
+		}
+		if err == nil && output.Format == "phpspy" && config.PHPSpyConfig.WritePprof {
+			profileFileName, err := writeProfile(traceDir, metadata)
+			if err != nil {
+				log.Errorf("failed to convert trace to a pprof profile: %v", err)
+			}
+			metadata.PprofFile = profileFileName
+		}
+		if err := writeMetadata(traceDir, metadata); err != nil {
+			log.Errorf("failed to write trace metadata: %v", err)
+		}
+	}()
+
+	log.Debugf("trace command: %s", strings.Join(command, " "))
+
+	traceCommand, err = runner.Start(command, traceFile, traceFile)
+	if err != nil {
+		return false, err
 	}
 	done := make(chan error, 1)
 	go func() {
 		done <- traceCommand.Wait()
 	}()
+	// bounded tracers are given extra time to stop by themselves and write out their trace
+	timeout := time.Duration(traceDuration) * time.Second
+	if output.Bounded {
+		timeout += boundedTracerGracePeriod
+	}
 	select {
-	case <-time.After(time.Duration(traceDuration) * time.Second):
-		if err := traceCommand.Process.Kill(); err != nil {
-			logrus.WithField("pid", pid).Error("failed to kill process after specified trace duration")
-			return err
+	case <-clock.After(timeout):
+		if err := stopTracer(traceCommand, done, log); err != nil {
+			log.Error("failed to stop process after specified trace duration")
+			return true, err
 		}
-		logrus.WithField("pid", pid).Infof("trace stopped after %d seconds", traceDuration)
-		logrus.WithField("pid", pid).Infof("trace written to %s", traceFileName)
-		return nil
+		metadata.Status = TraceStatusStopped
+		log.Infof("trace stopped after %d seconds", traceDuration)
+		log.Infof("trace written to %s", traceFileName)
+		return true, nil
+	case <-ctx.Done():
+		if err := stopTracer(traceCommand, done, log); err != nil {
+			log.Error("failed to stop process on shutdown")
+			return true, err
+		}
+		metadata.Status = TraceStatusInterrupted
+		log.Warnf("trace interrupted by shutdown, partial trace written to %s", traceFileName)
+		return true, nil
 	case err := <-done:
 		if err != nil {
-			logrus.WithField("pid", pid).Error("unexpected tracing error")
-			return err
+			log.Error("unexpected tracing error")
+			return true, err
+		}
+		metadata.Status = TraceStatusCompleted
+		if output.Bounded {
+			log.Infof("trace written to %s", traceFileName)
+			return true, nil
 		}
-		logrus.WithField("pid", pid).Error("trace finished before elasped trace duration")
+		log.Error("trace finished before elasped trace duration")
+	}
+	return true, nil
+}
+
+// stopTracer interrupts the tracer so it can flush its output, and kills it if it hasn't exited within
+// tracerStopGracePeriod, done receives the result of waiting for the tracer
+func stopTracer(traceCommand system.Command, done <-chan error, log *logrus.Entry) error {
+	if err := traceCommand.Signal(os.Interrupt); err != nil {
+		log.Warnf("failed to interrupt tracer: %v", err)
+	} else {
+		select {
+		case <-done:
+			return nil
+		case <-clock.After(tracerStopGracePeriod):
+			log.Warnf("tracer still running %s after being interrupted, killing it", tracerStopGracePeriod)
+		}
+	}
+	if err := traceCommand.Kill(); err != nil {
+		return err
 	}
+	// wait for the tracer to exit so its exit status is recorded
+	<-done
 	return nil
 }
@@ -0,0 +1,624 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/cooldown"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/pprof"
+	"github.com/daniel-cole/phunter/process"
+	"github.com/daniel-cole/phunter/process/processtest"
+	"github.com/daniel-cole/phunter/retention"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunTracerWritesMetadata(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.TraceDuration = 1
+	traceConfig.Dryrun = true
+	traceConfig.Docker = true
+	traceConfig.TargetName = "php"
+	tracer, err := NewTracer(traceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []Sample{{Type: "CPU", Value: 200}, {Type: "CPU", Value: 250}}
+
+	var hookStatuses []string
+	recordHook := func(_ config.HunterConfig, metadata Metadata) {
+		hookStatuses = append(hookStatuses, metadata.Status)
+	}
+	t.Cleanup(OnStart(recordHook))
+	t.Cleanup(OnComplete(recordHook))
+
+	p := &processtest.Process{ID: os.Getpid()}
+	traced, err := runTracer(context.Background(), p, tracer, traceConfig, Trigger{Type: "CPU", CPU: 250, RSS: 1024, Samples: samples},
+		&container.Info{Name: "web"})
+	if err != nil || !traced {
+		t.Fatalf("expected the trace to run, instead got %t: %v", traced, err)
+	}
+	if !reflect.DeepEqual(hookStatuses, []string{TraceStatusRunning, TraceStatusCompleted}) {
+		t.Errorf("expected the start and complete hooks to be called in order, instead got %v", hookStatuses)
+	}
+
+	files, err := ioutil.ReadDir(traceDir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected a trace and its metadata, instead got %d files: %v", len(files), err)
+	}
+	metadata, err := ReadMetadata(traceDir, files[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Target != "php" || metadata.Trigger != "CPU" || metadata.CPU != 250 || metadata.RSS != 1024 {
+		t.Errorf("unexpected trigger in metadata: %+v", metadata)
+	}
+	if !reflect.DeepEqual(metadata.Samples, samples) {
+		t.Errorf("expected samples %+v, instead got %+v", samples, metadata.Samples)
+	}
+	if !reflect.DeepEqual(metadata.Command, []string{"echo", "dryrun"}) {
+		t.Errorf("unexpected command: %v", metadata.Command)
+	}
+	if metadata.Status != TraceStatusCompleted || metadata.ExitCode == nil || *metadata.ExitCode != 0 {
+		t.Errorf("expected the trace to complete with exit code 0, instead got %s %v", metadata.Status, metadata.ExitCode)
+	}
+	if metadata.EndTime == nil || metadata.EndTime.Before(metadata.StartTime) {
+		t.Errorf("expected the end time to be after the start time: %v %v", metadata.StartTime, metadata.EndTime)
+	}
+	if metadata.Process == nil || metadata.Process.Cmdline == "" {
+		t.Errorf("expected the process to be recorded, instead got %+v", metadata.Process)
+	}
+	if metadata.Container == nil || metadata.Container.Name != "web" {
+		t.Errorf("expected the container to be recorded, instead got %+v", metadata.Container)
+	}
+	if metadata.Config["application"] != "php" || metadata.Config["trace_dir"] != traceDir {
+		t.Errorf("expected the configuration to be recorded, instead got %v", metadata.Config)
+	}
+}
+
+// useFakes replaces the clock and command runner with fakes until the test finishes, the cooldowns are timed
+// by the fake clock
+func useFakes(t *testing.T, command *systemtest.Command) (*systemtest.Clock, *systemtest.Runner) {
+	fakeClock := systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	fakeRunner := &systemtest.Runner{New: func([]string) *systemtest.Command { return command }}
+	realCooldowns := cooldowns
+	clock, runner, cooldowns = fakeClock, fakeRunner, cooldown.NewLimiter(fakeClock)
+	t.Cleanup(func() { clock, runner, cooldowns = system.RealClock, system.ExecRunner, realCooldowns })
+	return fakeClock, fakeRunner
+}
+
+// waitForWaiters waits for the code under test to wait on n timers of the fake clock
+func waitForWaiters(t *testing.T, clock *systemtest.Clock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers, instead got %d", n, clock.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// runFakeTracer runs phpspy for 30 seconds as a fake command, act is called once the tracer has started
+func runFakeTracer(t *testing.T, command *systemtest.Command,
+	act func(clock *systemtest.Clock, cancel context.CancelFunc)) (Metadata, string, []string, error) {
+
+	t.Helper()
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+	clock, runner := useFakes(t, command)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.TraceDuration = 30
+	traceConfig.TargetName = "php"
+	tracer, err := NewTracer(traceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := runTracer(ctx, &processtest.Process{ID: os.Getpid()}, tracer, traceConfig, Trigger{Type: "CPU"}, nil)
+		result <- err
+	}()
+	waitForWaiters(t, clock, 1)
+	act(clock, cancel)
+	select {
+	case err = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the trace to finish")
+	}
+
+	files, readErr := ioutil.ReadDir(traceDir)
+	if readErr != nil || len(files) != 2 {
+		t.Fatalf("expected a trace and its metadata, instead got %d files: %v", len(files), readErr)
+	}
+	metadata, readErr := ReadMetadata(traceDir, files[0].Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	output, readErr := ioutil.ReadFile(filepath.Join(traceDir, metadata.TraceFile))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if started := runner.Started(); len(started) != 1 || started[0][0] != "phpspy" {
+		t.Errorf("expected phpspy to be started, instead got %q", started)
+	}
+	return metadata, string(output), signalNames(command.Signals()), err
+}
+
+func signalNames(signals []os.Signal) []string {
+	names := make([]string, len(signals))
+	for i, sig := range signals {
+		names[i] = sig.String()
+	}
+	return names
+}
+
+func TestWriteMetadataReplacesSidecar(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	metadata := Metadata{PID: 4242, TraceFile: "web-4242-2020-08-01T12:00:00Z.trace", Status: TraceStatusRunning}
+	if err := writeMetadata(traceDir, metadata); err != nil {
+		t.Fatal(err)
+	}
+	metadata.Status = TraceStatusCompleted
+	if err := writeMetadata(traceDir, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ReadMetadata(traceDir, metadata.TraceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Status != TraceStatusCompleted {
+		t.Errorf("expected the sidecar to be replaced, instead got status %s", actual.Status)
+	}
+	files, err := ioutil.ReadDir(traceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != MetadataFileName(metadata.TraceFile) || files[0].Mode().Perm() != 0644 {
+		t.Errorf("expected only the sidecar to be left in the trace directory, instead got %v", files)
+	}
+}
+
+func TestHooksUnregister(t *testing.T) {
+	var called []string
+	unregisterFirst := OnComplete(func(config.HunterConfig, Metadata) { called = append(called, "first") })
+	unregisterSecond := OnComplete(func(config.HunterConfig, Metadata) { called = append(called, "second") })
+	defer unregisterSecond()
+
+	unregisterFirst()
+	// unregistering twice has no effect
+	unregisterFirst()
+	traceCompleted(config.Default(), Metadata{})
+	if !reflect.DeepEqual(called, []string{"second"}) {
+		t.Errorf("expected only the registered hook to be called, instead got %v", called)
+	}
+}
+
+func TestRunTracerStoppedAfterDuration(t *testing.T) {
+	command := systemtest.NewCommand()
+	command.Output = "started\n"
+	command.InterruptOutput = "flushed\n"
+	metadata, output, signals, err := runFakeTracer(t, command, func(clock *systemtest.Clock, _ context.CancelFunc) {
+		clock.Advance(29 * time.Second)
+		if command.ExitCode() != -1 {
+			t.Error("expected the tracer to run for the trace duration")
+		}
+		clock.Advance(time.Second)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != TraceStatusStopped || metadata.ExitCode == nil || *metadata.ExitCode != 0 {
+		t.Errorf("expected the trace to be stopped, instead got %s %v", metadata.Status, metadata.ExitCode)
+	}
+	if metadata.EndTime == nil || metadata.EndTime.Sub(metadata.StartTime) != 30*time.Second {
+		t.Errorf("expected the trace to end after 30 seconds: %v %v", metadata.StartTime, metadata.EndTime)
+	}
+	if output != "started\nflushed\n" || !reflect.DeepEqual(signals, []string{"interrupt"}) {
+		t.Errorf("expected the tracer to be interrupted and flush its output, instead got %q %q", output, signals)
+	}
+}
+
+func TestRunTracerInterrupted(t *testing.T) {
+	command := systemtest.NewCommand()
+	command.InterruptOutput = "flushed\n"
+	metadata, output, _, err := runFakeTracer(t, command, func(_ *systemtest.Clock, cancel context.CancelFunc) {
+		cancel()
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != TraceStatusInterrupted || metadata.ExitCode == nil || *metadata.ExitCode != 0 {
+		t.Errorf("expected the trace to be recorded as interrupted, instead got %s %v", metadata.Status, metadata.ExitCode)
+	}
+	if output != "flushed\n" {
+		t.Errorf("expected the tracer to flush its output, instead got %q", output)
+	}
+}
+
+func TestRunTracerKilledAfterGracePeriod(t *testing.T) {
+	command := systemtest.NewCommand()
+	command.IgnoreInterrupt = true
+	metadata, _, signals, err := runFakeTracer(t, command, func(clock *systemtest.Clock, cancel context.CancelFunc) {
+		cancel()
+		// the trace duration and the grace period
+		waitForWaiters(t, clock, 2)
+		clock.Advance(tracerStopGracePeriod)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != TraceStatusInterrupted || metadata.ExitCode == nil || *metadata.ExitCode != -1 {
+		t.Errorf("expected the killed trace to be recorded as interrupted, instead got %s %v", metadata.Status, metadata.ExitCode)
+	}
+	if !reflect.DeepEqual(signals, []string{"interrupt", "killed"}) {
+		t.Errorf("expected the tracer to be interrupted then killed, instead got %q", signals)
+	}
+}
+
+func TestRunTracerFailed(t *testing.T) {
+	command := systemtest.NewCommand()
+	metadata, _, _, err := runFakeTracer(t, command, func(*systemtest.Clock, context.CancelFunc) {
+		command.Exit(2)
+	})
+
+	if err == nil {
+		t.Error("expected the tracer exiting with an error to fail the trace")
+	}
+	if metadata.Status != TraceStatusFailed || metadata.ExitCode == nil || *metadata.ExitCode != 2 || metadata.Error != "exit status 2" {
+		t.Errorf("expected the trace to fail with exit code 2, instead got %s %v %q", metadata.Status, metadata.ExitCode, metadata.Error)
+	}
+}
+
+func TestRunTracerCommandFailed(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.TargetName = "command"
+	traceConfig.Application = "command"
+	traceConfig.CommandTracerConfig = config.CommandTracerConfig{Args: []string{"trace", "{{.Pid}}"}}
+	tracer, err := NewTracer(traceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traced, err := runTracer(context.Background(), &processtest.Process{ID: os.Getpid()}, tracer, traceConfig, Trigger{Type: "CPU"}, nil)
+	if err == nil || traced {
+		t.Errorf("expected an error building the trace command, instead got %t: %v", traced, err)
+	}
+	if files, _ := ioutil.ReadDir(traceDir); len(files) != 0 {
+		t.Errorf("expected no trace to be written, instead got %d files", len(files))
+	}
+}
+
+func TestRunTraceRefusedBelowFreeSpaceFloor(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.Dryrun = true
+	traceConfig.TargetName = "refused"
+	traceConfig.Retention.MinFreeMiB = math.MaxInt64 / (1024 * 1024)
+
+	traced, err := runTrace(context.Background(), &processtest.Process{ID: os.Getpid()}, traceConfig, Trigger{Type: "CPU"}, nil)
+	if !errors.Is(err, retention.ErrInsufficientSpace) || traced {
+		t.Errorf("expected the trace to be refused, instead got %t: %v", traced, err)
+	}
+	if refused := metrics.TracesRefused.Value("refused", ReasonDiskSpace); refused != 1 {
+		t.Errorf("expected 1 refused trace, instead got %v", refused)
+	}
+	if files, _ := ioutil.ReadDir(traceDir); len(files) != 0 {
+		t.Errorf("expected no trace to be written, instead got %d files", len(files))
+	}
+}
+
+func TestStartTraceRefusedWithoutCooldown(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.Dryrun = true
+	traceConfig.TargetName = "refused-cooldown"
+	traceConfig.Cooldown.Target = 300
+	traceConfig.Retention.MinFreeMiB = math.MaxInt64 / (1024 * 1024)
+
+	p := &processtest.Process{ID: os.Getpid()}
+	key := cooldownKey(p, traceConfig, nil)
+	if key.StartTime == 0 {
+		t.Error("expected the start time of the process to be part of the cooldown key")
+	}
+	if err := startTrace(context.Background(), p, process.NewHistory(1), traceConfig, key, Trigger{Type: "CPU"}, nil); err == nil {
+		t.Error("expected the trace to be refused")
+	}
+	if err := cooldowns.Check(traceConfig.Cooldown.Policy(), key); err != nil {
+		t.Errorf("expected no cooldown to start for a trace that didn't run, instead got %v", err)
+	}
+}
+
+func TestStartTraceRefusedKeepsHistory(t *testing.T) {
+	traceConfig := config.Default()
+	traceConfig.TargetName = "hourly"
+	traceConfig.Cooldown.MaxTracesPerHour = 1
+	policy := traceConfig.Cooldown.Policy()
+	release, err := cooldowns.Acquire(policy, cooldown.Key{Target: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release(false)
+
+	history := process.NewHistory(2)
+	history.Add(process.Sample{CPU: 200})
+	p := &processtest.Process{ID: os.Getpid()}
+	if err := startTrace(context.Background(), p, history, traceConfig, cooldownKey(p, traceConfig, nil), Trigger{Type: "CPU"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if refused := metrics.TracesRefused.Value("hourly", cooldown.ReasonHourly); refused != 1 {
+		t.Errorf("expected the trace to be refused by the hourly limit, instead got %v", refused)
+	}
+	if len(history.Samples()) != 1 {
+		t.Error("expected the history to be kept so the process is traced once allowed")
+	}
+}
+
+func TestRetentionDirGroupsTraceFiles(t *testing.T) {
+	tests := map[string]string{
+		"web-1234-2020-08-01T12:00:00Z.trace":                    "web-1234-2020-08-01T12:00:00Z.trace",
+		"1234-2020-08-01T22:00:00+10:00.txt.meta.json":           "1234-2020-08-01T22:00:00+10:00.txt",
+		"web-1234-2020-08-01T12:00:00Z.trace" + pprof.FileSuffix: "web-1234-2020-08-01T12:00:00Z.trace",
+		"notes.txt":                      "",
+		"1234.trace":                     "",
+		"2020-08-01T12:00:00Z.trace":     "",
+		"backup.tar.gz" + MetadataSuffix: "",
+	}
+	dir := RetentionDir("traces")
+	for name, expected := range tests {
+		trace, ok := dir.Group(name)
+		if expected == "" && ok {
+			t.Errorf("expected %s not to be part of a trace, instead grouped with %s", name, trace)
+		}
+		if expected != "" && (!ok || trace != expected) {
+			t.Errorf("expected %s to be grouped with %s, instead got %s %v", name, expected, trace, ok)
+		}
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	metadata := Metadata{OutputFormat: "phpspy", TraceFile: "4242-2020-08-01T12:00:00Z.trace"}
+	contents := "0 usleep <internal>:-1\n1 <main> /var/www/index.php:3\n\n"
+	if err := ioutil.WriteFile(filepath.Join(traceDir, metadata.TraceFile), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profileFileName, err := writeProfile(traceDir, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profileFileName != "4242-2020-08-01T12:00:00Z.trace.pb.gz" {
+		t.Errorf("unexpected profile file name %s", profileFileName)
+	}
+	if info, err := os.Stat(filepath.Join(traceDir, profileFileName)); err != nil || info.Size() == 0 {
+		t.Errorf("expected the profile to be written: %v", err)
+	}
+
+	// the tracer failing to attach leaves a trace without any stacks
+	if err := ioutil.WriteFile(filepath.Join(traceDir, metadata.TraceFile), []byte("dryrun\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeProfile(traceDir, metadata); err == nil {
+		t.Error("expected converting a trace without stacks to fail")
+	}
+}
+
+func TestAttemptTraceFiresFromHistory(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.TraceDuration = 1
+	traceConfig.Dryrun = true
+	traceConfig.TargetName = "php"
+	traceConfig.ThresholdParams.CPUThreshold = 100
+	traceConfig.ThresholdParams.CPUTriggerCount = 2
+	traceConfig.ThresholdParams.RSSThreshold = math.MaxInt64
+	history := process.NewHistory(traceConfig.ThresholdParams.HistorySize())
+	p := &processtest.Process{ID: os.Getpid()}
+	queue := NewQueue(func() config.QueueConfig { return traceConfig.Queue })
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+
+	traces := func() int {
+		files, err := ioutil.ReadDir(traceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files) / 2
+	}
+	if err := AttemptTrace(context.Background(), p, history, queue, traceConfig); err != nil {
+		t.Fatal(err)
+	}
+	if traces() != 0 || len(history.Samples()) != 1 {
+		t.Fatalf("expected a single sample not to fire the trigger, instead got %d traces", traces())
+	}
+	if err := AttemptTrace(context.Background(), p, history, queue, traceConfig); err != nil {
+		t.Fatal(err)
+	}
+	waitIdle(t, queue)
+	if traces() != 1 {
+		t.Fatalf("expected the second sample above the threshold to fire the trigger, instead got %d traces", traces())
+	}
+	if samples := history.Samples(); len(samples) != 0 {
+		t.Errorf("expected the history to be cleared once the trace was started, instead got %+v", samples)
+	}
+
+	// the process is cooling down after the trace so firing again doesn't trace it
+	refused := metrics.TracesRefused.Value("php", cooldown.ReasonPID)
+	for i := 0; i < 2; i++ {
+		if err := AttemptTrace(context.Background(), p, history, queue, traceConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if traces() != 1 || metrics.TracesRefused.Value("php", cooldown.ReasonPID) != refused+1 {
+		t.Errorf("expected the trace to be refused by the pid cooldown, instead got %d traces", traces())
+	}
+	if len(history.Samples()) != 2 {
+		t.Errorf("expected the history to be kept while the trace is refused")
+	}
+	state := CooldownState()
+	if len(state.PIDs) != 1 || state.PIDs[0].Name != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the process to be cooling down, instead got %+v", state.PIDs)
+	}
+}
+
+// waitIdle waits for the traces queued to finish
+func waitIdle(t *testing.T, queue *Queue) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !queue.idle() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the queued traces to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAttemptTraceScriptedSamples(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "phunter-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(traceDir)
+	command := systemtest.NewCommand()
+	clock, runner := useFakes(t, command)
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.TraceDuration = 30
+	traceConfig.TargetName = "scripted"
+	traceConfig.ThresholdParams.CPUThreshold = 100
+	traceConfig.ThresholdParams.CPUTriggerCount = 2
+	traceConfig.ThresholdParams.RSSThreshold = math.MaxInt64
+	history := process.NewHistory(traceConfig.ThresholdParams.HistorySize())
+	// a pid that isn't running so no other test has it locked
+	p := &processtest.Process{ID: math.MaxInt32, CPU: []float64{50, 150, 90, 150, 150}}
+	queue := NewQueue(func() config.QueueConfig { return traceConfig.Queue })
+	stop := make(chan struct{})
+	go queue.Run(stop)
+
+	for i := 0; i < 5; i++ {
+		if len(runner.Started()) != 0 {
+			t.Fatalf("expected the trigger not to fire before the fifth sample, fired after %d", i)
+		}
+		if err := AttemptTrace(context.Background(), p, history, queue, traceConfig); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Duration(traceConfig.CheckInterval) * time.Second)
+	}
+	// the trace is waiting for the trace duration to pass
+	waitForWaiters(t, clock, 1)
+	if started := runner.Started(); len(started) != 1 || !reflect.DeepEqual(started[0][:3], []string{"phpspy", "-p", strconv.Itoa(math.MaxInt32)}) {
+		t.Fatalf("expected phpspy to be started against the process, instead got %q", started)
+	}
+	clock.Advance(30 * time.Second)
+	close(stop)
+	queue.Wait()
+
+	files, err := filepath.Glob(filepath.Join(traceDir, "*"+MetadataSuffix))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a trace, instead got %v: %v", files, err)
+	}
+	metadata, err := ReadMetadata(traceDir, strings.TrimSuffix(filepath.Base(files[0]), MetadataSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != TraceStatusStopped || metadata.CPU != 150 || len(metadata.Samples) != 6 {
+		t.Errorf("unexpected trace %+v", metadata)
+	}
+	if interval := metadata.Samples[4].Time.Sub(metadata.Samples[2].Time); interval != 30*time.Second {
+		t.Errorf("expected the samples to be a check interval apart, instead got %s", interval)
+	}
+
+	// the cooldown is timed by the same clock as the trace
+	if state := CooldownState(); len(state.PIDs) != 1 || state.PIDs[0].RemainingSeconds != float64(traceConfig.Cooldown.PID) {
+		t.Errorf("expected the process to be cooling down from the end of the trace, instead got %+v", state.PIDs)
+	}
+	clock.Advance(time.Duration(traceConfig.Cooldown.PID) * time.Second)
+	if state := CooldownState(); len(state.PIDs) != 0 {
+		t.Errorf("expected the cooldown to end, instead got %+v", state.PIDs)
+	}
+}
+
+func TestAttemptTraceLocksPIDForEveryTarget(t *testing.T) {
+	pid := math.MaxInt32 - 1
+	lock, _, _ := lockTrace(pid, "php")
+	defer lock.release()
+
+	traceConfig := config.Default()
+	traceConfig.TargetName = "python"
+	skipped := metrics.TracesSkipped.Value("python")
+	history := process.NewHistory(3)
+	if err := AttemptTrace(context.Background(), &processtest.Process{ID: pid}, history, nil, traceConfig); err != nil {
+		t.Errorf("expected the process to be skipped without an error while it's locked for the php target, instead got %v", err)
+	}
+	if metrics.TracesSkipped.Value("python") != skipped+1 || len(history.Samples()) != 0 {
+		t.Error("expected the skipped check to be counted without sampling the process")
+	}
+}
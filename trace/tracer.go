@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/system"
+	"sort"
+	"sync"
+)
+
+// Tracer builds the command that traces a process for a particular application
+// the command must write the trace to stdout
+type Tracer interface {
+	Command(target Target) ([]string, error)
+	Output() Output
+}
+
+// Target is the process that will be traced
+type Target struct {
+	PID      int
+	Version  string // application version e.g. 74 for php 7.4
+	Duration int    // how long the trace should run for in seconds
+}
+
+// Output describes what a tracer produces
+type Output struct {
+	Format    string // format of the trace e.g. phpspy, collapsed or backtrace
+	Extension string // file extension used for the trace file
+	Bounded   bool   // the tracer exits by itself after the trace duration or after taking a single snapshot
+}
+
+// Factory creates a tracer from the backend's configuration block
+type Factory func(config config.HunterConfig) (Tracer, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a tracer backend available for the application, registering an application twice panics
+func Register(application string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[application]; exists {
+		panic(fmt.Sprintf("tracer already registered for application %s", application))
+	}
+	registry[application] = factory
+}
+
+// Applications returns the applications that have a registered tracer
+func Applications() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	applications := make([]string, 0, len(registry))
+	for application := range registry {
+		applications = append(applications, application)
+	}
+	sort.Strings(applications)
+	return applications
+}
+
+// NewTracer returns the tracer for the configured application
+func NewTracer(config config.HunterConfig) (Tracer, error) {
+	registryMu.RLock()
+	factory, ok := registry[config.Application]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported application %q, supported applications are %v",
+			config.Application, Applications())
+	}
+	return factory(config)
+}
+
+// CheckTracer ensures the tracer for the configured application can be created and its binary is installed
+func CheckTracer(config config.HunterConfig) error {
+	tracer, err := NewTracer(config)
+	if err != nil {
+		return err
+	}
+	command, err := tracer.Command(Target{PID: 1, Version: config.ApplicationVersion, Duration: config.TraceDuration})
+	if err != nil {
+		return err
+	}
+	if !config.Dryrun && !system.CheckBinaryOnPath(command[0]) {
+		return fmt.Errorf("missing binary from path: %s", command[0])
+	}
+	return nil
+}
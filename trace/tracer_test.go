@@ -0,0 +1,120 @@
+package trace
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"reflect"
+	"testing"
+)
+
+var testTarget = Target{PID: 4242, Version: "74", Duration: 10}
+
+func TestNewTracerUnsupportedApplication(t *testing.T) {
+	if _, err := NewTracer(config.HunterConfig{Application: "pyhton"}); err == nil {
+		t.Error("expected an error for an unsupported application")
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering php twice to panic")
+		}
+	}()
+	Register("php", newPHPSpyTracer)
+}
+
+func TestTracerCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   config.HunterConfig
+		expected []string
+		output   Output
+	}{
+		{
+			name:     "php",
+			config:   config.HunterConfig{Application: "php", PHPSpyConfig: config.DefaultPHPSpyConfig()},
+			expected: []string{"phpspy", "-V74", "-p", "4242", "-H", "99", "-b", "4096"},
+			output:   Output{Format: "phpspy", Extension: "trace"},
+		},
+		{
+			name: "python",
+			config: config.HunterConfig{
+				Application: "python",
+				PySpyConfig: config.PySpyConfig{Rate: 50, Native: true},
+			},
+			expected: []string{"py-spy", "record", "--pid", "4242", "--duration", "10", "--format", "raw",
+				"--output", "/dev/stdout", "--rate", "50", "--native"},
+			output: Output{Format: "collapsed", Extension: "txt", Bounded: true},
+		},
+		{
+			name:   "ruby",
+			config: config.HunterConfig{Application: "ruby"},
+			expected: []string{"rbspy", "record", "--pid", "4242", "--duration", "10", "--format", "collapsed",
+				"--file", "/dev/stdout", "--silent"},
+			output: Output{Format: "collapsed", Extension: "txt", Bounded: true},
+		},
+		{
+			name:     "native eu-stack",
+			config:   config.HunterConfig{Application: "native"},
+			expected: []string{"eu-stack", "-p", "4242"},
+			output:   Output{Format: "backtrace", Extension: "txt", Bounded: true},
+		},
+		{
+			name: "native gdb",
+			config: config.HunterConfig{
+				Application:        "native",
+				NativeTracerConfig: config.NativeTracerConfig{Tool: config.NativeToolGDB},
+			},
+			expected: []string{"gdb", "-p", "4242", "-batch", "-ex", "thread apply all bt"},
+			output:   Output{Format: "backtrace", Extension: "txt", Bounded: true},
+		},
+		{
+			name: "command",
+			config: config.HunterConfig{
+				Application: "command",
+				CommandTracerConfig: config.CommandTracerConfig{
+					Args:      []string{"perf", "record", "-p", "{{.PID}}", "--", "sleep", "{{.Duration}}"},
+					Extension: "data",
+				},
+			},
+			expected: []string{"perf", "record", "-p", "4242", "--", "sleep", "10"},
+			output:   Output{Format: "raw", Extension: "data"},
+		},
+	}
+
+	for _, test := range tests {
+		tracer, err := NewTracer(test.config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		command, err := tracer.Command(testTarget)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(command, test.expected) {
+			t.Errorf("%s: expected command %v, instead got: %v", test.name, test.expected, command)
+		}
+		if tracer.Output() != test.output {
+			t.Errorf("%s: expected output %+v, instead got: %+v", test.name, test.output, tracer.Output())
+		}
+	}
+}
+
+func TestCommandTracerInvalidTemplate(t *testing.T) {
+	cfg := config.HunterConfig{
+		Application:         "command",
+		CommandTracerConfig: config.CommandTracerConfig{Args: []string{"trace", "{{.Pid}}"}},
+	}
+	tracer, err := NewTracer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracer.Command(testTarget); err == nil {
+		t.Error("expected an error rendering an unknown field")
+	}
+
+	cfg.CommandTracerConfig.Args = []string{"trace", "{{.PID"}
+	if _, err := NewTracer(cfg); err == nil {
+		t.Error("expected an error parsing an invalid template")
+	}
+}
@@ -0,0 +1,95 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Client uploads objects to an S3 compatible bucket such as AWS S3 or MinIO
+type S3Client struct {
+	Endpoint    *url.URL
+	Region      string
+	Bucket      string
+	PathStyle   bool // address the bucket as endpoint/bucket rather than bucket.endpoint
+	Credentials Credentials
+	HTTPClient  *http.Client
+}
+
+// StatusError is returned when S3 responds with an error
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// ObjectURL returns the URL of an object in the bucket
+func (c *S3Client) ObjectURL(key string) *url.URL {
+	objectURL := *c.Endpoint
+	path := strings.TrimSuffix(objectURL.Path, "/")
+	if c.PathStyle {
+		path += "/" + c.Bucket
+	} else {
+		objectURL.Host = c.Bucket + "." + objectURL.Host
+	}
+	objectURL.Path = path + "/" + strings.TrimPrefix(key, "/")
+	objectURL.RawPath = ""
+	return &objectURL
+}
+
+// PutFile uploads the contents of a file to key
+func (c *S3Client) PutFile(key, filePath, contentType string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// the body is hashed to sign the request then rewound to send it
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.ObjectURL(key).String(), ioutil.NopCloser(file))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	signRequest(req, c.Credentials, c.Region, hex.EncodeToString(hash.Sum(nil)), time.Now())
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return size, nil
+}
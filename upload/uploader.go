@@ -0,0 +1,254 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/metrics"
+	"github.com/daniel-cole/phunter/system"
+	"github.com/daniel-cole/phunter/trace"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultQueueSize is how many finished traces can wait to be uploaded before new traces are dropped
+const DefaultQueueSize = 100
+
+// KeyData is available to the key template, e.g. {{.Node}}/{{.Date}}/{{.Container}}/{{.File}}
+type KeyData struct {
+	Node        string // kubernetes node name or hostname
+	Container   string // container or pod display name, host when the process isn't in a container
+	Namespace   string // kubernetes namespace, empty outside of kubernetes
+	Pod         string // kubernetes pod name, empty outside of kubernetes
+	Target      string
+	Application string
+	PID         int
+	Timestamp   string // when the trace started in RFC 3339 format
+	Date        string // the day the trace started in YYYY-MM-DD format
+	File        string // the trace or metadata file name
+}
+
+// Job is a finished trace to upload along with the configuration it was traced with
+type Job struct {
+	Config   config.HunterConfig
+	Metadata trace.Metadata
+}
+
+// Uploader uploads finished traces and their metadata in the background, retrying failed uploads with backoff
+type Uploader struct {
+	jobs  chan Job
+	clock system.Clock  // times the backoff between attempts
+	done  chan struct{} // closed when Run returns
+}
+
+// NewUploader returns an uploader that queues up to queueSize traces
+func NewUploader(queueSize int) *Uploader {
+	return &Uploader{jobs: make(chan Job, queueSize), clock: system.RealClock, done: make(chan struct{})}
+}
+
+// Enqueue queues a finished trace to be uploaded if uploading is enabled in its configuration
+// the trace is dropped, and false returned, when the queue is full
+func (u *Uploader) Enqueue(job Job) bool {
+	if !job.Config.Upload.Enabled {
+		return true
+	}
+	select {
+	case u.jobs <- job:
+		metrics.UploadQueueLength.Set(float64(len(u.jobs)))
+		return true
+	default:
+		logrus.WithField("trace", job.Metadata.TraceFile).Error("upload queue is full, trace will not be uploaded")
+		metrics.Uploads.Inc("dropped")
+		return false
+	}
+}
+
+// Run uploads queued traces one at a time until stopped, the traces already queued when stopped are
+// still uploaded but failed uploads aren't retried
+func (u *Uploader) Run(stop <-chan struct{}) {
+	defer close(u.done)
+	for {
+		select {
+		case <-stop:
+			if len(u.jobs) > 0 {
+				logrus.Infof("uploading %d queued traces before stopping", len(u.jobs))
+			}
+			for {
+				select {
+				case job := <-u.jobs:
+					u.run(job, stop)
+				default:
+					return
+				}
+			}
+		case job := <-u.jobs:
+			u.run(job, stop)
+		}
+	}
+}
+
+// Done returns a channel that's closed once Run has uploaded the queued traces and returned
+func (u *Uploader) Done() <-chan struct{} {
+	return u.done
+}
+
+func (u *Uploader) run(job Job, stop <-chan struct{}) {
+	metrics.UploadQueueLength.Set(float64(len(u.jobs)))
+	if err := u.Upload(job, stop); err != nil {
+		logrus.WithField("trace", job.Metadata.TraceFile).Errorf("failed to upload trace: %v", err)
+		metrics.Uploads.Inc("failure")
+		return
+	}
+	metrics.Uploads.Inc("success")
+}
+
+// Upload uploads a trace followed by its metadata, so the metadata being present means the trace is complete
+func (u *Uploader) Upload(job Job, stop <-chan struct{}) error {
+	uploadConfig := job.Config.Upload
+	client, err := NewS3Client(uploadConfig)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithFields(logrus.Fields{"trace": job.Metadata.TraceFile, "bucket": uploadConfig.Bucket})
+
+	files := []struct{ name, contentType string }{{job.Metadata.TraceFile, "application/octet-stream"}}
+	if job.Metadata.PprofFile != "" {
+		files = append(files, struct{ name, contentType string }{job.Metadata.PprofFile, "application/octet-stream"})
+	}
+	// the metadata is uploaded last so it's only there once the files it describes are
+	files = append(files, struct{ name, contentType string }{trace.MetadataFileName(job.Metadata.TraceFile), "application/json"})
+	for _, file := range files {
+		key, err := ObjectKey(uploadConfig.KeyTemplate, NewKeyData(job.Config, job.Metadata, file.name))
+		if err != nil {
+			return err
+		}
+		filePath := filepath.Join(job.Config.TraceDir, file.name)
+		err = u.retry(uploadConfig, stop, func() error {
+			size, err := client.PutFile(key, filePath, file.contentType)
+			if err == nil {
+				metrics.UploadBytes.Add(float64(size))
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s to %s: %v", file.name, key, err)
+		}
+		log.Infof("uploaded %s to %s", file.name, key)
+	}
+
+	if uploadConfig.DeleteAfterUpload {
+		for _, file := range files {
+			if err := os.Remove(filepath.Join(job.Config.TraceDir, file.name)); err != nil && !os.IsNotExist(err) {
+				log.Errorf("failed to delete uploaded file %s: %v", file.name, err)
+			}
+		}
+		log.Info("deleted local copy of uploaded trace")
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, fails with an error that isn't temporary, or max_attempts is reached
+// waiting initial_backoff seconds after the first attempt and doubling the wait after each attempt up to max_backoff
+func (u *Uploader) retry(uploadConfig config.UploadConfig, stop <-chan struct{}, f func() error) error {
+	backoff := time.Duration(uploadConfig.InitialBackoff) * time.Second
+	maxBackoff := time.Duration(uploadConfig.MaxBackoff) * time.Second
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !temporary(err) || attempt >= uploadConfig.MaxAttempts {
+			return err
+		}
+		logrus.Warnf("upload attempt %d/%d failed, retrying in %s: %v", attempt, uploadConfig.MaxAttempts, backoff, err)
+		metrics.UploadRetries.Inc()
+		if !u.sleep(backoff, stop) {
+			return fmt.Errorf("stopped before upload succeeded: %v", err)
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// temporary reports whether an upload that failed with err may succeed if retried
+func temporary(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Temporary()
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// sleep waits for d, returning false if stopped first
+func (u *Uploader) sleep(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-u.clock.After(d):
+		return true
+	}
+}
+
+// NewS3Client returns a client for the bucket in the upload configuration
+func NewS3Client(uploadConfig config.UploadConfig) (*S3Client, error) {
+	endpoint, err := uploadConfig.EndpointURL()
+	if err != nil {
+		return nil, err
+	}
+	accessKeyID, secretAccessKey, sessionToken := uploadConfig.Credentials()
+	return &S3Client{
+		Endpoint:    endpoint,
+		Region:      uploadConfig.Region,
+		Bucket:      uploadConfig.Bucket,
+		PathStyle:   uploadConfig.PathStyle,
+		Credentials: Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey, SessionToken: sessionToken},
+		HTTPClient:  &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// NewKeyData returns the values available to the key template for a file belonging to a trace
+func NewKeyData(traceConfig config.HunterConfig, metadata trace.Metadata, fileName string) KeyData {
+	data := KeyData{
+		Node:        metadata.Node(traceConfig),
+		Container:   "host",
+		Target:      metadata.Target,
+		Application: metadata.Application,
+		PID:         metadata.PID,
+		Timestamp:   metadata.StartTime.Format(time.RFC3339),
+		Date:        metadata.StartTime.Format("2006-01-02"),
+		File:        fileName,
+	}
+	if c := metadata.Container; c != nil {
+		data.Container = c.DisplayName()
+		if c.Pod != nil {
+			data.Namespace = c.Pod.Namespace
+			data.Pod = c.Pod.Name
+		}
+	}
+	return data
+}
+
+// ObjectKey renders the key template, returning an error if the key is empty
+func ObjectKey(keyTemplate string, data KeyData) (string, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(keyTemplate)
+	if err != nil {
+		return "", err
+	}
+	var key bytes.Buffer
+	if err := tmpl.Execute(&key, data); err != nil {
+		return "", err
+	}
+	// clean up the empty segments left by values that aren't set e.g. the namespace outside of kubernetes
+	cleaned := strings.TrimPrefix(path.Clean("/"+key.String()), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("key template %q rendered an empty key", keyTemplate)
+	}
+	return cleaned, nil
+}
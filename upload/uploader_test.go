@@ -0,0 +1,304 @@
+package upload
+
+import (
+	"github.com/daniel-cole/phunter/config"
+	"github.com/daniel-cole/phunter/container"
+	"github.com/daniel-cole/phunter/system/systemtest"
+	"github.com/daniel-cole/phunter/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a MinIO style stand-in that stores objects in memory after checking the request signature
+type fakeS3 struct {
+	*httptest.Server
+	t           *testing.T
+	credentials Credentials
+
+	mu       sync.Mutex
+	objects  map[string]string // path style /bucket/key to contents
+	requests int
+	failures []int // status codes to respond with before succeeding
+}
+
+func newFakeS3(t *testing.T, failures ...int) *fakeS3 {
+	s := &fakeS3{
+		t:           t,
+		credentials: Credentials{AccessKeyID: "minio", SecretAccessKey: "minio123"},
+		objects:     make(map[string]string),
+		failures:    failures,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if hashHex(body) != r.Header.Get("X-Amz-Content-Sha256") {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+	if !s.validSignature(r) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.objects[r.URL.Path] = string(body)
+}
+
+// validSignature signs a copy of the request with the server's credentials and compares the signatures
+func (s *fakeS3) validSignature(r *http.Request) bool {
+	signedAt, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	signed := &http.Request{Method: r.Method, URL: r.URL, Host: r.Host, Header: http.Header{}}
+	for _, name := range []string{"Content-Type", "X-Amz-Content-Sha256", "X-Amz-Date"} {
+		signed.Header.Set(name, r.Header.Get(name))
+	}
+	signRequest(signed, s.credentials, "us-east-1", r.Header.Get("X-Amz-Content-Sha256"), signedAt)
+	return signed.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (s *fakeS3) object(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contents, ok := s.objects[path]
+	return contents, ok
+}
+
+func newTestJob(t *testing.T, s *fakeS3) Job {
+	traceDir, err := ioutil.TempDir("", "phunter-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(traceDir) })
+
+	metadata := trace.Metadata{
+		PID:       4242,
+		TraceFile: "web-4242-2020-08-01T12:00:00Z.txt",
+		StartTime: time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC),
+		Container: &container.Info{Name: "web", Pod: &container.Pod{Name: "web-abcde", Namespace: "shop", Node: "node-1"}},
+	}
+	files := map[string]string{metadata.TraceFile: "trace contents", trace.MetadataFileName(metadata.TraceFile): "{}"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(traceDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	traceConfig := config.Default()
+	traceConfig.TraceDir = traceDir
+	traceConfig.Upload = config.DefaultUploadConfig()
+	traceConfig.Upload.Enabled = true
+	traceConfig.Upload.Endpoint = s.URL
+	traceConfig.Upload.Bucket = "traces"
+	traceConfig.Upload.PathStyle = true
+	traceConfig.Upload.AccessKeyID = s.credentials.AccessKeyID
+	traceConfig.Upload.SecretAccessKey = s.credentials.SecretAccessKey
+	traceConfig.Upload.InitialBackoff = 0
+	traceConfig.Upload.MaxAttempts = 3
+	return Job{Config: traceConfig, Metadata: metadata}
+}
+
+func newTestUploader() *Uploader {
+	u := NewUploader(1)
+	u.clock = systemtest.NewClock(time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC))
+	return u
+}
+
+func TestUpload(t *testing.T) {
+	s := newFakeS3(t)
+	job := newTestJob(t, s)
+
+	if err := newTestUploader().Upload(job, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/traces/node-1/2020-08-01/shop_web-abcde/web-4242-2020-08-01T12:00:00Z.txt":           "trace contents",
+		"/traces/node-1/2020-08-01/shop_web-abcde/web-4242-2020-08-01T12:00:00Z.txt.meta.json": "{}",
+	}
+	for path, contents := range expected {
+		if actual, ok := s.object(path); !ok || actual != contents {
+			t.Errorf("expected %s to contain %q, instead got %q", path, contents, actual)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(job.Config.TraceDir, job.Metadata.TraceFile)); err != nil {
+		t.Errorf("expected the local copy to be kept: %v", err)
+	}
+}
+
+func TestUploadRetriesTemporaryErrors(t *testing.T) {
+	s := newFakeS3(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	job := newTestJob(t, s)
+	job.Config.Upload.DeleteAfterUpload = true
+
+	if err := newTestUploader().Upload(job, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.requests != 4 {
+		t.Errorf("expected 2 failed and 2 successful requests, instead got %d requests", s.requests)
+	}
+	if files, _ := ioutil.ReadDir(job.Config.TraceDir); len(files) != 0 {
+		t.Errorf("expected the local copy to be deleted after upload, instead %d files remain", len(files))
+	}
+}
+
+func TestUploadGivesUp(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         []int
+		expectedRequests int
+	}{
+		{"after max attempts", []int{500, 502, 503, 504}, 3},
+		{"on errors that aren't temporary", []int{http.StatusForbidden}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newFakeS3(t, test.failures...)
+			job := newTestJob(t, s)
+			job.Config.Upload.DeleteAfterUpload = true
+
+			if err := newTestUploader().Upload(job, nil); err == nil {
+				t.Fatal("expected the upload to fail")
+			}
+			if s.requests != test.expectedRequests {
+				t.Errorf("expected %d requests, instead got %d", test.expectedRequests, s.requests)
+			}
+			if files, _ := ioutil.ReadDir(job.Config.TraceDir); len(files) != 2 {
+				t.Errorf("expected the local copy to be kept when the upload fails, instead %d files remain", len(files))
+			}
+		})
+	}
+}
+
+func TestUploadStoppedDuringBackoff(t *testing.T) {
+	s := newFakeS3(t, http.StatusServiceUnavailable)
+	job := newTestJob(t, s)
+	job.Config.Upload.InitialBackoff = 10
+	u := newTestUploader()
+	stop := make(chan struct{})
+	close(stop)
+
+	// the fake clock never passes the backoff so only stopping ends the wait
+	if err := u.Upload(job, stop); err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Errorf("expected the upload to be stopped while waiting to retry, instead got %v", err)
+	}
+	if s.requests != 1 {
+		t.Errorf("expected a single attempt before stopping, instead got %d requests", s.requests)
+	}
+}
+
+func TestUploadWrongCredentials(t *testing.T) {
+	s := newFakeS3(t)
+	job := newTestJob(t, s)
+	job.Config.Upload.SecretAccessKey = "wrong"
+
+	if err := newTestUploader().Upload(job, nil); err == nil {
+		t.Fatal("expected the upload to be rejected")
+	}
+	if s.requests != 1 {
+		t.Errorf("expected a rejected signature not to be retried, instead got %d requests", s.requests)
+	}
+}
+
+func TestRunUploadsQueuedTraces(t *testing.T) {
+	s := newFakeS3(t)
+	job := newTestJob(t, s)
+	u := newTestUploader()
+	stop := make(chan struct{})
+	go u.Run(stop)
+
+	disabled := job
+	disabled.Config.Upload.Enabled = false
+	if !u.Enqueue(disabled) || !u.Enqueue(job) {
+		t.Fatal("expected the traces to be queued")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.object("/traces/node-1/2020-08-01/shop_web-abcde/web-4242-2020-08-01T12:00:00Z.txt.meta.json"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the trace to be uploaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-u.Done()
+	if s.requests != 2 {
+		t.Errorf("expected only the enabled trace to be uploaded, instead got %d requests", s.requests)
+	}
+}
+
+func TestRunUploadsQueuedTracesWhenStopped(t *testing.T) {
+	s := newFakeS3(t)
+	job := newTestJob(t, s)
+	u := newTestUploader()
+	if !u.Enqueue(job) {
+		t.Fatal("expected the trace to be queued")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	go u.Run(stop)
+	select {
+	case <-u.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the uploader to stop")
+	}
+	if s.requests != 2 {
+		t.Errorf("expected the queued trace to be uploaded before stopping, instead got %d requests", s.requests)
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	endpoint, _ := url.Parse("https://s3.eu-west-1.amazonaws.com")
+	client := &S3Client{Endpoint: endpoint, Bucket: "traces"}
+	if actual := client.ObjectURL("node-1/a b.txt").String(); actual != "https://traces.s3.eu-west-1.amazonaws.com/node-1/a%20b.txt" {
+		t.Errorf("unexpected virtual hosted style URL: %s", actual)
+	}
+	client.PathStyle = true
+	if actual := client.ObjectURL("node-1/a.txt").String(); actual != "https://s3.eu-west-1.amazonaws.com/traces/node-1/a.txt" {
+		t.Errorf("unexpected path style URL: %s", actual)
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	data := KeyData{Node: "node-1", Container: "host", PID: 4242, Date: "2020-08-01", File: "4242.txt"}
+
+	key, err := ObjectKey("phunter/{{.Node}}/{{.Namespace}}/{{.Container}}/{{.PID}}/{{.File}}", data)
+	if err != nil || key != "phunter/node-1/host/4242/4242.txt" {
+		t.Errorf("expected empty segments to be removed, instead got %q: %v", key, err)
+	}
+	if _, err := ObjectKey("{{.Nod}}/{{.File}}", data); err == nil {
+		t.Error("expected an unknown field to be rejected")
+	}
+	if _, err := ObjectKey("{{.Namespace}}", data); err == nil {
+		t.Error("expected an empty key to be rejected")
+	}
+}